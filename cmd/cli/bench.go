@@ -0,0 +1,259 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/c4pt0r/tipubsub"
+)
+
+// benchKey identifies a published message, the payload starts with
+// "<publisher>:<seq>:" so subscribers can check loss and duplication
+type benchKey struct {
+	publisher int
+	seq       int64
+}
+
+func benchPayload(publisher int, seq int64, size int) string {
+	prefix := fmt.Sprintf("%d:%d:", publisher, seq)
+	if len(prefix) >= size {
+		return prefix
+	}
+	return prefix + strings.Repeat("x", size-len(prefix))
+}
+
+func parseBenchPayload(data string) (benchKey, bool) {
+	parts := strings.SplitN(data, ":", 3)
+	if len(parts) != 3 {
+		return benchKey{}, false
+	}
+	p, err1 := strconv.Atoi(parts[0])
+	seq, err2 := strconv.ParseInt(parts[1], 10, 64)
+	if err1 != nil || err2 != nil {
+		return benchKey{}, false
+	}
+	return benchKey{p, seq}, true
+}
+
+type benchSubscriber struct {
+	streamName string
+	id         string
+	ch         <-chan tipubsub.Message
+
+	mu        sync.Mutex
+	seen      map[benchKey]int
+	latencies []time.Duration
+	received  int64
+}
+
+func (s *benchSubscriber) run(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case msg, ok := <-s.ch:
+			if !ok {
+				return
+			}
+			latency := time.Duration(time.Now().UnixNano() - msg.Ts)
+			key, ok := parseBenchPayload(msg.Data)
+			s.mu.Lock()
+			if ok {
+				s.seen[key]++
+			}
+			s.latencies = append(s.latencies, latency)
+			s.mu.Unlock()
+			atomic.AddInt64(&s.received, 1)
+		}
+	}
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p)
+	return sorted[i]
+}
+
+func ms(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 2, 64)
+}
+
+func runBench(args []string) error {
+	usage := errUsage{findCommand("bench").usage}
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	numStreams := fs.Int("streams", 1, "number of streams")
+	numPubs := fs.Int("publishers", 1, "number of publishers, spread over the streams")
+	numSubs := fs.Int("subscribers", 1, "number of subscribers per stream")
+	size := fs.Int("size", 128, "message size in bytes")
+	batch := fs.Int("batch", 0, "messages per synchronous publish, 0 publishes through the hub queue")
+	duration := fs.Duration("duration", 10*time.Second, "how long to publish")
+	messages := fs.Int64("messages", 0, "messages per publisher, overrides -duration")
+	drain := fs.Duration("drain-timeout", 30*time.Second, "how long to wait for subscribers after publishing")
+	prefix := fs.String("prefix", "bench", "stream name prefix")
+	keep := fs.Bool("keep", false, "keep the bench streams")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return usage
+	}
+	if *numStreams <= 0 || *numPubs <= 0 || *numSubs < 0 || *size <= 0 || *batch < 0 {
+		return usage
+	}
+
+	run := randomString(6)
+	streams := make([]string, *numStreams)
+	for i := range streams {
+		streams[i] = fmt.Sprintf("%s_%s_%d", *prefix, run, i)
+		if err := hub.CreateStream(streams[i]); err != nil {
+			return err
+		}
+	}
+	if !*keep {
+		defer func() {
+			for _, name := range streams {
+				hub.DeleteStream(name)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	var subs []*benchSubscriber
+	for _, name := range streams {
+		for i := 0; i < *numSubs; i++ {
+			id := fmt.Sprintf("bench-%s-%d", run, i)
+			ch, err := hub.Subscribe(name, id)
+			if err != nil {
+				return err
+			}
+			sub := &benchSubscriber{streamName: name, id: id, ch: ch, seen: map[benchKey]int{}}
+			subs = append(subs, sub)
+			go sub.run(done)
+		}
+	}
+	defer close(done)
+
+	// publish
+	published := make([]int64, *numPubs)
+	errCh := make(chan error, *numPubs)
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(*duration)
+	for p := 0; p < *numPubs; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			streamName := streams[p%len(streams)]
+			var seq int64
+			more := func() bool {
+				if *messages > 0 {
+					return seq < *messages
+				}
+				return time.Now().Before(deadline)
+			}
+			for more() {
+				if *batch == 0 {
+					if err := hub.Publish(streamName, &tipubsub.Message{Data: benchPayload(p, seq, *size)}); err != nil {
+						errCh <- err
+						return
+					}
+					seq++
+				} else {
+					msgs := make([]*tipubsub.Message, 0, *batch)
+					for len(msgs) < *batch && (*messages == 0 || seq < *messages) {
+						msgs = append(msgs, &tipubsub.Message{Data: benchPayload(p, seq, *size)})
+						seq++
+					}
+					if err := hub.PublishSync(streamName, msgs...); err != nil {
+						errCh <- err
+						return
+					}
+				}
+				atomic.StoreInt64(&published[p], seq)
+			}
+		}(p)
+	}
+	wg.Wait()
+	// queued messages are only published once they are written
+	if *batch == 0 {
+		for _, name := range streams {
+			hub.CloseStream(name)
+		}
+	}
+	elapsed := time.Since(start)
+	close(errCh)
+	if err := <-errCh; err != nil {
+		return err
+	}
+
+	// expected messages per stream
+	expected := map[string]int64{}
+	var total int64
+	for p, n := range published {
+		expected[streams[p%len(streams)]] += n
+		total += n
+	}
+
+	// wait for the subscribers to catch up
+	drainDeadline := time.Now().Add(*drain)
+	for time.Now().Before(drainDeadline) {
+		caughtUp := true
+		for _, sub := range subs {
+			if atomic.LoadInt64(&sub.received) < expected[sub.streamName] {
+				caughtUp = false
+				break
+			}
+		}
+		if caughtUp {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for _, sub := range subs {
+		hub.Unsubscribe(sub.streamName, sub.id)
+	}
+
+	var latencies []time.Duration
+	var received, lost, duplicated int64
+	for _, sub := range subs {
+		sub.mu.Lock()
+		latencies = append(latencies, sub.latencies...)
+		received += int64(len(sub.latencies))
+		for _, n := range sub.seen {
+			if n > 1 {
+				duplicated += int64(n - 1)
+			}
+		}
+		lost += expected[sub.streamName] - int64(len(sub.seen))
+		sub.mu.Unlock()
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	secs := elapsed.Seconds()
+	p := newPrinter("metric", "value")
+	defer p.Flush()
+	p.Row("streams", *numStreams)
+	p.Row("publishers", *numPubs)
+	p.Row("subscribers", len(subs))
+	p.Row("message_size", *size)
+	p.Row("batch_size", *batch)
+	p.Row("published", total)
+	p.Row("publish_seconds", strconv.FormatFloat(secs, 'f', 2, 64))
+	p.Row("publish_msgs_per_sec", strconv.FormatFloat(float64(total)/secs, 'f', 0, 64))
+	p.Row("publish_mb_per_sec", strconv.FormatFloat(float64(total)*float64(*size)/secs/1024/1024, 'f', 2, 64))
+	p.Row("received", received)
+	p.Row("lost", lost)
+	p.Row("duplicated", duplicated)
+	p.Row("latency_p50_ms", ms(percentile(latencies, 0.5)))
+	p.Row("latency_p90_ms", ms(percentile(latencies, 0.9)))
+	p.Row("latency_p99_ms", ms(percentile(latencies, 0.99)))
+	if len(latencies) > 0 {
+		p.Row("latency_max_ms", ms(latencies[len(latencies)-1]))
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBenchPayload(t *testing.T) {
+	data := benchPayload(3, 42, 64)
+	if len(data) != 64 {
+		t.Fatalf("payload of %d bytes, want 64", len(data))
+	}
+	if key, ok := parseBenchPayload(data); !ok || key != (benchKey{3, 42}) {
+		t.Fatalf("got %v, %v", key, ok)
+	}
+	// the key is kept when the size is too small for it
+	if key, ok := parseBenchPayload(benchPayload(12, 345, 2)); !ok || key != (benchKey{12, 345}) {
+		t.Fatalf("short payload: got %v, %v", key, ok)
+	}
+	for _, data := range []string{"", "x", "1:2", "a:2:", "1:b:"} {
+		if _, ok := parseBenchPayload(data); ok {
+			t.Errorf("%q parsed", data)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	if percentile(nil, 0.5) != 0 {
+		t.Error("percentile of nothing is not 0")
+	}
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+	for p, want := range map[float64]time.Duration{0.5: 50, 0.99: 99, 1: 100} {
+		if got := percentile(sorted, p); got != want*time.Millisecond {
+			t.Errorf("p%v: got %v, want %v", p*100, got, want*time.Millisecond)
+		}
+	}
+	if ms(1500*time.Microsecond) != "1.50" {
+		t.Errorf("got %s", ms(1500*time.Microsecond))
+	}
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/c4pt0r/tipubsub"
+	"github.com/c4pt0r/tipubsub/webhook"
+)
+
+// errUsage makes the cli exit with code 2
+type errUsage struct {
+	usage string
+}
+
+func (e errUsage) Error() string {
+	return "usage: " + e.usage
+}
+
+// command is shared by the one-shot mode and the shell
+type command struct {
+	name    string
+	aliases []string
+	usage   string
+	help    string
+	run     func(args []string) error
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{
+			name:    "publish",
+			aliases: []string{"pub", "p", "push", "send"},
+			usage:   "publish <streamName> [message...]",
+			help:    "publish messages, read newline-delimited messages from stdin if none is given",
+			run:     runPublish,
+		},
+		{
+			name:  "tail",
+			usage: "tail [-offset id] [-limit n] [-filter expr] [-f] <streamName|pattern>",
+			help:  "print messages after offset, -f keeps waiting for new ones",
+			run:   runTail,
+		},
+		{
+			name:    "subscribe",
+			aliases: []string{"sub", "watch", "listen", "l"},
+			usage:   "subscribe <streamName> [offset]",
+			help:    "same as tail -f, from offset if given",
+			run:     runSubscribe,
+		},
+		{
+			name:    "ls",
+			aliases: []string{"list"},
+			usage:   "ls",
+			help:    "list all stream names",
+			run:     runLs,
+		},
+		{
+			name:    "stat",
+			aliases: []string{"stats", "info"},
+			usage:   "stat <streamName>",
+			help:    "print min and max id of a stream",
+			run:     runStat,
+		},
+		{
+			name:  "gc",
+			usage: "gc <streamName>",
+			help:  "force gc of a stream",
+			run:   runGC,
+		},
+		{
+			name:  "create",
+			usage: "create [-layout auto_increment|auto_random] <streamName>",
+			help:  "create a stream, the layout defaults to the configured one",
+			run:   runCreate,
+		},
+		{
+			name:    "describe",
+			aliases: []string{"desc"},
+			usage:   "describe [-schema] <streamName>",
+			help:    "print counts, id and time range, size and subscribers of a stream",
+			run:     runDescribe,
+		},
+		{
+			name:  "truncate",
+			usage: "truncate <streamName>",
+			help:  "delete all messages of a stream",
+			run:   runTruncate,
+		},
+		{
+			name:    "drop",
+			aliases: []string{"rm"},
+			usage:   "drop <streamName>",
+			help:    "delete a stream with its messages and durable offsets",
+			run:     runDrop,
+		},
+		{
+			name:    "rename",
+			aliases: []string{"mv"},
+			usage:   "rename <streamName> <newName>",
+			help:    "rename a stream",
+			run:     runRename,
+		},
+		{
+			name:  "export",
+			usage: "export [-format ndjson|binary] [-from id] [-to id] [-since time] [-until time] [-resume] <streamName> <file|->",
+			help:  "export messages of a stream to a file",
+			run:   runExport,
+		},
+		{
+			name:  "import",
+			usage: "import [-format ndjson|binary] [-preserve-ts] [-preserve-id] [-resume] <streamName> <file|->",
+			help:  "import exported messages into a stream",
+			run:   runImport,
+		},
+		{
+			name:  "bench",
+			usage: "bench [-streams n] [-publishers n] [-subscribers n] [-size bytes] [-batch n] [-duration d|-messages n] [-keep]",
+			help:  "measure publish throughput, end-to-end latency, loss and duplication",
+			run:   runBench,
+		},
+		{
+			name:  "webhook",
+			usage: "webhook add <name> <streamName> <url> [secret] [batchSize] | ls | rm <name> | pause <name> | resume <name>",
+			help:  "manage webhooks",
+			run:   runWebhook,
+		},
+	}
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+		for _, alias := range c.aliases {
+			if alias == name {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+func runPublish(args []string) error {
+	if len(args) < 1 {
+		return errUsage{"publish <streamName> [message...]"}
+	}
+	streamName := args[0]
+	p := newPrinter("stream_name", "id")
+	defer p.Flush()
+	publish := func(lines []string) error {
+		msgs := make([]*tipubsub.Message, len(lines))
+		for i, line := range lines {
+			msgs[i] = &tipubsub.Message{Data: line}
+		}
+		// publish synchronously so everything is committed before exiting
+		if err := hub.PublishSync(streamName, msgs...); err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			p.Row(streamName, msg.ID)
+		}
+		return nil
+	}
+	if len(args) > 1 && args[1] != "-" {
+		return publish(args[1:])
+	}
+	return readLines(os.Stdin, hub.Config().MaxBatchSize, publish)
+}
+
+// readLines calls fn with batches of at most batchSize non-empty lines
+func readLines(r io.Reader, batchSize int, fn func(lines []string) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var batch []string
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		batch = append(batch, line)
+		if len(batch) >= batchSize {
+			if err := fn(batch); err != nil {
+				return err
+			}
+			batch = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(batch) > 0 {
+		return fn(batch)
+	}
+	return nil
+}
+
+func printMessage(p printer, msg tipubsub.Message) {
+	if msg.Stream != "" {
+		p.Row(msg.Stream, msg.ID, msg.Ts, msg.Data)
+	} else {
+		p.Row(msg.ID, msg.Ts, msg.Data)
+	}
+	p.Flush()
+}
+
+func runTail(args []string) error {
+	usage := errUsage{findCommand("tail").usage}
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+	offsetFlag := fs.String("offset", "", "print messages after this id, default is the beginning, or the end with -f")
+	limit := fs.Int("limit", 0, "stop after printing n messages, 0 means no limit")
+	follow := fs.Bool("f", false, "keep waiting for new messages")
+	filterFlag := fs.String("filter", "", `only print matching messages, e.g. 'header.type == "order" && data.amount > 100'`)
+	if err := fs.Parse(args); err != nil {
+		return usage
+	}
+	if fs.NArg() != 1 {
+		return usage
+	}
+	var filter *tipubsub.Filter
+	if *filterFlag != "" {
+		f, err := tipubsub.ParseFilter(*filterFlag)
+		if err != nil {
+			return err
+		}
+		filter = f
+	}
+	streamName := fs.Arg(0)
+	if tipubsub.IsStreamPattern(streamName) {
+		if !*follow || *offsetFlag != "" {
+			return fmt.Errorf("a stream pattern needs -f and no -offset")
+		}
+		return tailPattern(streamName, filter, *limit)
+	}
+	offset := tipubsub.Offset(0)
+	if *follow {
+		offset = tipubsub.LatestId
+	}
+	if *offsetFlag != "" {
+		o, err := strconv.ParseInt(*offsetFlag, 10, 64)
+		if err != nil {
+			return usage
+		}
+		offset = tipubsub.Offset(o)
+	}
+
+	p := newPrinter("id", "ts", "data")
+	defer p.Flush()
+	printed := 0
+	done := func() bool {
+		return *limit > 0 && printed >= *limit
+	}
+	if !*follow {
+		for !done() {
+			msgs, max, err := hub.FetchMessages(streamName, offset, hub.Config().MaxBatchSize)
+			if err != nil {
+				return err
+			}
+			if len(msgs) == 0 {
+				return nil
+			}
+			for _, msg := range msgs {
+				if done() {
+					break
+				}
+				if filter != nil && !filter.Match(&msg) {
+					continue
+				}
+				printMessage(p, msg)
+				printed++
+			}
+			offset = max
+		}
+		return nil
+	}
+
+	subName := fmt.Sprintf("tail-%s-%s", streamName, randomString(5))
+	ch, err := hub.SubscribeWithFilter(streamName, subName, offset, filter)
+	if err != nil {
+		return err
+	}
+	defer hub.Unsubscribe(streamName, subName)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	defer signal.Stop(c)
+	for !done() {
+		select {
+		case <-c:
+			return nil
+		case msg, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			printMessage(p, msg)
+			printed++
+		}
+	}
+	return nil
+}
+
+// tailPattern prints the new messages of the streams matching pattern
+func tailPattern(pattern string, filter *tipubsub.Filter, limit int) error {
+	subName := fmt.Sprintf("tail-%s", randomString(5))
+	ch, err := hub.SubscribePattern(pattern, subName, filter)
+	if err != nil {
+		return err
+	}
+	defer hub.UnsubscribePattern(subName)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	defer signal.Stop(c)
+	p := newPrinter("stream", "id", "ts", "data")
+	defer p.Flush()
+	for printed := 0; limit <= 0 || printed < limit; printed++ {
+		select {
+		case <-c:
+			return nil
+		case msg, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			printMessage(p, msg)
+		}
+	}
+	return nil
+}
+
+func runSubscribe(args []string) error {
+	switch len(args) {
+	case 1:
+		return runTail([]string{"-f", args[0]})
+	case 2:
+		return runTail([]string{"-f", "-offset", args[1], args[0]})
+	}
+	return errUsage{"subscribe <streamName> [offset]"}
+}
+
+func runLs(args []string) error {
+	if len(args) != 0 {
+		return errUsage{"ls"}
+	}
+	names, err := hub.GetStreamNames()
+	if err != nil {
+		return err
+	}
+	p := newPrinter("stream_name")
+	defer p.Flush()
+	for _, name := range names {
+		p.Row(name)
+	}
+	return nil
+}
+
+func runStat(args []string) error {
+	if len(args) != 1 {
+		return errUsage{"stat <streamName>"}
+	}
+	streamName := args[0]
+	min, max, err := hub.MinMaxID(streamName)
+	if err != nil {
+		return err
+	}
+	p := newPrinter("stream_name", "min_id", "max_id")
+	defer p.Flush()
+	p.Row(streamName, min, max)
+	return nil
+}
+
+func formatTs(ts int64) string {
+	if ts == 0 {
+		return ""
+	}
+	return time.Unix(0, ts).Format(time.RFC3339Nano)
+}
+
+func runCreate(args []string) error {
+	usage := errUsage{findCommand("create").usage}
+	fs := flag.NewFlagSet("create", flag.ContinueOnError)
+	layout := fs.String("layout", "", "table layout, auto_increment or auto_random")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return usage
+	}
+	if *layout == "" {
+		return hub.CreateStream(fs.Arg(0))
+	}
+	l, err := tipubsub.ParseStreamLayout(*layout)
+	if err != nil {
+		return err
+	}
+	return hub.CreateStreamWithLayout(fs.Arg(0), l)
+}
+
+func runDescribe(args []string) error {
+	usage := errUsage{"describe [-schema] <streamName>"}
+	fs := flag.NewFlagSet("describe", flag.ContinueOnError)
+	schema := fs.Bool("schema", false, "also print the CREATE TABLE statement")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return usage
+	}
+	info, err := hub.DescribeStream(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	header := []string{"stream_name", "table_name", "count", "min_id", "max_id", "oldest", "newest", "table_size", "subscribers", "layout", "delayed"}
+	row := []interface{}{info.Name, info.TableName, info.Count, info.MinID, info.MaxID,
+		formatTs(info.OldestTs), formatTs(info.NewestTs), info.TableSize, info.Subscribers, info.Layout, info.Delayed}
+	if *schema {
+		header = append(header, "schema")
+		row = append(row, info.Schema)
+	}
+	p := newPrinter(header...)
+	defer p.Flush()
+	p.Row(row...)
+	return nil
+}
+
+func runTruncate(args []string) error {
+	if len(args) != 1 {
+		return errUsage{"truncate <streamName>"}
+	}
+	deleted, err := hub.TruncateStream(args[0])
+	if err != nil {
+		return err
+	}
+	p := newPrinter("stream_name", "deleted")
+	defer p.Flush()
+	p.Row(args[0], deleted)
+	return nil
+}
+
+func runDrop(args []string) error {
+	if len(args) != 1 {
+		return errUsage{"drop <streamName>"}
+	}
+	return hub.DeleteStream(args[0])
+}
+
+func runRename(args []string) error {
+	if len(args) != 2 {
+		return errUsage{"rename <streamName> <newName>"}
+	}
+	return hub.RenameStream(args[0], args[1])
+}
+
+func runGC(args []string) error {
+	if len(args) != 1 {
+		return errUsage{"gc <streamName>"}
+	}
+	return hub.ForceGC(args[0])
+}
+
+func runWebhook(args []string) error {
+	usage := errUsage{findCommand("webhook").usage}
+	if len(args) < 1 {
+		return usage
+	}
+	r, err := webhook.NewRegistry(hub.DB())
+	if err != nil {
+		return err
+	}
+	sub, args := args[0], args[1:]
+	switch sub {
+	case "add":
+		if len(args) < 3 || len(args) > 5 {
+			return usage
+		}
+		w := &webhook.Webhook{
+			Name:       args[0],
+			StreamName: args[1],
+			URL:        args[2],
+			BatchSize:  1,
+		}
+		if len(args) >= 4 {
+			w.Secret = args[3]
+		}
+		if len(args) == 5 {
+			n, err := strconv.Atoi(args[4])
+			if err != nil || n <= 0 {
+				return errors.New("batchSize must be a positive integer")
+			}
+			w.BatchSize = n
+		}
+		return r.Put(w)
+	case "ls", "list":
+		hooks, err := r.List()
+		if err != nil {
+			return err
+		}
+		p := newPrinter("name", "stream_name", "url", "batch_size", "paused", "last_error")
+		defer p.Flush()
+		for _, w := range hooks {
+			p.Row(w.Name, w.StreamName, w.URL, w.BatchSize, w.Paused, w.LastError)
+		}
+		return nil
+	case "rm", "remove", "del":
+		if len(args) != 1 {
+			return usage
+		}
+		return r.Remove(args[0])
+	case "pause", "resume":
+		if len(args) != 1 {
+			return usage
+		}
+		return r.SetPaused(args[0], sub == "pause", "")
+	}
+	return usage
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/c4pt0r/tipubsub"
+)
+
+func parseTime(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixNano(), nil
+}
+
+func progress(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+}
+
+// resumeExport cuts an interrupted export file after its last complete
+// message and returns the id of that message
+func resumeExport(path string, format tipubsub.ExportFormat) (int64, bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	r, err := tipubsub.NewMessageReader(f, format)
+	if err == io.EOF {
+		// nothing but maybe a partial header
+		return 0, false, os.Truncate(path, 0)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	var lastID int64
+	for {
+		msg, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		lastID = msg.ID
+	}
+	if err := os.Truncate(path, r.Offset()); err != nil {
+		return 0, false, err
+	}
+	if format == tipubsub.FormatNDJSON && r.Offset() > 0 {
+		// the last message may miss its newline, the next ones go on new lines
+		return lastID, true, endWithNewline(path)
+	}
+	return lastID, true, nil
+}
+
+func endWithNewline(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, st.Size()-1); err != nil {
+		return err
+	}
+	if last[0] == '\n' {
+		return nil
+	}
+	_, err = f.WriteAt([]byte{'\n'}, st.Size())
+	return err
+}
+
+func runExport(args []string) error {
+	usage := errUsage{findCommand("export").usage}
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	formatFlag := fs.String("format", string(tipubsub.FormatNDJSON), "ndjson|binary")
+	from := fs.Int64("from", 0, "first message id")
+	to := fs.Int64("to", 0, "last message id")
+	since := fs.String("since", "", "only messages at or after this RFC3339 time")
+	until := fs.String("until", "", "only messages at or before this RFC3339 time")
+	resume := fs.Bool("resume", false, "continue an interrupted export into the same file")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 2 {
+		return usage
+	}
+	format, err := tipubsub.ParseExportFormat(*formatFlag)
+	if err != nil {
+		return err
+	}
+	opts := tipubsub.ExportOptions{
+		FromID: *from,
+		ToID:   *to,
+		Progress: func(exported int64, lastID int64) {
+			progress("exported %d messages, last id %d", exported, lastID)
+		},
+	}
+	if opts.Since, err = parseTime(*since); err != nil {
+		return err
+	}
+	if opts.Until, err = parseTime(*until); err != nil {
+		return err
+	}
+	streamName, path := fs.Arg(0), fs.Arg(1)
+
+	var out io.Writer = os.Stdout
+	withHeader := true
+	if path != "-" {
+		flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if *resume {
+			lastID, found, err := resumeExport(path, format)
+			if err != nil {
+				return err
+			}
+			if found {
+				withHeader = false
+				if lastID+1 > opts.FromID {
+					opts.FromID = lastID + 1
+				}
+				progress("resuming after id %d", lastID)
+			}
+			flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		}
+		f, err := os.OpenFile(path, flags, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	w, err := tipubsub.NewMessageWriter(out, format, withHeader)
+	if err != nil {
+		return err
+	}
+	exported, lastID, err := hub.Export(streamName, w, opts)
+	if err != nil {
+		return err
+	}
+	p := newPrinter("stream_name", "exported", "last_id")
+	defer p.Flush()
+	p.Row(streamName, exported, lastID)
+	return nil
+}
+
+// the checkpoint of an import is "<stream name> <messages read>"
+func importCheckpointPath(path string) string {
+	return path + ".import-progress"
+}
+
+func readImportCheckpoint(path string, streamName string) (int64, error) {
+	b, err := ioutil.ReadFile(importCheckpointPath(path))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) != 2 || fields[0] != streamName {
+		return 0, fmt.Errorf("checkpoint %s is not for stream %s", importCheckpointPath(path), streamName)
+	}
+	return strconv.ParseInt(fields[1], 10, 64)
+}
+
+func runImport(args []string) error {
+	usage := errUsage{findCommand("import").usage}
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	formatFlag := fs.String("format", string(tipubsub.FormatNDJSON), "ndjson|binary")
+	preserveTs := fs.Bool("preserve-ts", false, "keep the original ts of messages")
+	preserveID := fs.Bool("preserve-id", false, "keep the original ids of messages, existing ids are skipped")
+	resume := fs.Bool("resume", false, "skip the messages imported by an interrupted run")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 2 {
+		return usage
+	}
+	format, err := tipubsub.ParseExportFormat(*formatFlag)
+	if err != nil {
+		return err
+	}
+	streamName, path := fs.Arg(0), fs.Arg(1)
+
+	var in io.Reader = os.Stdin
+	checkpoint := path != "-"
+	if checkpoint {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	opts := tipubsub.ImportOptions{
+		PreserveTs: *preserveTs,
+		PreserveID: *preserveID,
+		// the checkpoint is written after the batch commits, without the
+		// ids only dedup keys drop the messages of a batch imported twice
+		RequireDedupKey: *resume && !*preserveID,
+		Progress: func(imported int64) {
+			progress("imported %d messages", imported)
+			if checkpoint {
+				ioutil.WriteFile(importCheckpointPath(path), []byte(fmt.Sprintf("%s %d", streamName, imported)), 0644)
+			}
+		},
+	}
+	if *resume && checkpoint {
+		if opts.Skip, err = readImportCheckpoint(path, streamName); err != nil {
+			return err
+		}
+		progress("resuming after %d messages", opts.Skip)
+	}
+	r, err := tipubsub.NewMessageReader(in, format)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	imported, err := hub.Import(streamName, r, opts)
+	if err != nil {
+		if opts.RequireDedupKey {
+			return fmt.Errorf("%v, -resume needs -preserve-id or messages with dedup keys", err)
+		}
+		return err
+	}
+	if checkpoint {
+		os.Remove(importCheckpointPath(path))
+	}
+	p := newPrinter("stream_name", "imported")
+	defer p.Flush()
+	p.Row(streamName, imported-opts.Skip)
+	return nil
+}
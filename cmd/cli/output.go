@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputCSV   = "csv"
+)
+
+// printer writes rows in the format chosen by --output, json prints one
+// object per line so the output of tail can be piped into jq
+type printer interface {
+	Row(vals ...interface{})
+	Flush()
+}
+
+func newPrinter(header ...string) printer {
+	return newPrinterTo(os.Stdout, *output, header...)
+}
+
+func newPrinterTo(w io.Writer, format string, header ...string) printer {
+	switch format {
+	case outputJSON:
+		return &jsonPrinter{enc: json.NewEncoder(w), header: header}
+	case outputCSV:
+		p := &csvPrinter{w: csv.NewWriter(w)}
+		p.w.Write(header)
+		return p
+	default:
+		p := &tablePrinter{w: tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)}
+		p.Row(toInterfaces(header)...)
+		return p
+	}
+}
+
+func toInterfaces(ss []string) []interface{} {
+	ret := make([]interface{}, len(ss))
+	for i, s := range ss {
+		ret[i] = s
+	}
+	return ret
+}
+
+type tablePrinter struct {
+	w *tabwriter.Writer
+}
+
+func (p *tablePrinter) Row(vals ...interface{}) {
+	for i, v := range vals {
+		if i > 0 {
+			fmt.Fprint(p.w, "\t")
+		}
+		fmt.Fprint(p.w, v)
+	}
+	fmt.Fprintln(p.w)
+}
+
+func (p *tablePrinter) Flush() {
+	p.w.Flush()
+}
+
+type jsonPrinter struct {
+	enc    *json.Encoder
+	header []string
+}
+
+func (p *jsonPrinter) Row(vals ...interface{}) {
+	obj := make(map[string]interface{}, len(vals))
+	for i, v := range vals {
+		obj[p.header[i]] = v
+	}
+	p.enc.Encode(obj)
+}
+
+func (p *jsonPrinter) Flush() {}
+
+type csvPrinter struct {
+	w *csv.Writer
+}
+
+func (p *csvPrinter) Row(vals ...interface{}) {
+	rec := make([]string, len(vals))
+	for i, v := range vals {
+		rec[i] = fmt.Sprint(v)
+	}
+	p.w.Write(rec)
+}
+
+func (p *csvPrinter) Flush() {
+	p.w.Flush()
+}
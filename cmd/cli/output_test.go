@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPrinters(t *testing.T) {
+	for format, want := range map[string]string{
+		outputJSON:  "{\"id\":1,\"name\":\"a\"}\n{\"id\":2,\"name\":\"b c\"}\n",
+		outputCSV:   "id,name\n1,a\n2,b c\n",
+		outputTable: "id  name\n1   a\n2   b c\n",
+	} {
+		var buf bytes.Buffer
+		p := newPrinterTo(&buf, format, "id", "name")
+		p.Row(1, "a")
+		p.Row(2, "b c")
+		p.Flush()
+		if buf.String() != want {
+			t.Errorf("%s: got %q, want %q", format, buf.String(), want)
+		}
+	}
+}
+
+func TestReadLines(t *testing.T) {
+	var batches []string
+	err := readLines(strings.NewReader("a\r\n\nb\nc\nd\ne"), 2, func(lines []string) error {
+		batches = append(batches, strings.Join(lines, ","))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(batches) != "[a,b c,d e]" {
+		t.Errorf("got batches %v", batches)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/abiosoft/ishell"
+)
+
+func runShell() {
+	// set shell prompts
+	shell := ishell.New()
+	shell.SetPrompt("tipubsub> ")
+
+	// register commands
+	for _, cmd := range commands {
+		cmd := cmd
+		names := append([]string{cmd.name}, cmd.aliases...)
+		shell.AddCmd(&ishell.Cmd{
+			Name:    cmd.name,
+			Aliases: cmd.aliases,
+			Help:    fmt.Sprintf("%s: %s", strings.Join(names, "|"), cmd.help),
+			Func: func(c *ishell.Context) {
+				if err := cmd.run(c.Args); err != nil {
+					c.Println(err)
+				}
+			},
+		})
+	}
+
+	shell.AddCmd(&ishell.Cmd{
+		Name:    "exit",
+		Aliases: []string{"quit"},
+		Help:    "exit",
+		Func: func(c *ishell.Context) {
+			c.Stop()
+		},
+	})
+
+	fmt.Println(shell.HelpText())
+	shell.Run()
+	shell.Close()
+}
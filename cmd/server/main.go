@@ -0,0 +1,74 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+
+	"github.com/c4pt0r/log"
+	"github.com/c4pt0r/tipubsub"
+	"github.com/c4pt0r/tipubsub/grpcapi"
+	"github.com/c4pt0r/tipubsub/mqtt"
+	"github.com/c4pt0r/tipubsub/push"
+	"github.com/c4pt0r/tipubsub/resp"
+	"github.com/c4pt0r/tipubsub/webhook"
+)
+
+var (
+	configFile = flag.String("c", "config.toml", "config file")
+	logLevel   = flag.String("l", "info", "log level")
+)
+
+func main() {
+	flag.Parse()
+	log.SetLevelByString(*logLevel)
+	cfg := tipubsub.MustLoadConfig(*configFile)
+	log.Info("config:", cfg)
+
+	hub, err := tipubsub.NewHub(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	errCh := make(chan error, 1)
+	if cfg.PushAddr != "" {
+		go func() {
+			errCh <- push.NewServer(hub, cfg).ListenAndServe(cfg.PushAddr)
+		}()
+	}
+	if cfg.GRPCAddr != "" {
+		go func() {
+			errCh <- grpcapi.NewServer(hub).ListenAndServe(cfg.GRPCAddr)
+		}()
+	}
+	if cfg.RESPAddr != "" {
+		go func() {
+			errCh <- resp.NewServer(hub, cfg).ListenAndServe(cfg.RESPAddr)
+		}()
+	}
+	if cfg.MQTTAddr != "" {
+		go func() {
+			errCh <- mqtt.NewServer(hub).ListenAndServe(cfg.MQTTAddr)
+		}()
+	}
+	if cfg.WebhookEnabled {
+		d, err := webhook.NewDispatcher(hub, cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go d.Run()
+	}
+	log.Fatal(<-errCh)
+}
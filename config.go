@@ -17,6 +17,7 @@ package tipubsub
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/ilyakaznacheev/cleanenv"
@@ -27,12 +28,161 @@ type Config struct {
 	DSN string `toml:"dsn" env:"DSN" env-default:"root:@tcp(localhost:4000)/test"`
 	// MaxBatchSize is the maximum number of messages to batch a transaction.
 	MaxBatchSize int `toml:"max_batch_size" env:"MAX_BATCH_SIZE" env-default:"1000"`
-	// PollIntervalInMs is the interval to poll the database.
+	// LingerInMs is how long a batch waits for more messages after the first one.
+	LingerInMs int `toml:"linger_in_ms" env:"LINGER_IN_MS" env-default:"100"`
+	// MaxBatchBytes is the maximum size of the messages data in a transaction.
+	MaxBatchBytes int `toml:"max_batch_bytes" env:"MAX_BATCH_BYTES" env-default:"8388608"`
+	// PublishWriters is the number of goroutines writing batches of a stream.
+	PublishWriters int `toml:"publish_writers" env:"PUBLISH_WRITERS" env-default:"1"`
+	// InsertRowsPerStmt is the maximum number of rows of a multi-row INSERT, 1 inserts row by row.
+	InsertRowsPerStmt int `toml:"insert_rows_per_stmt" env:"INSERT_ROWS_PER_STMT" env-default:"256"`
+	// PublishQueueSize is the number of messages queued per writer of a stream, 0 means MaxBatchSize.
+	PublishQueueSize int `toml:"publish_queue_size" env:"PUBLISH_QUEUE_SIZE" env-default:"0"`
+	// QueueFullPolicy is what Publish does when a queue is full: block, error or spill.
+	QueueFullPolicy QueueFullPolicy `toml:"queue_full_policy" env:"QUEUE_FULL_POLICY" env-default:"block"`
+	// PublishTimeoutInMs is how long Publish blocks on a full queue, 0 waits forever.
+	PublishTimeoutInMs int `toml:"publish_timeout_in_ms" env:"PUBLISH_TIMEOUT_IN_MS" env-default:"0"`
+	// SpillDir is where full queues spill messages, one directory per hub, defaults to a temp directory.
+	SpillDir string `toml:"spill_dir" env:"SPILL_DIR"`
+	// DelayCheckIntervalInMs is the interval to deliver due delayed messages, 0 disables it on this hub.
+	DelayCheckIntervalInMs int `toml:"delay_check_interval_in_ms" env:"DELAY_CHECK_INTERVAL_IN_MS" env-default:"1000"`
+	// StreamWatchIntervalInMs is the interval to look for new streams matching pattern subscriptions, 0 disables it.
+	StreamWatchIntervalInMs int `toml:"stream_watch_interval_in_ms" env:"STREAM_WATCH_INTERVAL_IN_MS" env-default:"1000"`
+	// WatermarkIntervalInMs is the interval to read the last id written to all the streams and
+	// wake the poll workers of the written ones, 0 disables watermarks.
+	WatermarkIntervalInMs int `toml:"watermark_interval_in_ms" env:"WATERMARK_INTERVAL_IN_MS" env-default:"0"`
+	// NotifyAddr is the UDP listen address for the write notifications of other hubs.
+	NotifyAddr string `toml:"notify_addr" env:"NOTIFY_ADDR"`
+	// NotifyPeers are the NotifyAddr of the other hubs to notify of the writes of this hub.
+	NotifyPeers []string `toml:"notify_peers" env:"NOTIFY_PEERS" env-separator:","`
+	// IdlePollIntervalInMs replaces MaxPollIntervalInMs when watermarks or notifications are enabled.
+	IdlePollIntervalInMs int `toml:"idle_poll_interval_in_ms" env:"IDLE_POLL_INTERVAL_IN_MS" env-default:"5000"`
+	// SharedPollIntervalInMs is the interval to check the max id of all the subscribed streams in one
+	// query and poll only the ones that moved, 0 lets every stream poll on its own.
+	SharedPollIntervalInMs int `toml:"shared_poll_interval_in_ms" env:"SHARED_POLL_INTERVAL_IN_MS" env-default:"0"`
+	// PollWorkerIdleTimeoutInSec is how long a poll worker without subscribers lives, 0 keeps it forever.
+	// Workers are checked every timeout, so one may live up to twice as long.
+	PollWorkerIdleTimeoutInSec int `toml:"poll_worker_idle_timeout_in_sec" env:"POLL_WORKER_IDLE_TIMEOUT_IN_SEC" env-default:"300"`
+	// SubscriberQueueSize is the number of polled batches buffered per subscriber, a subscriber
+	// falling further behind is dropped so it never holds up the others.
+	SubscriberQueueSize int `toml:"subscriber_queue_size" env:"SUBSCRIBER_QUEUE_SIZE" env-default:"1024"`
+	// StreamLayout is the table layout of new streams, auto_increment or auto_random.
+	StreamLayout StreamLayout `toml:"stream_layout" env:"STREAM_LAYOUT" env-default:"auto_increment"`
+	// Streams overrides the settings above for single streams.
+	Streams map[string]StreamConfig `toml:"streams"`
+	// PollIntervalInMs is the interval to poll the database while a stream is active.
 	PollIntervalInMs int `toml:"poll_interval_in_ms" env:"POLL_INTERVAL_IN_MS" env-default:"100"`
+	// MaxPollIntervalInMs is how far the poll interval of an idle stream backs off.
+	MaxPollIntervalInMs int `toml:"max_poll_interval_in_ms" env:"MAX_POLL_INTERVAL_IN_MS" env-default:"1000"`
+	// GapTimeoutInMs is how long readers wait for a missing id below the ones they read to commit
+	// before skipping it, 0 never waits.
+	GapTimeoutInMs int `toml:"gap_timeout_in_ms" env:"GAP_TIMEOUT_IN_MS" env-default:"1000"`
 	// GCIntervalInSec is the interval to run garbage collection.
 	GCIntervalInSec int `toml:"gc_interval_in_sec" env:"GC_INTERVAL_IN_SEC" env-default:"600"`
 	// GCKeepItems is the number of items to keep in the cache.
 	GCKeepItems int `toml:"gc_keep_items" env:"GC_KEEP_ITEMS" env-default:"10000"`
+	// PushAddr is the listen address of the SSE/WebSocket server.
+	PushAddr string `toml:"push_addr" env:"PUSH_ADDR" env-default:":8080"`
+	// PushHeartbeatInSec is the interval to send heartbeats to idle push connections.
+	PushHeartbeatInSec int `toml:"push_heartbeat_in_sec" env:"PUSH_HEARTBEAT_IN_SEC" env-default:"15"`
+	// PushBufferSize is the number of messages buffered per push connection,
+	// slow clients exceeding it are disconnected.
+	PushBufferSize int `toml:"push_buffer_size" env:"PUSH_BUFFER_SIZE" env-default:"1000"`
+	// GRPCAddr is the listen address of the gRPC server.
+	GRPCAddr string `toml:"grpc_addr" env:"GRPC_ADDR" env-default:":9090"`
+	// RESPAddr is the listen address of the Redis protocol server.
+	RESPAddr string `toml:"resp_addr" env:"RESP_ADDR" env-default:":6380"`
+	// MQTTAddr is the listen address of the MQTT broker.
+	MQTTAddr string `toml:"mqtt_addr" env:"MQTT_ADDR" env-default:":1883"`
+	// WebhookEnabled runs the webhook dispatcher in the server.
+	WebhookEnabled bool `toml:"webhook_enabled" env:"WEBHOOK_ENABLED" env-default:"true"`
+	// WebhookTimeoutInSec is the timeout of a webhook request.
+	WebhookTimeoutInSec int `toml:"webhook_timeout_in_sec" env:"WEBHOOK_TIMEOUT_IN_SEC" env-default:"10"`
+	// WebhookMaxFailures is the number of failed deliveries in a row before a webhook is paused.
+	WebhookMaxFailures int `toml:"webhook_max_failures" env:"WEBHOOK_MAX_FAILURES" env-default:"10"`
+	// WebhookReloadIntervalInSec is the interval to reload webhooks from the database.
+	WebhookReloadIntervalInSec int `toml:"webhook_reload_interval_in_sec" env:"WEBHOOK_RELOAD_INTERVAL_IN_SEC" env-default:"10"`
+	// WebhookLeaseInSec is how long a server owns a webhook without renewing it, only the owner
+	// delivers it. Keep it well above WebhookTimeoutInSec.
+	WebhookLeaseInSec int `toml:"webhook_lease_in_sec" env:"WEBHOOK_LEASE_IN_SEC" env-default:"30"`
+}
+
+// StreamConfig is the per stream part of Config, zero values fall back
+// to the global settings.
+type StreamConfig struct {
+	MaxBatchSize       int             `toml:"max_batch_size"`
+	MaxBatchBytes      int             `toml:"max_batch_bytes"`
+	LingerInMs         int             `toml:"linger_in_ms"`
+	PublishWriters     int             `toml:"publish_writers"`
+	QueueSize          int             `toml:"publish_queue_size"`
+	QueueFullPolicy    QueueFullPolicy `toml:"queue_full_policy"`
+	PublishTimeoutInMs int             `toml:"publish_timeout_in_ms"`
+	// the poll interval backs off from MinPollIntervalInMs to
+	// MaxPollIntervalInMs while the stream is idle
+	MinPollIntervalInMs int `toml:"min_poll_interval_in_ms"`
+	MaxPollIntervalInMs int `toml:"max_poll_interval_in_ms"`
+	// Layout is only used when the stream is created
+	Layout StreamLayout `toml:"layout"`
+}
+
+// StreamConfig returns the settings of a stream merged with the global ones.
+func (c *Config) StreamConfig(streamName string) StreamConfig {
+	sc := c.Streams[streamName]
+	if sc.MaxBatchSize <= 0 {
+		sc.MaxBatchSize = c.MaxBatchSize
+	}
+	if sc.MaxBatchBytes <= 0 {
+		sc.MaxBatchBytes = c.MaxBatchBytes
+	}
+	if sc.LingerInMs <= 0 {
+		sc.LingerInMs = c.LingerInMs
+	}
+	if sc.PublishWriters <= 0 {
+		sc.PublishWriters = c.PublishWriters
+	}
+	if sc.PublishWriters <= 0 {
+		sc.PublishWriters = 1
+	}
+	if sc.QueueSize <= 0 {
+		sc.QueueSize = c.PublishQueueSize
+	}
+	if sc.QueueSize <= 0 {
+		sc.QueueSize = sc.MaxBatchSize
+	}
+	if sc.QueueFullPolicy == "" {
+		sc.QueueFullPolicy = c.QueueFullPolicy
+	}
+	if sc.QueueFullPolicy == "" {
+		sc.QueueFullPolicy = QueueFullBlock
+	}
+	if sc.PublishTimeoutInMs <= 0 {
+		sc.PublishTimeoutInMs = c.PublishTimeoutInMs
+	}
+	if sc.Layout == "" {
+		sc.Layout = c.StreamLayout
+	}
+	if sc.MinPollIntervalInMs <= 0 {
+		sc.MinPollIntervalInMs = c.PollIntervalInMs
+	}
+	if sc.MaxPollIntervalInMs <= 0 {
+		sc.MaxPollIntervalInMs = c.MaxPollIntervalInMs
+	}
+	if sc.MaxPollIntervalInMs < sc.MinPollIntervalInMs {
+		sc.MaxPollIntervalInMs = sc.MinPollIntervalInMs
+	}
+	return sc
+}
+
+// pollIntervals returns the bounds of the poll interval of a stream, an
+// idle stream is woken on writes when watermarks or notifications are
+// enabled so it can back off up to IdlePollIntervalInMs
+func (c *Config) pollIntervals(streamName string) (min, max time.Duration) {
+	sc := c.StreamConfig(streamName)
+	maxMs := sc.MaxPollIntervalInMs
+	if (c.WatermarkIntervalInMs > 0 || c.NotifyAddr != "") && c.IdlePollIntervalInMs > maxMs {
+		maxMs = c.IdlePollIntervalInMs
+	}
+	return time.Duration(sc.MinPollIntervalInMs) * time.Millisecond, time.Duration(maxMs) * time.Millisecond
 }
 
 func (c *Config) String() string {
@@ -0,0 +1,72 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStreamConfig(t *testing.T) {
+	cfg := &Config{
+		MaxBatchSize:        100,
+		PollIntervalInMs:    10,
+		MaxPollIntervalInMs: 1000,
+		QueueFullPolicy:     QueueFullError,
+		Streams: map[string]StreamConfig{
+			"busy": {MaxBatchSize: 500, MinPollIntervalInMs: 5},
+			// a max below the min is raised to it
+			"odd": {MinPollIntervalInMs: 2000},
+		},
+	}
+	sc := cfg.StreamConfig("other")
+	if sc.MaxBatchSize != 100 || sc.PublishWriters != 1 || sc.QueueSize != 100 ||
+		sc.QueueFullPolicy != QueueFullError || sc.MinPollIntervalInMs != 10 || sc.MaxPollIntervalInMs != 1000 {
+		t.Errorf("defaults: got %+v", sc)
+	}
+	sc = cfg.StreamConfig("busy")
+	if sc.MaxBatchSize != 500 || sc.QueueSize != 500 || sc.MinPollIntervalInMs != 5 || sc.MaxPollIntervalInMs != 1000 {
+		t.Errorf("busy: got %+v", sc)
+	}
+	if sc := cfg.StreamConfig("odd"); sc.MaxPollIntervalInMs != 2000 {
+		t.Errorf("odd: got max poll interval %d", sc.MaxPollIntervalInMs)
+	}
+	if sc := (&Config{}).StreamConfig("s"); sc.QueueFullPolicy != QueueFullBlock {
+		t.Errorf("got queue full policy %q", sc.QueueFullPolicy)
+	}
+}
+
+func TestPollIntervals(t *testing.T) {
+	cfg := &Config{PollIntervalInMs: 10, MaxPollIntervalInMs: 1000, IdlePollIntervalInMs: 5000}
+	if min, max := cfg.pollIntervals("s"); min != 10*time.Millisecond || max != time.Second {
+		t.Errorf("got %v %v", min, max)
+	}
+	// woken on writes, an idle stream can back off further
+	cfg.WatermarkIntervalInMs = 100
+	if _, max := cfg.pollIntervals("s"); max != 5*time.Second {
+		t.Errorf("with watermarks: got max %v", max)
+	}
+	cfg.WatermarkIntervalInMs, cfg.NotifyAddr = 0, ":9000"
+	if _, max := cfg.pollIntervals("s"); max != 5*time.Second {
+		t.Errorf("with notifications: got max %v", max)
+	}
+}
+
+func TestDefaultConfig(t *testing.T) {
+	// idle poll workers are stopped unless configured otherwise
+	if cfg := DefaultConfig(); cfg.PollWorkerIdleTimeoutInSec != 300 {
+		t.Errorf("got poll worker idle timeout %d", cfg.PollWorkerIdleTimeoutInSec)
+	}
+}
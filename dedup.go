@@ -0,0 +1,124 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	// MaxDedupKeyLen is the size of the dedup_key column of stream tables
+	MaxDedupKeyLen = 255
+	// maxDedupAttempts bounds the retries of a batch racing with another
+	// publisher of the same dedup key
+	maxDedupAttempts = 3
+	// dedupLookupBatch is the number of keys looked up per query
+	dedupLookupBatch = 500
+)
+
+var ErrDedupKeyTooLong = fmt.Errorf("dedup key longer than %d bytes", MaxDedupKeyLen)
+
+// ProducerDedupKey is the dedup key of the message seq of a producer, a
+// producer retrying a publish with the same seq gets the first message
+// back instead of a duplicate
+func ProducerDedupKey(producerID string, seq uint64) string {
+	return producerID + ":" + strconv.FormatUint(seq, 10)
+}
+
+func dedupKeyArg(msg *Message) sql.NullString {
+	return sql.NullString{String: msg.DedupKey, Valid: msg.DedupKey != ""}
+}
+
+// isDuplicateKeyErr tells if err is a unique key violation
+func isDuplicateKeyErr(err error) bool {
+	var myErr *mysql.MySQLError
+	return errors.As(err, &myErr) && myErr.Number == 1062
+}
+
+// dedup sets the ID of the messages whose dedup key is in the stream table
+// tblName already and returns the messages to insert, a key repeated in messages
+// is inserted once. resolve sets the ID of the repeated ones after the
+// insert.
+func (s *TiDBStore) dedup(txn *sql.Tx, tblName string, messages []*Message) ([]*Message, func(), error) {
+	firsts := map[string]*Message{}
+	var keys []interface{}
+	for _, msg := range messages {
+		if msg.DedupKey == "" {
+			continue
+		}
+		if _, ok := firsts[msg.DedupKey]; !ok {
+			firsts[msg.DedupKey] = msg
+			keys = append(keys, msg.DedupKey)
+		}
+	}
+	if len(keys) == 0 {
+		return messages, func() {}, nil
+	}
+	existing := map[string]int64{}
+	for start := 0; start < len(keys); start += dedupLookupBatch {
+		end := start + dedupLookupBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		stmt := fmt.Sprintf(`
+			SELECT dedup_key, id
+			FROM %s
+			WHERE dedup_key IN (?%s)`,
+			quoteIdent(tblName), strings.Repeat(", ?", end-start-1))
+		rows, err := txn.Query(stmt, keys[start:end]...)
+		if err != nil {
+			return nil, nil, err
+		}
+		for rows.Next() {
+			var key string
+			var id int64
+			if err := rows.Scan(&key, &id); err != nil {
+				rows.Close()
+				return nil, nil, err
+			}
+			existing[key] = id
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+	var fresh, repeated []*Message
+	for _, msg := range messages {
+		if msg.DedupKey != "" {
+			if id, ok := existing[msg.DedupKey]; ok {
+				msg.ID = id
+				continue
+			}
+			if firsts[msg.DedupKey] != msg {
+				repeated = append(repeated, msg)
+				continue
+			}
+		}
+		fresh = append(fresh, msg)
+	}
+	resolve := func() {
+		for _, msg := range repeated {
+			msg.ID = firsts[msg.DedupKey].ID
+		}
+	}
+	return fresh, resolve, nil
+}
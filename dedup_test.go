@@ -0,0 +1,78 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestDedupHelpers(t *testing.T) {
+	if got := ProducerDedupKey("p1", 42); got != "p1:42" {
+		t.Errorf("got dedup key %q", got)
+	}
+	if arg := dedupKeyArg(&Message{}); arg.Valid {
+		t.Error("no dedup key is not NULL")
+	}
+	if arg := dedupKeyArg(&Message{DedupKey: "k"}); !arg.Valid || arg.String != "k" {
+		t.Errorf("got %v", arg)
+	}
+	if !isDuplicateKeyErr(fmt.Errorf("insert: %w", &mysql.MySQLError{Number: 1062})) {
+		t.Error("wrapped duplicate key error not detected")
+	}
+	if isDuplicateKeyErr(&mysql.MySQLError{Number: 1064}) || isDuplicateKeyErr(nil) {
+		t.Error("other error taken for a duplicate key")
+	}
+}
+
+func TestPutMessagesDedup(t *testing.T) {
+	s := testStore(t)
+	name := testStream(t, s, LayoutAutoIncrement)
+	first := []*Message{
+		{Data: "a", DedupKey: "a"},
+		{Data: "no key"},
+		{Data: "a repeated", DedupKey: "a"},
+	}
+	if err := s.PutMessages(name, first); err != nil {
+		t.Fatal(err)
+	}
+	if first[2].ID != first[0].ID {
+		t.Errorf("repeat in the batch got id %d, want %d", first[2].ID, first[0].ID)
+	}
+	again := []*Message{{Data: "a again", DedupKey: "a"}, {Data: "b", DedupKey: "b"}}
+	if err := s.PutMessages(name, again); err != nil {
+		t.Fatal(err)
+	}
+	if again[0].ID != first[0].ID {
+		t.Errorf("republished message got id %d, want %d", again[0].ID, first[0].ID)
+	}
+	msgs, _, err := s.FetchMessages(name, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data []string
+	for _, msg := range msgs {
+		data = append(data, msg.Data)
+	}
+	if fmt.Sprint(data) != "[a no key b]" {
+		t.Errorf("stream has %q", data)
+	}
+	long := make([]byte, MaxDedupKeyLen+1)
+	if err := s.PutMessages(name, []*Message{{DedupKey: string(long)}}); err != ErrDedupKeyTooLong {
+		t.Errorf("long dedup key: got %v", err)
+	}
+}
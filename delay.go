@@ -0,0 +1,200 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/c4pt0r/log"
+)
+
+// Delayed messages wait in tipubsub_delayed and are appended to their
+// stream when they are due, so they get an ID at delivery time and the
+// offsets subscribers poll by stay ordered. Their ID is 0 until then.
+
+// putDelayed parks the messages due later and returns the others, a
+// message whose dedup key is parked already is dropped
+func putDelayed(txn *sql.Tx, streamName string, messages []*Message) ([]*Message, error) {
+	now := time.Now().UnixNano()
+	parked, err := parkedDedupKeys(txn, streamName, now, messages)
+	if err != nil {
+		return nil, err
+	}
+	due := messages[:0:0]
+	for _, msg := range messages {
+		if msg.DeliverAt <= now {
+			due = append(due, msg)
+			continue
+		}
+		if parked[msg.DedupKey] {
+			msg.ID = 0
+			continue
+		}
+		_, err := txn.Exec(`
+			INSERT INTO tipubsub_delayed (stream_name, deliver_at, ts, data, dedup_key, expire_at, headers)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			streamName, msg.DeliverAt, msg.Ts, msg.Data, dedupKeyArg(msg), nullInt64(msg.ExpireAt), headersArg(msg))
+		if err != nil {
+			return nil, err
+		}
+		msg.ID = 0
+	}
+	return due, nil
+}
+
+// parkedDedupKeys returns the dedup keys of the messages due later that
+// wait in tipubsub_delayed already
+func parkedDedupKeys(txn *sql.Tx, streamName string, now int64, messages []*Message) (map[string]bool, error) {
+	var keys []interface{}
+	for _, msg := range messages {
+		if msg.DeliverAt > now && msg.DedupKey != "" {
+			keys = append(keys, msg.DedupKey)
+		}
+	}
+	parked := map[string]bool{}
+	for start := 0; start < len(keys); start += dedupLookupBatch {
+		end := start + dedupLookupBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		args := append([]interface{}{streamName}, keys[start:end]...)
+		rows, err := txn.Query(`
+			SELECT dedup_key
+			FROM tipubsub_delayed
+			WHERE stream_name = ? AND dedup_key IN (?`+strings.Repeat(", ?", end-start-1)+`)`, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var key string
+			if err := rows.Scan(&key); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			parked[key] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return parked, nil
+}
+
+func (s *TiDBStore) DeliverDelayed(now int64, limit int, written func(streamName string, msgs []*Message)) (int, error) {
+	txn, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer txn.Rollback()
+	// the lock keeps hubs from delivering the same messages
+	rows, err := txn.Query(`
+		SELECT id, stream_name, deliver_at, ts, data, IFNULL(dedup_key, ''), IFNULL(expire_at, 0), headers
+		FROM tipubsub_delayed
+		WHERE deliver_at <= ?
+		ORDER BY deliver_at, id
+		LIMIT ?
+		FOR UPDATE`, now, limit)
+	if err != nil {
+		return 0, err
+	}
+	var ids []interface{}
+	var names []string
+	byStream := map[string][]*Message{}
+	for rows.Next() {
+		var id int64
+		var name string
+		var headers sql.NullString
+		msg := &Message{}
+		if err := rows.Scan(&id, &name, &msg.DeliverAt, &msg.Ts, &msg.Data, &msg.DedupKey, &msg.ExpireAt, &headers); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if msg.Headers, err = scanHeaders(headers); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+		// expired before delivery, only deleted
+		if msg.ExpireAt != 0 && msg.ExpireAt <= now {
+			continue
+		}
+		if _, ok := byStream[name]; !ok {
+			names = append(names, name)
+		}
+		byStream[name] = append(byStream[name], msg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	var delivered []string
+	for _, name := range names {
+		meta, ok, err := s.streamMeta(name)
+		if err != nil {
+			return 0, err
+		}
+		// the messages of a dropped stream are just deleted
+		if !ok {
+			continue
+		}
+		if err := s.putMessagesTx(storeTx{s, txn, true}, name, meta, byStream[name]); err != nil {
+			return 0, err
+		}
+		delivered = append(delivered, name)
+	}
+	_, err = txn.Exec(`
+		DELETE FROM tipubsub_delayed
+		WHERE id IN (?`+strings.Repeat(", ?", len(ids)-1)+`)`, ids...)
+	if err != nil {
+		return 0, err
+	}
+	if err := txn.Commit(); err != nil {
+		return 0, err
+	}
+	if written != nil {
+		for _, name := range delivered {
+			written(name, byStream[name])
+		}
+	}
+	return len(ids), nil
+}
+
+// deliverDelayed moves the due delayed messages of all the streams to
+// their streams, every hub runs it
+func (m *Hub) deliverDelayed() {
+	interval := time.Duration(m.cfg.DelayCheckIntervalInMs) * time.Millisecond
+	for {
+		time.Sleep(interval)
+		for {
+			n, err := m.store.DeliverDelayed(time.Now().UnixNano(), m.cfg.MaxBatchSize, m.streamWritten)
+			if err != nil {
+				log.Error("deliver delayed messages:", err)
+				break
+			}
+			if n > 0 {
+				log.D("delivered", n, "delayed messages")
+			}
+			if n < m.cfg.MaxBatchSize {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeliverDelayed(t *testing.T) {
+	s := testStore(t)
+	name := testStream(t, s, LayoutAutoIncrement)
+	t.Cleanup(func() { s.db.Exec(`DELETE FROM tipubsub_delayed WHERE stream_name = ?`, name) })
+	now := time.Now()
+	due := now.Add(time.Hour).UnixNano()
+	msgs := []*Message{
+		{Data: "now"},
+		{Data: "later", DeliverAt: due},
+		{Data: "expires first", DeliverAt: due, ExpireAt: now.Add(time.Minute).UnixNano()},
+	}
+	if err := s.PutMessages(name, msgs); err != nil {
+		t.Fatal(err)
+	}
+	if msgs[0].ID == 0 || msgs[1].ID != 0 || msgs[2].ID != 0 {
+		t.Fatalf("got ids %d %d %d, only the first message has one", msgs[0].ID, msgs[1].ID, msgs[2].ID)
+	}
+	// nothing is due yet, other streams may have some
+	if _, err := s.DeliverDelayed(now.UnixNano(), 100, nil); err != nil {
+		t.Fatal(err)
+	}
+	fetched, _, err := s.FetchMessages(name, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fetched) != 1 {
+		t.Fatalf("%d messages before the delivery time", len(fetched))
+	}
+	var written []*Message
+	for {
+		n, err := s.DeliverDelayed(due, 100, func(streamName string, msgs []*Message) {
+			if streamName == name {
+				written = append(written, msgs...)
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n < 100 {
+			break
+		}
+	}
+	fetched, _, err = s.FetchMessages(name, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fetched) != 2 || fetched[1].Data != "later" || fetched[1].ID <= fetched[0].ID {
+		t.Fatalf("got %v after the delivery time", fetched)
+	}
+	if len(written) != 1 || written[0].ID != fetched[1].ID {
+		t.Fatalf("written got %v, want the delivered message", written)
+	}
+}
@@ -0,0 +1,477 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExportFormat is the file format of Export and Import
+type ExportFormat string
+
+const (
+	// FormatNDJSON is one JSON encoded Message per line
+	FormatNDJSON ExportFormat = "ndjson"
+	// FormatBinary is a magic header with a version byte followed by
+	// varint encoded messages, see binaryWriter
+	FormatBinary ExportFormat = "binary"
+)
+
+// binaryVersion is the version of the binary format, files of another
+// version are rejected
+const binaryVersion = 2
+
+var (
+	// binaryMagic is followed by the version
+	binaryMagic = []byte("TPSB")
+
+	ErrUnknownFormat = errors.New("unknown export format")
+	ErrBadMagic      = errors.New("not a tipubsub binary export")
+)
+
+func ParseExportFormat(s string) (ExportFormat, error) {
+	switch f := ExportFormat(strings.ToLower(s)); f {
+	case FormatNDJSON, FormatBinary:
+		return f, nil
+	}
+	return "", ErrUnknownFormat
+}
+
+// MessageWriter encodes messages in an export format
+type MessageWriter interface {
+	Write(msg *Message) error
+	Flush() error
+}
+
+// MessageReader decodes messages in an export format, returns io.EOF at
+// the end. Offset is the number of bytes of the complete messages read so
+// far, a truncated file can be cut there to resume writing it.
+type MessageReader interface {
+	Read() (*Message, error)
+	Offset() int64
+}
+
+// NewMessageWriter returns a writer of format, withHeader is false when
+// appending to an existing binary file.
+func NewMessageWriter(w io.Writer, format ExportFormat, withHeader bool) (MessageWriter, error) {
+	bw := bufio.NewWriter(w)
+	switch format {
+	case FormatNDJSON:
+		return &ndjsonWriter{w: bw}, nil
+	case FormatBinary:
+		if withHeader {
+			if _, err := bw.Write(append(binaryMagic, binaryVersion)); err != nil {
+				return nil, err
+			}
+		}
+		return &binaryWriter{w: bw}, nil
+	}
+	return nil, ErrUnknownFormat
+}
+
+func NewMessageReader(r io.Reader, format ExportFormat) (MessageReader, error) {
+	br := bufio.NewReader(r)
+	switch format {
+	case FormatNDJSON:
+		return &ndjsonReader{r: br}, nil
+	case FormatBinary:
+		magic := make([]byte, len(binaryMagic)+1)
+		if _, err := io.ReadFull(br, magic); err != nil {
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			return nil, ErrBadMagic
+		}
+		if string(magic[:len(binaryMagic)]) != string(binaryMagic) || magic[len(binaryMagic)] != binaryVersion {
+			return nil, ErrBadMagic
+		}
+		return &binaryReader{r: br, offset: int64(len(magic))}, nil
+	}
+	return nil, ErrUnknownFormat
+}
+
+type ndjsonWriter struct {
+	w *bufio.Writer
+}
+
+func (w *ndjsonWriter) Write(msg *Message) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if _, err := w.w.Write(b); err != nil {
+		return err
+	}
+	return w.w.WriteByte('\n')
+}
+
+func (w *ndjsonWriter) Flush() error {
+	return w.w.Flush()
+}
+
+type ndjsonReader struct {
+	r      *bufio.Reader
+	offset int64
+}
+
+func (r *ndjsonReader) Read() (*Message, error) {
+	for {
+		line, err := r.r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if err == io.EOF && len(strings.TrimSpace(string(line))) == 0 {
+			return nil, io.EOF
+		}
+		if err == io.EOF {
+			// the last line has no newline, it is a message if it is
+			// complete JSON and an interrupted write otherwise
+			var msg Message
+			if json.Unmarshal(line, &msg) != nil {
+				return nil, io.EOF
+			}
+			r.offset += int64(len(line))
+			return &msg, nil
+		}
+		r.offset += int64(len(line))
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		var msg Message
+		if err := json.Unmarshal(line, &msg); err != nil {
+			return nil, fmt.Errorf("bad message at byte %d: %v", r.offset-int64(len(line)), err)
+		}
+		return &msg, nil
+	}
+}
+
+func (r *ndjsonReader) Offset() int64 {
+	return r.offset
+}
+
+// binaryWriter writes messages as uvarint id, varint ts, data,
+// dedup key, varint deliver_at and expire_at, uvarint number of headers
+// and the name and value of every header sorted by name. Strings are a
+// uvarint length followed by the bytes.
+type binaryWriter struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (w *binaryWriter) Write(msg *Message) error {
+	w.uvarint(uint64(msg.ID))
+	w.varint(msg.Ts)
+	w.string(msg.Data)
+	w.string(msg.DedupKey)
+	w.varint(msg.DeliverAt)
+	w.varint(msg.ExpireAt)
+	names := make([]string, 0, len(msg.Headers))
+	for name := range msg.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.uvarint(uint64(len(names)))
+	for _, name := range names {
+		w.string(name)
+		w.string(msg.Headers[name])
+	}
+	// bufio.Writer keeps the first error
+	_, err := w.w.Write(nil)
+	return err
+}
+
+func (w *binaryWriter) uvarint(v uint64) {
+	w.w.Write(w.buf[:binary.PutUvarint(w.buf[:], v)])
+}
+
+func (w *binaryWriter) varint(v int64) {
+	w.w.Write(w.buf[:binary.PutVarint(w.buf[:], v)])
+}
+
+func (w *binaryWriter) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.w.WriteString(s)
+}
+
+func (w *binaryWriter) Flush() error {
+	return w.w.Flush()
+}
+
+type binaryReader struct {
+	r      *bufio.Reader
+	offset int64
+}
+
+// countingByteReader counts the bytes consumed by the varint decoders
+// and readString
+type countingByteReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+// readString reads a uvarint length and as many bytes
+func (c *countingByteReader) readString() (string, error) {
+	size, err := binary.ReadUvarint(c)
+	if err != nil {
+		return "", err
+	}
+	if size > math.MaxInt32 {
+		return "", fmt.Errorf("bad string size %d", size)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return "", err
+	}
+	c.n += int64(size)
+	return string(b), nil
+}
+
+func (c *countingByteReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+func (r *binaryReader) Read() (*Message, error) {
+	cr := &countingByteReader{r: r.r}
+	id, err := binary.ReadUvarint(cr)
+	if err != nil {
+		// EOF in the middle of a message is a truncated file
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	msg := &Message{ID: int64(id)}
+	if msg.Ts, err = binary.ReadVarint(cr); err != nil {
+		return nil, truncated(err)
+	}
+	if err := r.readFields(cr, msg); err != nil {
+		return nil, r.readError(err)
+	}
+	r.offset += cr.n
+	return msg, nil
+}
+
+// readFields reads the fields of a message after its ts
+func (r *binaryReader) readFields(cr *countingByteReader, msg *Message) error {
+	var err error
+	if msg.Data, err = cr.readString(); err != nil {
+		return err
+	}
+	if msg.DedupKey, err = cr.readString(); err != nil {
+		return err
+	}
+	if msg.DeliverAt, err = binary.ReadVarint(cr); err != nil {
+		return err
+	}
+	if msg.ExpireAt, err = binary.ReadVarint(cr); err != nil {
+		return err
+	}
+	n, err := binary.ReadUvarint(cr)
+	if err != nil {
+		return err
+	}
+	if n > math.MaxInt32 {
+		return fmt.Errorf("bad number of headers %d", n)
+	}
+	for i := uint64(0); i < n; i++ {
+		name, err := cr.readString()
+		if err != nil {
+			return err
+		}
+		value, err := cr.readString()
+		if err != nil {
+			return err
+		}
+		if msg.Headers == nil {
+			msg.Headers = map[string]string{}
+		}
+		msg.Headers[name] = value
+	}
+	return nil
+}
+
+// readError is io.EOF for a truncated message, other errors tell where
+// the bad message starts
+func (r *binaryReader) readError(err error) error {
+	if err = truncated(err); err == io.EOF {
+		return err
+	}
+	return fmt.Errorf("bad message at byte %d: %v", r.offset, err)
+}
+
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return io.EOF
+	}
+	return err
+}
+
+func (r *binaryReader) Offset() int64 {
+	return r.offset
+}
+
+// ExportOptions selects the messages to export, zero values are unbounded
+type ExportOptions struct {
+	// messages with FromID <= id <= ToID
+	FromID int64
+	ToID   int64
+	// messages with Since <= ts <= Until, in nanoseconds
+	Since int64
+	Until int64
+	// Progress is called after every exported batch
+	Progress func(exported int64, lastID int64)
+}
+
+// Export writes the messages of a stream in the range of opts to w, it
+// returns the number of exported messages and the last exported id.
+func (m *Hub) Export(streamName string, w MessageWriter, opts ExportOptions) (int64, int64, error) {
+	var exported, lastID int64
+	offset := Offset(0)
+	if opts.FromID > 0 {
+		offset = Offset(opts.FromID - 1)
+	}
+	for {
+		msgs, max, err := m.store.FetchMessages(streamName, offset, m.cfg.MaxBatchSize)
+		if err != nil {
+			return exported, lastID, err
+		}
+		if len(msgs) == 0 {
+			break
+		}
+		finished := false
+		for i := range msgs {
+			msg := &msgs[i]
+			if opts.ToID > 0 && msg.ID > opts.ToID {
+				finished = true
+				break
+			}
+			if (opts.Since > 0 && msg.Ts < opts.Since) || (opts.Until > 0 && msg.Ts > opts.Until) {
+				continue
+			}
+			if err := w.Write(msg); err != nil {
+				return exported, lastID, err
+			}
+			exported++
+			lastID = msg.ID
+		}
+		if err := w.Flush(); err != nil {
+			return exported, lastID, err
+		}
+		if opts.Progress != nil {
+			opts.Progress(exported, lastID)
+		}
+		if finished {
+			break
+		}
+		offset = max
+	}
+	return exported, lastID, nil
+}
+
+// ImportOptions controls how exported messages are loaded
+type ImportOptions struct {
+	// PreserveTs keeps the original ts, otherwise ts is the import time
+	PreserveTs bool
+	// PreserveID keeps the original ids, messages whose id already exists
+	// are skipped so an interrupted import can simply be restarted
+	PreserveID bool
+	// Skip is the number of messages to skip from the beginning of r
+	Skip int64
+	// RequireDedupKey stops at the first message without dedup key, so
+	// the messages imported again when resuming after a crash are dropped
+	// as duplicates
+	RequireDedupKey bool
+	// Progress is called after every committed batch with the number of
+	// messages read from r so far, including skipped ones
+	Progress func(imported int64)
+}
+
+// Import loads the messages of r into a stream in batches, it returns the
+// number of messages read from r including skipped ones.
+func (m *Hub) Import(streamName string, r MessageReader, opts ImportOptions) (int64, error) {
+	if _, err := m.getOrOpenStream(streamName); err != nil {
+		return 0, err
+	}
+	var read int64
+	batch := make([]*Message, 0, m.cfg.MaxBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		var err error
+		if opts.PreserveID {
+			err = m.store.PutMessagesWithID(streamName, batch)
+		} else {
+			err = m.store.PutMessages(streamName, batch)
+		}
+		if err != nil {
+			return err
+		}
+		m.streamWritten(streamName, batch)
+		batch = batch[:0]
+		if opts.Progress != nil {
+			opts.Progress(read)
+		}
+		return nil
+	}
+	for {
+		msg, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return read, err
+		}
+		read++
+		if read <= opts.Skip {
+			continue
+		}
+		if opts.RequireDedupKey && msg.DedupKey == "" {
+			return read - 1 - int64(len(batch)), fmt.Errorf("message %d has no dedup key", read)
+		}
+		if !opts.PreserveTs {
+			msg.Ts = 0
+		}
+		if msg.Ts == 0 {
+			msg.Ts = time.Now().UnixNano()
+		}
+		if !opts.PreserveID {
+			msg.ID = 0
+		}
+		batch = append(batch, msg)
+		if len(batch) >= m.cfg.MaxBatchSize {
+			if err := flush(); err != nil {
+				return read - int64(len(batch)), err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return read - int64(len(batch)), err
+	}
+	return read, nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func exportMessages() []*Message {
+	return []*Message{
+		{ID: 1, Ts: 100, Data: "plain"},
+		{ID: 2, Ts: 200, Data: `{"a": "line\nbreak"}`, DedupKey: "k2", DeliverAt: 300, ExpireAt: 400,
+			Headers: map[string]string{"type": "order"}},
+		{ID: 300, Ts: -1, Data: ""},
+	}
+}
+
+func writeMessages(t *testing.T, format ExportFormat, msgs []*Message) []byte {
+	var buf bytes.Buffer
+	w, err := NewMessageWriter(&buf, format, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range msgs {
+		if err := w.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readMessages(t *testing.T, format ExportFormat, b []byte) ([]*Message, int64) {
+	r, err := NewMessageReader(bytes.NewReader(b), format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs []*Message
+	for {
+		msg, err := r.Read()
+		if err == io.EOF {
+			return msgs, r.Offset()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+func TestNDJSONRoundTrip(t *testing.T) {
+	b := writeMessages(t, FormatNDJSON, exportMessages())
+	msgs, offset := readMessages(t, FormatNDJSON, b)
+	if !reflect.DeepEqual(msgs, exportMessages()) {
+		t.Errorf("got %+v", msgs)
+	}
+	if offset != int64(len(b)) {
+		t.Errorf("offset %d, want %d", offset, len(b))
+	}
+}
+
+func TestNDJSONWithoutFinalNewline(t *testing.T) {
+	b := writeMessages(t, FormatNDJSON, exportMessages())
+	b = bytes.TrimSuffix(b, []byte("\n"))
+	msgs, offset := readMessages(t, FormatNDJSON, b)
+	if !reflect.DeepEqual(msgs, exportMessages()) {
+		t.Errorf("got %+v", msgs)
+	}
+	if offset != int64(len(b)) {
+		t.Errorf("offset %d, want %d", offset, len(b))
+	}
+}
+
+func TestNDJSONTruncated(t *testing.T) {
+	b := writeMessages(t, FormatNDJSON, exportMessages())
+	complete := bytes.Index(b, []byte(`{"id":"300"`))
+	msgs, offset := readMessages(t, FormatNDJSON, b[:complete+5])
+	if len(msgs) != 2 || offset != int64(complete) {
+		t.Errorf("got %d messages up to %d, want 2 up to %d", len(msgs), offset, complete)
+	}
+}
+
+func TestNDJSONBadLine(t *testing.T) {
+	r, err := NewMessageReader(strings.NewReader("{\"id\":\"1\"}\nnot json\n"), FormatNDJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(); err == nil || err == io.EOF {
+		t.Errorf("got %v, want a bad message error", err)
+	}
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	b := writeMessages(t, FormatBinary, exportMessages())
+	msgs, offset := readMessages(t, FormatBinary, b)
+	if !reflect.DeepEqual(msgs, exportMessages()) {
+		t.Errorf("got %+v", msgs)
+	}
+	if offset != int64(len(b)) {
+		t.Errorf("offset %d, want %d", offset, len(b))
+	}
+}
+
+func TestBinaryTruncated(t *testing.T) {
+	b := writeMessages(t, FormatBinary, exportMessages())
+	_, complete := readMessages(t, FormatBinary, writeMessages(t, FormatBinary, exportMessages()[:2]))
+	for cut := int(complete); cut < len(b); cut++ {
+		msgs, offset := readMessages(t, FormatBinary, b[:cut])
+		if len(msgs) != 2 || offset != complete {
+			t.Fatalf("cut at %d: got %d messages up to %d, want 2 up to %d", cut, len(msgs), offset, complete)
+		}
+	}
+}
+
+func TestBinaryBadMagic(t *testing.T) {
+	for _, b := range []string{"TPSX\x02", "TPSB\x01", "TPSB\x03", "TP"} {
+		if _, err := NewMessageReader(strings.NewReader(b), FormatBinary); err != ErrBadMagic {
+			t.Errorf("%q: got %v", b, err)
+		}
+	}
+}
+
+func TestImportRequireDedupKey(t *testing.T) {
+	store := newFakeStore()
+	hub := newFakeHub(&Config{MaxBatchSize: 10}, store)
+	defer hub.CloseStream("s")
+	b := writeMessages(t, FormatBinary, exportMessages())
+	r, err := NewMessageReader(bytes.NewReader(b), FormatBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second message has a key and is skipped, the third has none
+	n, err := hub.Import("s", r, ImportOptions{Skip: 2, RequireDedupKey: true})
+	if err == nil || !strings.Contains(err.Error(), "message 3 has no dedup key") {
+		t.Fatalf("got %v", err)
+	}
+	if n != 2 {
+		t.Errorf("imported up to %d, want 2", n)
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// fakeStore is an in-memory Store for the poll worker and hub tests, the
+// methods it does not implement panic through the nil embedded Store
+type fakeStore struct {
+	Store
+
+	mu       sync.Mutex
+	messages map[string][]Message
+	// endless makes every fetch return one more message
+	endless bool
+	// missing streams fail MaxIDs, maxIDQueries counts its calls
+	missing      map[string]bool
+	maxIDQueries int
+	// stream name + "/" + consumer id -> committed offset
+	offsets map[string]Offset
+	// stream name -> watermark
+	watermarks map[string]int64
+	// gate blocks PutMessages until it is closed, if set
+	gate chan struct{}
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{messages: map[string][]Message{}, offsets: map[string]Offset{}, watermarks: map[string]int64{}}
+}
+
+// newFakeHub returns a hub on store without its background goroutines
+func newFakeHub(cfg *Config, store Store) *Hub {
+	return &Hub{
+		cfg:         cfg,
+		store:       store,
+		pollWorkers: map[string]*PollWorker{},
+		streams:     map[string]*Stream{},
+		patternSubs: map[string]*patternSubscription{},
+		txWrites:    map[*sql.Tx]map[string][]*Message{},
+	}
+}
+
+func (s *fakeStore) CreateStreamWithLayout(streamName string, layout StreamLayout) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.messages[streamName]; !ok {
+		s.messages[streamName] = nil
+	}
+	return nil
+}
+
+func (s *fakeStore) GetStreamNames() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.messages {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (s *fakeStore) put(streamName string, data ...string) {
+	msgs := make([]Message, len(data))
+	for i, d := range data {
+		msgs[i].Data = d
+	}
+	s.putMessages(streamName, msgs...)
+}
+
+// putMessages appends messages with the next ids
+func (s *fakeStore) putMessages(streamName string, msgs ...Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, msg := range msgs {
+		msg.ID = int64(len(s.messages[streamName]) + 1)
+		s.messages[streamName] = append(s.messages[streamName], msg)
+	}
+}
+
+// insert adds messages keeping their ids, like a writer committing late
+func (s *fakeStore) insert(streamName string, msgs ...Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := append(s.messages[streamName], msgs...)
+	sort.Slice(all, func(i, j int) bool { return all[i].ID < all[j].ID })
+	s.messages[streamName] = all
+}
+
+func (s *fakeStore) MinMaxID(streamName string) (int64, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs := s.messages[streamName]
+	if len(msgs) == 0 {
+		return 0, 0, nil
+	}
+	return msgs[0].ID, msgs[len(msgs)-1].ID, nil
+}
+
+func (s *fakeStore) IDStep(streamName string) (int64, error) {
+	return 1, nil
+}
+
+func (s *fakeStore) MaxIDs(streamNames []string) (map[string]int64, error) {
+	s.mu.Lock()
+	s.maxIDQueries++
+	for _, name := range streamNames {
+		if s.missing[name] {
+			s.mu.Unlock()
+			return nil, fmt.Errorf("table of %s does not exist", name)
+		}
+	}
+	s.mu.Unlock()
+	maxIDs := map[string]int64{}
+	for _, name := range streamNames {
+		_, max, _ := s.MinMaxID(name)
+		maxIDs[name] = max
+	}
+	return maxIDs, nil
+}
+
+func (s *fakeStore) FetchMessages(streamName string, offset Offset, limit int) ([]Message, Offset, error) {
+	return s.FetchMessagesFiltered(streamName, offset, limit, nil)
+}
+
+func (s *fakeStore) FetchMessagesFiltered(streamName string, offset Offset, limit int, filter *Filter) ([]Message, Offset, error) {
+	if s.endless {
+		return []Message{{ID: int64(offset) + 1}}, offset + 1, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var msgs []Message
+	for _, msg := range s.messages[streamName] {
+		if msg.ID > int64(offset) && len(msgs) < limit {
+			msgs = append(msgs, msg)
+		}
+	}
+	if len(msgs) == 0 {
+		return nil, offset, nil
+	}
+	return msgs, Offset(msgs[len(msgs)-1].ID), nil
+}
+
+func (s *fakeStore) GetCommittedOffset(streamName string, consumerID string) (Offset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if offset, ok := s.offsets[streamName+"/"+consumerID]; ok {
+		return offset, nil
+	}
+	return LatestId, nil
+}
+
+func (s *fakeStore) InitCommittedOffset(streamName string, consumerID string, offset Offset) (Offset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := streamName + "/" + consumerID
+	if saved, ok := s.offsets[key]; ok {
+		return saved, nil
+	}
+	s.offsets[key] = offset
+	return offset, nil
+}
+
+func (s *fakeStore) BumpWatermark(streamName string, maxID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if maxID > s.watermarks[streamName] {
+		s.watermarks[streamName] = maxID
+	}
+	return nil
+}
+
+func (s *fakeStore) PutMessages(streamName string, messages []*Message) error {
+	if s.gate != nil {
+		<-s.gate
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, msg := range messages {
+		msg.ID = int64(len(s.messages[streamName]) + 1)
+		s.messages[streamName] = append(s.messages[streamName], *msg)
+	}
+	return nil
+}
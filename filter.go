@@ -0,0 +1,332 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Filter selects the messages delivered to a subscriber, it is a list of
+// predicates joined by &&:
+//
+//	header.type == "order" && data.amount > 100 && data.customer.id ^= "eu-"
+//
+// header.<name> is a header of the message and data.<path> a field of its
+// JSON data, array elements are selected by index and names with special
+// characters are quoted, e.g. data."first name".0. A field alone tests
+// that it exists. Operators are == and != on strings, numbers, booleans
+// and null, ^= (prefix) on strings and <, <=, > and >= on numbers. Objects
+// and arrays are never equal to a value. Headers are strings.
+type Filter struct {
+	expr  string
+	preds []predicate
+}
+
+type predicate struct {
+	// header is the header name, empty for data predicates
+	header string
+	path   []string
+	// op is empty when the predicate tests existence
+	op    string
+	value interface{}
+}
+
+var filterOps = []string{"==", "!=", "^=", "<=", ">=", "<", ">"}
+
+// ParseFilter parses a filter expression, see Filter
+func ParseFilter(expr string) (*Filter, error) {
+	p := &filterParser{s: expr}
+	f := &Filter{expr: expr}
+	for {
+		pred, err := p.predicate()
+		if err != nil {
+			return nil, fmt.Errorf("filter %q: %v", expr, err)
+		}
+		f.preds = append(f.preds, pred)
+		p.skipSpace()
+		if p.pos == len(p.s) {
+			return f, nil
+		}
+		if !strings.HasPrefix(p.s[p.pos:], "&&") {
+			return nil, fmt.Errorf("filter %q: expected && at %d", expr, p.pos)
+		}
+		p.pos += 2
+	}
+}
+
+func (f *Filter) String() string {
+	return f.expr
+}
+
+type filterParser struct {
+	s   string
+	pos int
+}
+
+func (p *filterParser) skipSpace() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *filterParser) predicate() (predicate, error) {
+	var pred predicate
+	p.skipSpace()
+	path, err := p.path()
+	if err != nil {
+		return pred, err
+	}
+	switch {
+	case len(path) == 2 && path[0] == "header":
+		pred.header = path[1]
+	case len(path) >= 1 && path[0] == "data":
+		pred.path = path[1:]
+	default:
+		return pred, fmt.Errorf("field must be header.<name> or data[.<path>] at %d", p.pos)
+	}
+	p.skipSpace()
+	for _, op := range filterOps {
+		if strings.HasPrefix(p.s[p.pos:], op) {
+			pred.op = op
+			p.pos += len(op)
+			break
+		}
+	}
+	if pred.op == "" {
+		return pred, nil
+	}
+	p.skipSpace()
+	dec := json.NewDecoder(strings.NewReader(p.s[p.pos:]))
+	if err := dec.Decode(&pred.value); err != nil {
+		return pred, fmt.Errorf("bad value at %d: %v", p.pos, err)
+	}
+	p.pos += int(dec.InputOffset())
+	switch v := pred.value.(type) {
+	case string:
+		if pred.op != "==" && pred.op != "!=" && pred.op != "^=" {
+			return pred, fmt.Errorf("%s needs a number", pred.op)
+		}
+	case float64:
+		if pred.op == "^=" {
+			return pred, fmt.Errorf("^= needs a string")
+		}
+	case bool, nil:
+		if pred.op != "==" && pred.op != "!=" {
+			return pred, fmt.Errorf("%s can not compare %v", pred.op, v)
+		}
+	default:
+		return pred, fmt.Errorf("%s can only compare a string, number, boolean or null", pred.op)
+	}
+	if pred.header != "" {
+		if _, ok := pred.value.(string); !ok {
+			return pred, fmt.Errorf("header %s is compared to a string", pred.header)
+		}
+	}
+	return pred, nil
+}
+
+// path reads dot separated names, quoted or made of letters, digits, _ and -
+func (p *filterParser) path() ([]string, error) {
+	var path []string
+	for {
+		if p.pos < len(p.s) && p.s[p.pos] == '"' {
+			dec := json.NewDecoder(strings.NewReader(p.s[p.pos:]))
+			var name string
+			if err := dec.Decode(&name); err != nil {
+				return nil, fmt.Errorf("bad name at %d: %v", p.pos, err)
+			}
+			p.pos += int(dec.InputOffset())
+			path = append(path, name)
+		} else {
+			start := p.pos
+			for p.pos < len(p.s) && isFilterNameChar(p.s[p.pos]) {
+				p.pos++
+			}
+			if start == p.pos {
+				return nil, fmt.Errorf("expected a name at %d", p.pos)
+			}
+			path = append(path, p.s[start:p.pos])
+		}
+		if p.pos == len(p.s) || p.s[p.pos] != '.' {
+			return path, nil
+		}
+		p.pos++
+	}
+}
+
+func isFilterNameChar(c byte) bool {
+	return c == '_' || c == '-' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// invalidData is the parsed data of a message which is not JSON
+type invalidData struct{}
+
+func parseData(data string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(data), &v); err != nil {
+		return invalidData{}
+	}
+	return v
+}
+
+// needsData tells if the filter looks at the data of messages
+func (f *Filter) needsData() bool {
+	for _, pred := range f.preds {
+		if pred.header == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Match tells if msg is selected by the filter
+func (f *Filter) Match(msg *Message) bool {
+	var data interface{}
+	if f.needsData() {
+		data = parseData(msg.Data)
+	}
+	return f.match(msg, data)
+}
+
+// match is Match with the data of msg parsed by parseData
+func (f *Filter) match(msg *Message, data interface{}) bool {
+	for _, pred := range f.preds {
+		var v interface{}
+		var found bool
+		if pred.header != "" {
+			v, found = msg.Headers[pred.header]
+		} else {
+			v, found = lookupPath(data, pred.path)
+		}
+		if !pred.eval(v, found) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterMessages returns the messages matching f, parsed are their data
+// parsed by parseData, nil if the filter does not need them
+func (f *Filter) filterMessages(msgs []Message, parsed []interface{}) []Message {
+	var ret []Message
+	for i := range msgs {
+		var data interface{}
+		if parsed != nil {
+			data = parsed[i]
+		}
+		if f.match(&msgs[i], data) {
+			ret = append(ret, msgs[i])
+		}
+	}
+	return ret
+}
+
+func lookupPath(v interface{}, path []string) (interface{}, bool) {
+	if _, ok := v.(invalidData); ok {
+		return nil, false
+	}
+	for _, name := range path {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			child, ok := node[name]
+			if !ok {
+				return nil, false
+			}
+			v = child
+		case []interface{}:
+			var i int
+			if _, err := fmt.Sscanf(name, "%d", &i); err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// scalarEqual compares a JSON value to a scalar literal, objects and
+// arrays are uncomparable and never equal to it
+func scalarEqual(v interface{}, want interface{}) bool {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	}
+	return v == want
+}
+
+func (pred predicate) eval(v interface{}, found bool) bool {
+	switch pred.op {
+	case "":
+		return found
+	case "==":
+		return found && scalarEqual(v, pred.value)
+	case "!=":
+		return !found || !scalarEqual(v, pred.value)
+	case "^=":
+		s, ok := v.(string)
+		return found && ok && strings.HasPrefix(s, pred.value.(string))
+	}
+	n, ok := v.(float64)
+	if !found || !ok {
+		return false
+	}
+	want := pred.value.(float64)
+	switch pred.op {
+	case "<":
+		return n < want
+	case "<=":
+		return n <= want
+	case ">":
+		return n > want
+	case ">=":
+		return n >= want
+	}
+	return false
+}
+
+// sqlWhere returns the conditions of the header predicates for the
+// WHERE clause of FetchMessages, data predicates are only checked by
+// Match as the data is not always JSON
+func (f *Filter) sqlWhere() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	for _, pred := range f.preds {
+		if pred.header == "" {
+			continue
+		}
+		b, _ := json.Marshal(pred.header)
+		path := "$." + string(b)
+		switch pred.op {
+		case "":
+			conds = append(conds, "JSON_CONTAINS_PATH(headers, 'one', ?)")
+			args = append(args, path)
+		case "==":
+			conds = append(conds, "JSON_UNQUOTE(JSON_EXTRACT(headers, ?)) = ?")
+			args = append(args, path, pred.value)
+		case "^=":
+			conds = append(conds, "JSON_UNQUOTE(JSON_EXTRACT(headers, ?)) LIKE ?")
+			args = append(args, path, escapeLike(pred.value.(string))+"%")
+		}
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,114 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"amount > 1",
+		"data.amount >",
+		"data.amount > \"x\"",
+		"data.name ^= 1",
+		"data.ok < true",
+		"header.type == 1",
+		"data.a == {\"b\": 1}",
+		"data.a != [1, 2]",
+		"data.a == 1 || data.b == 2",
+	} {
+		if _, err := ParseFilter(expr); err == nil {
+			t.Errorf("%q: expected an error", expr)
+		}
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	msg := &Message{
+		Data:    `{"amount": 150, "customer": {"id": "eu-1"}, "tags": ["a"], "ok": true, "none": null}`,
+		Headers: map[string]string{"type": "order"},
+	}
+	for _, c := range []struct {
+		expr string
+		want bool
+	}{
+		{`header.type == "order"`, true},
+		{`header.type != "order"`, false},
+		{`header.type ^= "ord"`, true},
+		{`header.missing`, false},
+		{`header.type`, true},
+		{`data.amount > 100`, true},
+		{`data.amount <= 100`, false},
+		{`data.amount >= 150 && data.amount < 151`, true},
+		{`data.customer.id ^= "eu-"`, true},
+		{`data.tags.0 == "a"`, true},
+		{`data.tags.1`, false},
+		{`data.ok == true`, true},
+		{`data.none == null`, true},
+		{`data.missing != 1`, true},
+		{`data.amount == "150"`, false},
+		// objects and arrays are never equal to a literal
+		{`data.customer == "eu-1"`, false},
+		{`data.tags != 1`, true},
+		{`data.customer.id == "eu-1" && header.type == "other"`, false},
+	} {
+		f, err := ParseFilter(c.expr)
+		if err != nil {
+			t.Fatalf("%q: %v", c.expr, err)
+		}
+		if got := f.Match(msg); got != c.want {
+			t.Errorf("%q: got %v, want %v", c.expr, got, c.want)
+		}
+	}
+}
+
+func TestFilterMatchNotJSON(t *testing.T) {
+	f, err := ParseFilter(`data.a == 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Match(&Message{Data: "not json"}) {
+		t.Error("non JSON data matched")
+	}
+	// non JSON data has no fields at all
+	f, err = ParseFilter(`data != 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Match(&Message{Data: "not json"}) {
+		t.Error("non JSON data did not match !=")
+	}
+}
+
+func TestFilterSQLWhere(t *testing.T) {
+	f, err := ParseFilter(`header.type == "order" && header.region ^= "eu_" && header.trace && data.amount > 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	where, args := f.sqlWhere()
+	wantWhere := `JSON_UNQUOTE(JSON_EXTRACT(headers, ?)) = ? AND ` +
+		`JSON_UNQUOTE(JSON_EXTRACT(headers, ?)) LIKE ? AND ` +
+		`JSON_CONTAINS_PATH(headers, 'one', ?)`
+	if where != wantWhere {
+		t.Errorf("got %s", where)
+	}
+	wantArgs := []interface{}{`$."type"`, "order", `$."region"`, `eu\_%`, `$."trace"`}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("got %v", args)
+	}
+}
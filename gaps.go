@@ -0,0 +1,83 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"time"
+)
+
+// idGaps holds back the messages read after a gap in the ids of a
+// stream. Writers commit in any order, so a missing id may belong to a
+// transaction still in flight when a higher one is read, and moving the
+// offset past it would skip that message for good. A gap is waited for
+// up to timeout, then it is taken for an id which is never used, e.g. of
+// a rolled back transaction or of another TiDB server's id cache.
+type idGaps struct {
+	// step is the difference between consecutive ids
+	step    int64
+	timeout time.Duration
+	// since is when the gap after the id after was first seen
+	since time.Time
+	after int64
+}
+
+func newIDGaps(cfg *Config, s Store, streamName string) (idGaps, error) {
+	step, err := s.IDStep(streamName)
+	if err != nil {
+		return idGaps{}, err
+	}
+	return idGaps{
+		step:    step,
+		timeout: time.Duration(cfg.GapTimeoutInMs) * time.Millisecond,
+	}, nil
+}
+
+// settled returns the messages of msgs, which were read after offset, up
+// to the first gap still waited for
+func (g *idGaps) settled(offset Offset, msgs []Message, now time.Time) []Message {
+	if g.timeout <= 0 {
+		return msgs
+	}
+	// nothing is known about the ids before the first one
+	prev := int64(offset)
+	for i := range msgs {
+		if prev > 0 && msgs[i].ID > prev+g.step {
+			if g.since.IsZero() || g.after != prev {
+				g.since, g.after = now, prev
+			}
+			if now.Sub(g.since) < g.timeout {
+				return msgs[:i]
+			}
+		}
+		prev = msgs[i].ID
+	}
+	g.since = time.Time{}
+	return msgs
+}
+
+// IDStep returns the difference between consecutive ids of a stream: 1
+// for the sequence of an auto_random stream, auto_increment_increment
+// otherwise
+func (s *TiDBStore) IDStep(streamName string) (int64, error) {
+	layout, _, err := s.streamLayout(streamName)
+	if err != nil || layout == LayoutAutoRandom {
+		return 1, err
+	}
+	var step int64
+	if err := s.db.QueryRow(`SELECT @@auto_increment_increment`).Scan(&step); err != nil {
+		return 0, err
+	}
+	return step, nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"testing"
+	"time"
+)
+
+func messagesWithIDs(ids ...int64) []Message {
+	msgs := make([]Message, len(ids))
+	for i, id := range ids {
+		msgs[i].ID = id
+	}
+	return msgs
+}
+
+func TestIDGapsSettled(t *testing.T) {
+	g := idGaps{step: 1, timeout: time.Second}
+	now := time.Now()
+	check := func(name string, offset Offset, ids []int64, at time.Time, want int) {
+		t.Helper()
+		if got := g.settled(offset, messagesWithIDs(ids...), at); len(got) != want {
+			t.Fatalf("%s: got %d messages, want %d", name, len(got), want)
+		}
+	}
+	check("contiguous", 1, []int64{2, 3}, now, 2)
+	check("from the start", 0, []int64{5, 6}, now, 2)
+	check("gap", 3, []int64{4, 6, 7}, now, 1)
+	check("still missing", 4, []int64{6, 7}, now.Add(time.Second/2), 0)
+	check("filled", 4, []int64{5, 6, 7}, now.Add(time.Second/2), 3)
+	check("new gap", 7, []int64{9}, now.Add(time.Second/2), 0)
+	check("timed out", 7, []int64{9, 11}, now.Add(2*time.Second), 1)
+	check("next gap waits again", 9, []int64{11}, now.Add(2*time.Second), 0)
+
+	g = idGaps{step: 2, timeout: time.Second}
+	check("step", 1, []int64{3, 5}, now, 2)
+	g = idGaps{step: 1}
+	check("no timeout", 1, []int64{5}, now, 1)
+}
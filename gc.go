@@ -17,26 +17,53 @@ package tipubsub
 import (
 	"database/sql"
 	"fmt"
+	"time"
 
 	"github.com/c4pt0r/log"
 )
 
 type gcWorker struct {
-	db  *sql.DB
-	cfg *Config
+	store Store
+	db    *sql.DB
+	cfg   *Config
 }
 
-func newGCWorker(db *sql.DB, config *Config) *gcWorker {
+func newGCWorker(store Store, config *Config) *gcWorker {
 	return &gcWorker{
-		db:  db,
-		cfg: config,
+		store: store,
+		db:    store.DB(),
+		cfg:   config,
 	}
 }
 
+// quotedTable returns the table of a stream ready to be used in SQL
+func (gc *gcWorker) quotedTable(streamName string) (string, error) {
+	tblName, err := gc.store.StreamTableName(streamName)
+	return quoteIdent(tblName), err
+}
+
 // getSafeOffsetID returns the offsetID of the last message in the stream
 func (gc *gcWorker) getSafeOffsetID(streamName string) (int64, error) {
+	return gc.getSafeOffsetIDWithKeep(streamName, gc.cfg.GCKeepItems)
+}
+
+// getSafeOffsetIDWithKeep returns the smallest ID among the last keepItems messages
+func (gc *gcWorker) getSafeOffsetIDWithKeep(streamName string, keepItems int) (int64, error) {
+	tblName, err := gc.quotedTable(streamName)
+	if err != nil {
+		return 0, err
+	}
+	if keepItems <= 0 {
+		// keep nothing, everything up to the max id goes
+		var maxID int64
+		stmt := fmt.Sprintf(`SELECT IFNULL(MAX(id), 0) FROM %s`, tblName)
+		if err := gc.db.QueryRow(stmt).Scan(&maxID); err != nil {
+			return 0, err
+		}
+		return maxID + 1, nil
+	}
 	stmt := fmt.Sprintf(`
-			SELECT MIN(t.id) 
+			SELECT IFNULL(MIN(t.id), 0)
 			FROM (
 				SELECT 
 					id
@@ -46,44 +73,93 @@ func (gc *gcWorker) getSafeOffsetID(streamName string) (int64, error) {
 					id
 				DESC LIMIT %d
 			) as t
-		`, getStreamTblName(streamName), gc.cfg.GCKeepItems)
+		`, tblName, keepItems)
 
 	var safeOffsetID int64
-	err := gc.db.QueryRow(stmt).Scan(&safeOffsetID)
+	err = gc.db.QueryRow(stmt).Scan(&safeOffsetID)
 	if err != nil {
 		return 0, err
 	}
 	return safeOffsetID, nil
 }
 
-// deleteUntil deletes all messages in the stream before the given offsetID
-func (gc *gcWorker) deleteUntil(streamName string, offsetID int64) error {
+// deleteUntil deletes all messages in the stream before the given offsetID,
+// it returns the number of deleted messages
+func (gc *gcWorker) deleteUntil(streamName string, offsetID int64) (int64, error) {
+	tblName, err := gc.quotedTable(streamName)
+	if err != nil {
+		return 0, err
+	}
 	stmt := fmt.Sprintf(`
 		DELETE FROM
 			%s
 		WHERE
 			id < ?
 		LIMIT %d
-	`, getStreamTblName(streamName), gc.cfg.MaxBatchSize) // TODO: batch size
+	`, tblName, gc.cfg.MaxBatchSize) // TODO: batch size
+	var deleted int64
 	for {
 		res, err := gc.db.Exec(stmt, offsetID)
 		if err != nil {
-			return err
+			return deleted, err
 		}
 		affectedRows, err := res.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
 		if affectedRows == 0 {
 			break
 		}
+		deleted += affectedRows
 		log.D("GC", "Deleted %d messages", affectedRows)
 	}
-	return nil
+	return deleted, nil
+}
+
+// deleteExpired deletes the expired messages of the stream wherever they
+// are, it returns the number of deleted messages
+func (gc *gcWorker) deleteExpired(streamName string) (int64, error) {
+	tblName, err := gc.quotedTable(streamName)
+	if err != nil {
+		return 0, err
+	}
+	stmt := fmt.Sprintf(`
+		DELETE FROM
+			%s
+		WHERE
+			expire_at <= ?
+		LIMIT %d
+	`, tblName, gc.cfg.MaxBatchSize)
+	now := time.Now().UnixNano()
+	var deleted int64
+	for {
+		res, err := gc.db.Exec(stmt, now)
+		if err != nil {
+			return deleted, err
+		}
+		affectedRows, err := res.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		if affectedRows == 0 {
+			break
+		}
+		deleted += affectedRows
+		log.D("GC", "Deleted %d expired messages", affectedRows)
+	}
+	return deleted, nil
 }
 
-// safeGC deletes all messages in the stream before the last SAFE_AMOUNT messages
+// safeGC deletes the expired messages and all messages in the stream
+// before the last SAFE_AMOUNT messages
 func (gc *gcWorker) safeGC(streamName string) error {
+	if _, err := gc.deleteExpired(streamName); err != nil {
+		return err
+	}
 	safePoint, err := gc.getSafeOffsetID(streamName)
 	if err != nil {
 		return err
 	}
-	return gc.deleteUntil(streamName, safePoint)
+	_, err = gc.deleteUntil(streamName, safePoint)
+	return err
 }
@@ -0,0 +1,248 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package grpcapi is a gRPC front-end of Hub, see pb/tipubsub.proto.
+// Clients use the generated pb.PubSubClient.
+package grpcapi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/c4pt0r/log"
+	"github.com/c4pt0r/tipubsub"
+	"github.com/c4pt0r/tipubsub/grpcapi/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type Server struct {
+	pb.UnimplementedPubSubServer
+
+	hub *tipubsub.Hub
+	seq int64
+}
+
+var _ pb.PubSubServer = (*Server)(nil)
+
+func NewServer(hub *tipubsub.Hub) *Server {
+	return &Server{
+		hub: hub,
+	}
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	gs := grpc.NewServer()
+	pb.RegisterPubSubServer(gs, s)
+	log.Info("grpc: listening on", addr)
+	return gs.Serve(l)
+}
+
+func (s *Server) Publish(ctx context.Context, req *pb.PublishRequest) (*pb.PublishResponse, error) {
+	if req.Stream == "" || req.Message == nil {
+		return nil, status.Error(codes.InvalidArgument, "stream and message are required")
+	}
+	if err := s.hub.Publish(req.Stream, fromPB(req.Message)); err != nil {
+		return nil, publishError(err)
+	}
+	return &pb.PublishResponse{}, nil
+}
+
+func (s *Server) PublishBatch(ctx context.Context, req *pb.PublishBatchRequest) (*pb.PublishResponse, error) {
+	if req.Stream == "" {
+		return nil, status.Error(codes.InvalidArgument, "stream is required")
+	}
+	for _, m := range req.Messages {
+		if err := s.hub.Publish(req.Stream, fromPB(m)); err != nil {
+			return nil, publishError(err)
+		}
+	}
+	return &pb.PublishResponse{}, nil
+}
+
+// publishError lets clients back off when the publish queue is full
+func publishError(err error) error {
+	if err == tipubsub.ErrQueueFull {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func (s *Server) Subscribe(req *pb.SubscribeRequest, stream pb.PubSub_SubscribeServer) error {
+	ch, subscriberID, err := s.subscribe(req)
+	if err != nil {
+		return err
+	}
+	defer s.hub.Unsubscribe(req.Stream, subscriberID)
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case msg, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if err := stream.Send(toPB(msg)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *Server) Consume(stream pb.PubSub_ConsumeServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	req := first.GetSubscribe()
+	if req == nil {
+		return status.Error(codes.InvalidArgument, "first request must be subscribe")
+	}
+	ch, subscriberID, err := s.subscribe(req)
+	if err != nil {
+		return err
+	}
+	defer s.hub.Unsubscribe(req.Stream, subscriberID)
+
+	credits := make(chan int32, 16)
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			r, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			switch v := r.Request.(type) {
+			case *pb.ConsumeRequest_Credit:
+				select {
+				case credits <- v.Credit.N:
+				case <-stream.Context().Done():
+					return
+				}
+			case *pb.ConsumeRequest_Ack:
+				if err := s.hub.CommitOffset(req.Stream, subscriberID, tipubsub.Offset(v.Ack.Id)); err != nil {
+					recvErr <- status.Error(codes.Internal, err.Error())
+					return
+				}
+			default:
+				recvErr <- status.Error(codes.InvalidArgument, "unexpected subscribe request")
+				return
+			}
+		}
+	}()
+
+	var available int32
+	for {
+		// only read from the subscription when the client has credits left
+		var msgs <-chan tipubsub.Message
+		if available > 0 {
+			msgs = ch
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case err := <-recvErr:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case n := <-credits:
+			available += n
+		case msg, ok := <-msgs:
+			if !ok {
+				return nil
+			}
+			if err := stream.Send(toPB(msg)); err != nil {
+				return err
+			}
+			available--
+		}
+	}
+}
+
+// subscribe resolves the offset of req and subscribes to the hub
+func (s *Server) subscribe(req *pb.SubscribeRequest) (<-chan tipubsub.Message, string, error) {
+	if req.Stream == "" {
+		return nil, "", status.Error(codes.InvalidArgument, "stream is required")
+	}
+	subscriberID := req.SubscriberId
+	if subscriberID == "" {
+		if req.OffsetType == pb.OffsetType_COMMITTED {
+			return nil, "", status.Error(codes.InvalidArgument, "subscriber_id is required for committed offset")
+		}
+		subscriberID = fmt.Sprintf("grpc-%d", atomic.AddInt64(&s.seq, 1))
+	}
+	var offset tipubsub.Offset
+	switch req.OffsetType {
+	case pb.OffsetType_LATEST:
+		offset = tipubsub.LatestId
+	case pb.OffsetType_EARLIEST:
+		offset = 0
+	case pb.OffsetType_ID:
+		offset = tipubsub.Offset(req.Offset)
+	case pb.OffsetType_COMMITTED:
+		o, err := s.hub.CommittedOffset(req.Stream, subscriberID)
+		if err != nil {
+			return nil, "", status.Error(codes.Internal, err.Error())
+		}
+		offset = o
+	default:
+		return nil, "", status.Error(codes.InvalidArgument, "unknown offset type")
+	}
+	var filter *tipubsub.Filter
+	if req.Filter != "" {
+		f, err := tipubsub.ParseFilter(req.Filter)
+		if err != nil {
+			return nil, "", status.Error(codes.InvalidArgument, err.Error())
+		}
+		filter = f
+	}
+	ch, err := s.hub.SubscribeWithFilter(req.Stream, subscriberID, offset, filter)
+	if err != nil {
+		return nil, "", status.Error(codes.Internal, err.Error())
+	}
+	return ch, subscriberID, nil
+}
+
+func fromPB(m *pb.Message) *tipubsub.Message {
+	return &tipubsub.Message{
+		Ts:        m.Ts,
+		Data:      m.Data,
+		DedupKey:  m.DedupKey,
+		DeliverAt: m.DeliverAt,
+		ExpireAt:  m.ExpireAt,
+		Headers:   m.Headers,
+	}
+}
+
+func toPB(m tipubsub.Message) *pb.Message {
+	return &pb.Message{
+		Id:        m.ID,
+		Ts:        m.Ts,
+		Data:      m.Data,
+		DedupKey:  m.DedupKey,
+		DeliverAt: m.DeliverAt,
+		ExpireAt:  m.ExpireAt,
+		Headers:   m.Headers,
+	}
+}
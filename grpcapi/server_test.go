@@ -0,0 +1,52 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcapi
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/c4pt0r/tipubsub"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMessageConversion(t *testing.T) {
+	msg := tipubsub.Message{
+		ID:        7,
+		Ts:        100,
+		Data:      "a",
+		DedupKey:  "k",
+		DeliverAt: 200,
+		ExpireAt:  300,
+		Headers:   map[string]string{"kind": "x"},
+	}
+	got := fromPB(toPB(msg))
+	// the id is set by the store, it is not published
+	msg.ID = 0
+	if !reflect.DeepEqual(*got, msg) {
+		t.Fatalf("got %+v, want %+v", *got, msg)
+	}
+}
+
+func TestPublishError(t *testing.T) {
+	if code := status.Code(publishError(tipubsub.ErrQueueFull)); code != codes.ResourceExhausted {
+		t.Errorf("queue full: got %s", code)
+	}
+	if code := status.Code(publishError(errors.New("boom"))); code != codes.Internal {
+		t.Errorf("other error: got %s", code)
+	}
+}
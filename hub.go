@@ -18,6 +18,7 @@ import (
 	"database/sql"
 	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/c4pt0r/log"
@@ -34,12 +35,22 @@ type Hub struct {
 	// streamName -> Stream
 	streams map[string]*Stream
 	cfg     *Config
+	// subscriberID -> pattern subscription
+	patternSubs map[string]*patternSubscription
+	notifier    *notifier
+	// transactions begun by RunTx -> messages PublishTx wrote in them
+	txMu     sync.Mutex
+	txWrites map[*sql.Tx]map[string][]*Message
 
 	gcWorker *gcWorker
 }
 
 func NewHub(c *Config) (*Hub, error) {
-	store, err := OpenStore(c.DSN)
+	store, err := OpenStoreWithConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	notifier, err := newNotifier(c)
 	if err != nil {
 		return nil, err
 	}
@@ -49,9 +60,30 @@ func NewHub(c *Config) (*Hub, error) {
 		store:       store,
 		pollWorkers: map[string]*PollWorker{},
 		streams:     map[string]*Stream{},
-		gcWorker:    newGCWorker(store.DB(), c),
+		patternSubs: map[string]*patternSubscription{},
+		notifier:    notifier,
+		txWrites:    map[*sql.Tx]map[string][]*Message{},
+		gcWorker:    newGCWorker(store, c),
 	}
 	go h.gc()
+	if c.DelayCheckIntervalInMs > 0 {
+		go h.deliverDelayed()
+	}
+	if c.StreamWatchIntervalInMs > 0 {
+		go h.watchStreams()
+	}
+	if c.WatermarkIntervalInMs > 0 {
+		go h.watchWatermarks()
+	}
+	if c.SharedPollIntervalInMs > 0 {
+		go h.sharedPoll()
+	}
+	if c.PollWorkerIdleTimeoutInSec > 0 {
+		go h.stopIdlePollWorkers()
+	}
+	if c.NotifyAddr != "" {
+		go h.receiveNotifications()
+	}
 	return h, nil
 }
 
@@ -68,32 +100,270 @@ func (m *Hub) gc() {
 	}
 }
 
+// stopIdlePollWorkers stops and forgets the poll workers without
+// subscribers for PollWorkerIdleTimeoutInSec, the next Subscribe to their
+// stream starts a new one. Subscribers resume from their own offsets, so
+// durable consumers lose no message.
+func (m *Hub) stopIdlePollWorkers() {
+	timeout := time.Duration(m.cfg.PollWorkerIdleTimeoutInSec) * time.Second
+	for {
+		time.Sleep(timeout)
+		m.stopPollWorkersIdleFor(timeout)
+	}
+}
+
+// stopPollWorkersIdleFor stops the poll workers without subscribers for timeout
+func (m *Hub) stopPollWorkersIdleFor(timeout time.Duration) {
+	// holding the lock, no subscriber can be added to a worker being stopped
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for streamName, pw := range m.pollWorkers {
+		if pw.idleFor(timeout) {
+			log.I("stop idle poll worker", streamName)
+			delete(m.pollWorkers, streamName)
+			pw.Stop()
+		}
+	}
+}
+
 func (m *Hub) ForceGC(streamName string) error {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	return m.gcWorker.safeGC(streamName)
 }
 
-func (m *Hub) Publish(streamName string, msg *Message) error {
+func (m *Hub) getOrOpenStream(streamName string) (*Stream, error) {
 	m.mu.Lock()
-	if _, ok := m.streams[streamName]; !ok {
-		stream, err := NewStream(m.cfg, m.store, streamName)
-		if err != nil {
-			m.mu.Unlock()
-			return err
+	defer m.mu.Unlock()
+	if s, ok := m.streams[streamName]; ok {
+		return s, nil
+	}
+	if err := ValidateStreamName(streamName); err != nil {
+		return nil, err
+	}
+	stream, err := NewStream(m.cfg, m.store, streamName)
+	if err != nil {
+		return nil, err
+	}
+	stream.onWritten = m.streamWritten
+	if err := stream.Open(); err != nil {
+		return nil, err
+	}
+	m.streams[streamName] = stream
+	return stream, nil
+}
+
+// CreateStream creates a stream if it does not exist
+func (m *Hub) CreateStream(streamName string) error {
+	_, err := m.getOrOpenStream(streamName)
+	return err
+}
+
+// CreateStreamWithLayout creates a stream with a table layout instead of
+// the configured one, an existing stream keeps its layout
+func (m *Hub) CreateStreamWithLayout(streamName string, layout StreamLayout) error {
+	if err := m.store.CreateStreamWithLayout(streamName, layout); err != nil {
+		return err
+	}
+	_, err := m.getOrOpenStream(streamName)
+	return err
+}
+
+func (m *Hub) Publish(streamName string, msg *Message) error {
+	s, err := m.getOrOpenStream(streamName)
+	if err != nil {
+		return err
+	}
+	return s.Publish(msg)
+}
+
+// TryPublish publishes a message or returns ErrQueueFull if the queue of
+// the stream is full, it never blocks or spills
+func (m *Hub) TryPublish(streamName string, msg *Message) error {
+	s, err := m.getOrOpenStream(streamName)
+	if err != nil {
+		return err
+	}
+	return s.TryPublish(msg)
+}
+
+// PublishWithKey publishes a message, messages with the same key keep
+// their order when the stream has several writers.
+func (m *Hub) PublishWithKey(streamName string, key string, msg *Message) error {
+	s, err := m.getOrOpenStream(streamName)
+	if err != nil {
+		return err
+	}
+	return s.PublishWithKey(key, msg)
+}
+
+// PublishSync writes messages to the store right away instead of queueing
+// them for the next batch, the IDs of msgs are set when it returns.
+func (m *Hub) PublishSync(streamName string, msgs ...*Message) error {
+	if _, err := m.getOrOpenStream(streamName); err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if msg.Ts == 0 {
+			msg.Ts = time.Now().UnixNano()
 		}
-		if err := stream.Open(); err != nil {
-			m.mu.Unlock()
-			return err
+	}
+	if err := m.store.PutMessages(streamName, msgs); err != nil {
+		return err
+	}
+	m.streamWritten(streamName, msgs)
+	return nil
+}
+
+// PublishTx writes messages in tx, a transaction on the database of the
+// hub, so they are published only if tx commits. The IDs of msgs are set
+// when it returns. When tx comes from RunTx or Process the subscribers are
+// woken as soon as it commits, otherwise they see the messages at their
+// next poll.
+func (m *Hub) PublishTx(tx *sql.Tx, streamName string, msgs ...*Message) error {
+	if _, err := m.getOrOpenStream(streamName); err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if msg.Ts == 0 {
+			msg.Ts = time.Now().UnixNano()
 		}
-		m.streams[streamName] = stream
 	}
-	s := m.streams[streamName]
-	m.mu.Unlock()
-	s.Publish(msg)
+	if err := m.store.PutMessagesTx(tx, streamName, msgs); err != nil {
+		return err
+	}
+	m.txMu.Lock()
+	if written, ok := m.txWrites[tx]; ok {
+		written[streamName] = append(written[streamName], msgs...)
+	}
+	m.txMu.Unlock()
 	return nil
 }
 
+// RunTx runs fn in a transaction on the database of the hub and commits
+// it if fn returns no error. The messages fn writes with PublishTx wake
+// their subscribers and move their watermarks once it commits.
+func (m *Hub) RunTx(fn func(tx *sql.Tx) error) error {
+	tx, err := m.store.DB().Begin()
+	if err != nil {
+		return err
+	}
+	m.txMu.Lock()
+	m.txWrites[tx] = map[string][]*Message{}
+	m.txMu.Unlock()
+	committed := false
+	defer func() {
+		tx.Rollback()
+		m.txMu.Lock()
+		written := m.txWrites[tx]
+		delete(m.txWrites, tx)
+		m.txMu.Unlock()
+		if committed {
+			for streamName, msgs := range written {
+				m.streamWritten(streamName, msgs)
+			}
+		}
+	}()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// FetchMessages returns at most limit messages after offset
+func (m *Hub) FetchMessages(streamName string, offset Offset, limit int) ([]Message, Offset, error) {
+	return m.store.FetchMessages(streamName, offset, limit)
+}
+
+// StreamLen returns the number of messages kept in a stream
+func (m *Hub) StreamLen(streamName string) (int64, error) {
+	return m.store.CountMessages(streamName)
+}
+
+// TrimStream deletes the oldest messages of a stream and keeps at most
+// keepItems, it returns the number of deleted messages.
+func (m *Hub) TrimStream(streamName string, keepItems int) (int64, error) {
+	safePoint, err := m.gcWorker.getSafeOffsetIDWithKeep(streamName, keepItems)
+	if err != nil {
+		return 0, err
+	}
+	return m.gcWorker.deleteUntil(streamName, safePoint)
+}
+
+// TrimStreamBefore deletes the messages of a stream whose ID is less than id,
+// it returns the number of deleted messages.
+func (m *Hub) TrimStreamBefore(streamName string, id int64) (int64, error) {
+	return m.gcWorker.deleteUntil(streamName, id)
+}
+
+// detachStream closes the local publisher and poll worker of a stream,
+// subscribers see their channels closed
+func (m *Hub) detachStream(streamName string) {
+	m.mu.Lock()
+	stream := m.streams[streamName]
+	pw := m.pollWorkers[streamName]
+	delete(m.streams, streamName)
+	delete(m.pollWorkers, streamName)
+	m.mu.Unlock()
+	if stream != nil {
+		stream.Close()
+	}
+	if pw != nil {
+		pw.close()
+	}
+}
+
+// CloseStream writes the queued messages of a stream and closes its local
+// publisher, the next publish opens it again. Subscribers are not affected.
+func (m *Hub) CloseStream(streamName string) {
+	m.mu.Lock()
+	stream := m.streams[streamName]
+	delete(m.streams, streamName)
+	m.mu.Unlock()
+	if stream != nil {
+		stream.Close()
+	}
+}
+
+// DeleteStream drops a stream with its messages and durable offsets.
+// Hubs in other processes keep polling the stream until they restart.
+func (m *Hub) DeleteStream(streamName string) error {
+	m.detachStream(streamName)
+	return m.store.DeleteStream(streamName)
+}
+
+// TruncateStream deletes all the messages of a stream, IDs keep growing
+// so the durable offsets of consumers stay valid
+func (m *Hub) TruncateStream(streamName string) (int64, error) {
+	return m.TrimStream(streamName, 0)
+}
+
+// RenameStream renames a stream, subscribers of the old name on this hub
+// see their channels closed
+func (m *Hub) RenameStream(oldName string, newName string) error {
+	m.detachStream(oldName)
+	return m.store.RenameStream(oldName, newName)
+}
+
+// DescribeStream returns the statistics of a stream, Subscribers only
+// counts the ones attached to this hub
+func (m *Hub) DescribeStream(streamName string) (*StreamInfo, error) {
+	info, err := m.store.DescribeStream(streamName)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	if pw, ok := m.pollWorkers[streamName]; ok {
+		info.Subscribers = int(atomic.LoadInt32(&pw.numSubscribers))
+	}
+	m.mu.RUnlock()
+	return info, nil
+}
+
 func (m *Hub) MinMaxID(streamName string) (int64, int64, error) {
 	return m.store.MinMaxID(streamName)
 }
@@ -107,6 +377,17 @@ func (m *Hub) PollStat(streamName string) map[string]interface{} {
 	return nil
 }
 
+// PublishStat returns the queue metrics of a stream opened for publishing
+// on this hub, nil if it is not
+func (m *Hub) PublishStat(streamName string) map[string]interface{} {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if s, ok := m.streams[streamName]; ok {
+		return s.Stat()
+	}
+	return nil
+}
+
 func (m *Hub) MessagesSinceOffset(streamName string, offset Offset) ([]Message, error) {
 	var ret []Message
 	for {
@@ -126,6 +407,21 @@ func (m *Hub) MessagesSinceOffset(streamName string, offset Offset) ([]Message,
 }
 
 func (m *Hub) Subscribe(streamName string, subscriberID string) (<-chan Message, error) {
+	return m.SubscribeFrom(streamName, subscriberID, LatestId)
+}
+
+// SubscribeFrom subscribes to a stream and replays the messages after offset
+// before delivering new ones, LatestId means only new messages.
+// The returned channel is closed after Unsubscribe, or when the subscriber
+// falls SubscriberQueueSize batches behind and has to subscribe again from
+// the offset of its last message.
+func (m *Hub) SubscribeFrom(streamName string, subscriberID string, offset Offset) (<-chan Message, error) {
+	return m.SubscribeWithFilter(streamName, subscriberID, offset, nil)
+}
+
+// SubscribeWithFilter is SubscribeFrom delivering only the messages
+// matching filter, nil delivers all of them
+func (m *Hub) SubscribeWithFilter(streamName string, subscriberID string, offset Offset, filter *Filter) (<-chan Message, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	// if the stream is not in the map, create a new poll worker for this stream
@@ -137,7 +433,7 @@ func (m *Hub) Subscribe(streamName string, subscriberID string) (<-chan Message,
 		}
 		m.pollWorkers[streamName] = pw
 	}
-	return m.pollWorkers[streamName].addNewSubscriber(subscriberID)
+	return m.pollWorkers[streamName].addNewSubscriber(subscriberID, offset, filter)
 }
 
 func (m *Hub) Unsubscribe(streamName string, subscriberID string) {
@@ -148,6 +444,39 @@ func (m *Hub) Unsubscribe(streamName string, subscriberID string) {
 	}
 }
 
+// CommitOffset saves the durable offset of a consumer, the consumer has
+// processed all the messages up to and including offset.
+func (m *Hub) CommitOffset(streamName string, consumerID string, offset Offset) error {
+	return m.store.CommitOffset(streamName, consumerID, offset)
+}
+
+// CommitOffsetTx is CommitOffset in the transaction tx
+func (m *Hub) CommitOffsetTx(tx *sql.Tx, streamName string, consumerID string, offset Offset) error {
+	return m.store.CommitOffsetTx(tx, streamName, consumerID, offset)
+}
+
+// LockCommittedOffset returns the durable offset of a consumer and locks it
+// until tx ends, so the readers sharing it take turns. It is LatestId if
+// the consumer never committed.
+func (m *Hub) LockCommittedOffset(tx *sql.Tx, streamName string, consumerID string) (Offset, error) {
+	return m.store.LockCommittedOffset(tx, streamName, consumerID)
+}
+
+// CommittedOffset returns the durable offset of a consumer, LatestId if the
+// consumer never committed.
+func (m *Hub) CommittedOffset(streamName string, consumerID string) (Offset, error) {
+	return m.store.GetCommittedOffset(streamName, consumerID)
+}
+
+// DeleteCommittedOffset forgets the durable offset of a consumer
+func (m *Hub) DeleteCommittedOffset(streamName string, consumerID string) error {
+	return m.store.DeleteCommittedOffset(streamName, consumerID)
+}
+
+func (m *Hub) Config() *Config {
+	return m.cfg
+}
+
 func (m *Hub) DB() *sql.DB {
 	return m.store.DB()
 }
@@ -157,3 +486,8 @@ func (m *Hub) GetStreamNames() ([]string, error) {
 	defer m.mu.RUnlock()
 	return m.store.GetStreamNames()
 }
+
+// StreamExists tells if a stream has been created
+func (m *Hub) StreamExists(streamName string) (bool, error) {
+	return m.store.StreamExists(streamName)
+}
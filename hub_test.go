@@ -0,0 +1,71 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStopIdlePollWorkers(t *testing.T) {
+	store := newFakeStore()
+	hub := newFakeHub(&Config{MaxBatchSize: 10, PollIntervalInMs: 1}, store)
+	for _, name := range []string{"idle", "busy"} {
+		if _, err := hub.Subscribe(name, "sub"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		for _, pw := range hub.pollWorkers {
+			pw.close()
+		}
+	}()
+	hub.Unsubscribe("idle", "sub")
+	idle := hub.pollWorkers["idle"]
+
+	// not idle for long enough
+	hub.stopPollWorkersIdleFor(time.Hour)
+	if len(hub.pollWorkers) != 2 {
+		t.Fatalf("%d poll workers left, want 2", len(hub.pollWorkers))
+	}
+	hub.stopPollWorkersIdleFor(0)
+	if _, ok := hub.pollWorkers["idle"]; ok {
+		t.Fatal("the idle poll worker was not stopped")
+	}
+	if _, ok := hub.pollWorkers["busy"]; !ok {
+		t.Fatal("the poll worker with a subscriber was stopped")
+	}
+	if !idle.stopped.Load().(bool) {
+		t.Fatal("the idle poll worker still runs")
+	}
+
+	// the next subscriber starts a new worker, replaying from its offset
+	store.put("idle", "a")
+	ch, err := hub.SubscribeFrom("idle", "sub", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hub.pollWorkers["idle"] == idle {
+		t.Fatal("the stopped poll worker was reused")
+	}
+	select {
+	case msg := <-ch:
+		if msg.Data != "a" {
+			t.Fatalf("got %q", msg.Data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no message from the new poll worker")
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StreamLayout is the table layout of a stream, it is chosen when the
+// stream is created and kept in tipubsub_meta.
+type StreamLayout string
+
+const (
+	// LayoutAutoIncrement uses id BIGINT AUTO_INCREMENT as the clustered
+	// primary key, all the writes of a stream go to the last region.
+	LayoutAutoIncrement StreamLayout = "auto_increment"
+	// LayoutAutoRandom clusters rows by an AUTO_RANDOM key so writes are
+	// spread across regions, the id subscribers poll by is allocated from
+	// a sequence and indexed separately.
+	LayoutAutoRandom StreamLayout = "auto_random"
+)
+
+// ParseStreamLayout parses a layout name, empty means LayoutAutoIncrement
+func ParseStreamLayout(s string) (StreamLayout, error) {
+	switch StreamLayout(strings.ToLower(s)) {
+	case "", LayoutAutoIncrement:
+		return LayoutAutoIncrement, nil
+	case LayoutAutoRandom:
+		return LayoutAutoRandom, nil
+	}
+	return "", fmt.Errorf("unknown stream layout %q, use %s or %s", s, LayoutAutoIncrement, LayoutAutoRandom)
+}
+
+const streamSeqPrefix = "tipubsub_seq_"
+
+// getStreamSeqName is the sequence allocating the ids of the auto_random
+// stream table tblName, the prefix is shorter than the table one so it
+// always fits
+func getStreamSeqName(tblName string) string {
+	return streamSeqPrefix + strings.TrimPrefix(tblName, streamTblPrefix)
+}
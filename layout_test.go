@@ -0,0 +1,64 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseStreamLayout(t *testing.T) {
+	for s, want := range map[string]StreamLayout{
+		"":               LayoutAutoIncrement,
+		"auto_increment": LayoutAutoIncrement,
+		"AUTO_RANDOM":    LayoutAutoRandom,
+	} {
+		if got, err := ParseStreamLayout(s); err != nil || got != want {
+			t.Errorf("%q: got %q, %v", s, got, err)
+		}
+	}
+	if _, err := ParseStreamLayout("hash"); err == nil {
+		t.Error("no error for an unknown layout")
+	}
+}
+
+func TestGetStreamSeqName(t *testing.T) {
+	if got := getStreamSeqName(getStreamTblName("orders")); got != "tipubsub_seq_orders" {
+		t.Errorf("got %s", got)
+	}
+	for _, name := range []string{"orders.eu", strings.Repeat("x", MaxStreamNameLen)} {
+		if seq := getStreamSeqName(getStreamTblName(name)); len(seq) > maxIdentLen {
+			t.Errorf("%q: sequence name %s is too long", name, seq)
+		}
+	}
+}
+
+func TestAutoRandomIDsFollowCommits(t *testing.T) {
+	s := testStore(t)
+	name := testStream(t, s, LayoutAutoRandom)
+	var last int64
+	for i := 0; i < 5; i++ {
+		msgs := []*Message{{Data: "a"}, {Data: "b"}}
+		if err := s.PutMessages(name, msgs); err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range msgs {
+			if msg.ID <= last {
+				t.Fatalf("id %d after %d", msg.ID, last)
+			}
+			last = msg.ID
+		}
+	}
+}
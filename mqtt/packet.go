@@ -0,0 +1,277 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// control packet types of MQTT 3.1.1
+const (
+	typeConnect     byte = 1
+	typeConnack     byte = 2
+	typePublish     byte = 3
+	typePuback      byte = 4
+	typePubrec      byte = 5
+	typeSubscribe   byte = 8
+	typeSuback      byte = 9
+	typeUnsubscribe byte = 10
+	typeUnsuback    byte = 11
+	typePingreq     byte = 12
+	typePingresp    byte = 13
+	typeDisconnect  byte = 14
+)
+
+// CONNACK return codes
+const (
+	connAccepted             byte = 0
+	connRefusedProtocol      byte = 1
+	connRefusedIdentifier    byte = 2
+	connRefusedNotAuthorized byte = 5
+)
+
+const subackFailure byte = 0x80
+
+// maxPacketSize bounds the remaining length we accept from clients
+const maxPacketSize = 16 * 1024 * 1024
+
+var (
+	errMalformed      = errors.New("mqtt: malformed packet")
+	errPacketTooLarge = errors.New("mqtt: packet too large")
+)
+
+type packet struct {
+	typ   byte
+	flags byte
+	body  []byte
+}
+
+func readPacket(r *bufio.Reader) (*packet, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	// remaining length is a variable byte integer of at most 4 bytes
+	var length, shift int
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, errMalformed
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length |= int(c&0x7f) << shift
+		if c&0x80 == 0 {
+			break
+		}
+		shift += 7
+	}
+	if length > maxPacketSize {
+		return nil, errPacketTooLarge
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return &packet{typ: b >> 4, flags: b & 0x0f, body: body}, nil
+}
+
+func encodePacket(typ byte, flags byte, body []byte) []byte {
+	buf := []byte{typ<<4 | flags}
+	n := len(body)
+	for {
+		c := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			c |= 0x80
+		}
+		buf = append(buf, c)
+		if n == 0 {
+			break
+		}
+	}
+	return append(buf, body...)
+}
+
+// decoder reads the fields of a packet body
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil || len(d.buf) < 1 {
+		d.err = errMalformed
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *decoder) uint16() uint16 {
+	if d.err != nil || len(d.buf) < 2 {
+		d.err = errMalformed
+		return 0
+	}
+	v := binary.BigEndian.Uint16(d.buf)
+	d.buf = d.buf[2:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := int(d.uint16())
+	if d.err != nil || len(d.buf) < n {
+		d.err = errMalformed
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = appendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+type connectPacket struct {
+	protocol     string
+	level        byte
+	cleanSession bool
+	keepAlive    uint16
+	clientID     string
+	username     string
+	password     []byte
+}
+
+func decodeConnect(p *packet) (*connectPacket, error) {
+	d := &decoder{buf: p.body}
+	c := &connectPacket{}
+	c.protocol = d.string()
+	c.level = d.byte()
+	flags := d.byte()
+	c.keepAlive = d.uint16()
+	c.cleanSession = flags&0x02 != 0
+	c.clientID = d.string()
+	if flags&0x04 != 0 {
+		// will topic and message, wills are not supported and ignored
+		d.string()
+		d.bytes()
+	}
+	if flags&0x80 != 0 {
+		c.username = d.string()
+	}
+	if flags&0x40 != 0 {
+		c.password = d.bytes()
+	}
+	return c, d.err
+}
+
+type publishPacket struct {
+	dup      bool
+	qos      byte
+	retain   bool
+	topic    string
+	packetID uint16
+	payload  []byte
+}
+
+func decodePublish(p *packet) (*publishPacket, error) {
+	d := &decoder{buf: p.body}
+	pub := &publishPacket{
+		dup:    p.flags&0x08 != 0,
+		qos:    (p.flags >> 1) & 0x03,
+		retain: p.flags&0x01 != 0,
+	}
+	pub.topic = d.string()
+	if pub.qos > 0 {
+		pub.packetID = d.uint16()
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	pub.payload = d.buf
+	return pub, nil
+}
+
+func (pub *publishPacket) encode() []byte {
+	var flags byte
+	if pub.dup {
+		flags |= 0x08
+	}
+	flags |= pub.qos << 1
+	if pub.retain {
+		flags |= 0x01
+	}
+	body := appendString(nil, pub.topic)
+	if pub.qos > 0 {
+		body = appendUint16(body, pub.packetID)
+	}
+	body = append(body, pub.payload...)
+	return encodePacket(typePublish, flags, body)
+}
+
+type topicFilter struct {
+	filter string
+	qos    byte
+}
+
+// decodeSubscribe decodes SUBSCRIBE, and UNSUBSCRIBE when withQoS is false
+func decodeSubscribe(p *packet, withQoS bool) (uint16, []topicFilter, error) {
+	d := &decoder{buf: p.body}
+	packetID := d.uint16()
+	var filters []topicFilter
+	for d.err == nil && len(d.buf) > 0 {
+		f := topicFilter{filter: d.string()}
+		if withQoS {
+			f.qos = d.byte()
+		}
+		filters = append(filters, f)
+	}
+	if d.err == nil && len(filters) == 0 {
+		d.err = errMalformed
+	}
+	return packetID, filters, d.err
+}
+
+func encodeAck(typ byte, packetID uint16) []byte {
+	return encodePacket(typ, 0, appendUint16(nil, packetID))
+}
+
+func encodeConnack(sessionPresent bool, code byte) []byte {
+	var sp byte
+	if sessionPresent {
+		sp = 1
+	}
+	return encodePacket(typeConnack, 0, []byte{sp, code})
+}
+
+func encodeSuback(packetID uint16, codes []byte) []byte {
+	body := appendUint16(nil, packetID)
+	return encodePacket(typeSuback, 0, append(body, codes...))
+}
@@ -0,0 +1,140 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestReadPacket(t *testing.T) {
+	// a remaining length of 200 takes two bytes
+	body := bytes.Repeat([]byte{1}, 200)
+	b := encodePacket(typePublish, 0x02, body)
+	if !bytes.Equal(b[:3], []byte{typePublish<<4 | 0x02, 0xc8, 0x01}) {
+		t.Fatalf("got header %x", b[:3])
+	}
+	p, err := readPacket(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.typ != typePublish || p.flags != 0x02 || !bytes.Equal(p.body, body) {
+		t.Fatalf("got type %d flags %x and %d bytes", p.typ, p.flags, len(p.body))
+	}
+
+	for name, b := range map[string][]byte{
+		"length over 4 bytes": {typePublish << 4, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"too large":           {typePublish << 4, 0xff, 0xff, 0xff, 0x7f},
+	} {
+		if _, err := readPacket(bufio.NewReader(bytes.NewReader(b))); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+	if _, err := readPacket(bufio.NewReader(bytes.NewReader([]byte{typePublish << 4, 5, 1}))); err == nil {
+		t.Error("truncated body: no error")
+	}
+}
+
+func TestDecodeConnect(t *testing.T) {
+	body := appendString(nil, "MQTT")
+	// clean session, will, username and password
+	body = append(body, 4, 0x02|0x04|0x80|0x40)
+	body = appendUint16(body, 30)
+	body = appendString(body, "client")
+	body = appendString(body, "will/topic")
+	body = appendString(body, "will message")
+	body = appendString(body, "user")
+	body = appendString(body, "secret")
+	c, err := decodeConnect(&packet{typ: typeConnect, body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.protocol != "MQTT" || c.level != 4 || !c.cleanSession || c.keepAlive != 30 ||
+		c.clientID != "client" || c.username != "user" || string(c.password) != "secret" {
+		t.Fatalf("got %+v", c)
+	}
+	if _, err := decodeConnect(&packet{typ: typeConnect, body: body[:len(body)-3]}); err != errMalformed {
+		t.Fatalf("truncated CONNECT: got %v", err)
+	}
+}
+
+func TestPublishRoundTrip(t *testing.T) {
+	for _, pub := range []*publishPacket{
+		{qos: 0, topic: "a/b", payload: []byte("hello")},
+		{qos: 1, dup: true, retain: true, topic: "a", packetID: 42, payload: []byte{}},
+	} {
+		p, err := readPacket(bufio.NewReader(bytes.NewReader(pub.encode())))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decodePublish(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.qos != pub.qos || got.dup != pub.dup || got.retain != pub.retain || got.topic != pub.topic ||
+			got.packetID != pub.packetID || !bytes.Equal(got.payload, pub.payload) {
+			t.Errorf("got %+v, want %+v", got, pub)
+		}
+	}
+}
+
+func TestDecodeSubscribe(t *testing.T) {
+	body := appendUint16(nil, 9)
+	body = appendString(body, "a/+")
+	body = append(body, 1)
+	body = appendString(body, "b/#")
+	body = append(body, 0)
+	pid, filters, err := decodeSubscribe(&packet{typ: typeSubscribe, body: body}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid != 9 || len(filters) != 2 || filters[0] != (topicFilter{"a/+", 1}) || filters[1] != (topicFilter{"b/#", 0}) {
+		t.Fatalf("got %d %v", pid, filters)
+	}
+	// a SUBSCRIBE needs at least one filter
+	if _, _, err := decodeSubscribe(&packet{typ: typeSubscribe, body: appendUint16(nil, 9)}, true); err != errMalformed {
+		t.Fatalf("no filter: got %v", err)
+	}
+}
+
+func TestTopicFilters(t *testing.T) {
+	for filter, valid := range map[string]bool{
+		"a": true, "a/b": true, "+": true, "#": true, "a/+/c": true, "a/#": true, "+/+": true,
+		"": false, "a#": false, "a/#/c": false, "a+": false, "a/b+/c": false,
+	} {
+		if validTopicFilter(filter) != valid {
+			t.Errorf("%q: valid is %v, want %v", filter, !valid, valid)
+		}
+	}
+	for _, c := range []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"+/b", "a/b", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b", true},
+		{"a/b/c", "a/b", false},
+	} {
+		if matchTopic(c.filter, c.topic) != c.match {
+			t.Errorf("%q against %q: got %v", c.filter, c.topic, !c.match)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mqtt is an embedded MQTT 3.1.1 broker backed by tipubsub streams.
+//
+// A topic is the name of a stream, filters with +/# wildcards are resolved
+// against the existing stream names when subscribing. QoS 1 publishes are
+// acknowledged after they are committed to the store, inbound QoS 2 is not
+// supported. Sessions with CleanSession=0 resume their QoS 1 subscriptions
+// from the durable offset named after the client id. The topic filters of
+// such a session are only kept in the memory of the server, a client
+// reconnecting after a restart or to another server subscribes again.
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/c4pt0r/log"
+	"github.com/c4pt0r/tipubsub"
+)
+
+// hub is the part of *tipubsub.Hub the broker uses
+type hub interface {
+	Publish(streamName string, msg *tipubsub.Message) error
+	PublishSync(streamName string, msgs ...*tipubsub.Message) error
+	SubscribeFrom(streamName string, subscriberID string, offset tipubsub.Offset) (<-chan tipubsub.Message, error)
+	Unsubscribe(streamName string, subscriberID string)
+	CommitOffset(streamName string, consumerID string, offset tipubsub.Offset) error
+	CommittedOffset(streamName string, consumerID string) (tipubsub.Offset, error)
+	GetStreamNames() ([]string, error)
+}
+
+type Server struct {
+	hub hub
+
+	mu sync.Mutex
+	// clientID -> connected session
+	conns map[string]*session
+	// clientID -> subscriptions kept for persistent sessions
+	persisted map[string]map[string]byte
+}
+
+func NewServer(h *tipubsub.Hub) *Server {
+	return newServer(h)
+}
+
+func newServer(h hub) *Server {
+	return &Server{
+		hub:       h,
+		conns:     map[string]*session{},
+		persisted: map[string]map[string]byte{},
+	}
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Info("mqtt: listening on", addr)
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l, tests can pass an in-process listener.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a single client connection until it is closed.
+func (s *Server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	p, err := readPacket(r)
+	if err != nil {
+		return
+	}
+	if p.typ != typeConnect {
+		log.Warn("mqtt: first packet is not CONNECT from", conn.RemoteAddr())
+		return
+	}
+	c, err := decodeConnect(p)
+	if err != nil {
+		return
+	}
+	if c.protocol != "MQTT" || c.level != 4 {
+		conn.Write(encodeConnack(false, connRefusedProtocol))
+		return
+	}
+	if c.clientID == "" && !c.cleanSession {
+		conn.Write(encodeConnack(false, connRefusedIdentifier))
+		return
+	}
+	sess := newSession(s, conn, c)
+	filters, present := s.attach(sess)
+	if _, err := conn.Write(encodeConnack(present, connAccepted)); err != nil {
+		s.detach(sess)
+		return
+	}
+	log.I("mqtt: client connected", sess.clientID, "clean:", sess.clean)
+	for filter, qos := range filters {
+		sess.subscribe(filter, qos)
+	}
+	err = sess.serve(r)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		log.Error("mqtt:", sess.clientID, err)
+	}
+	s.detach(sess)
+	log.I("mqtt: client disconnected", sess.clientID)
+}
+
+// attach registers a session, taking over a connection with the same client
+// id, and returns the subscriptions to restore
+func (s *Server) attach(sess *session) (map[string]byte, bool) {
+	s.mu.Lock()
+	old := s.conns[sess.clientID]
+	s.conns[sess.clientID] = sess
+	filters, present := s.persisted[sess.clientID]
+	if sess.clean {
+		delete(s.persisted, sess.clientID)
+		filters, present = nil, false
+	}
+	s.mu.Unlock()
+	if old != nil {
+		old.close()
+	}
+	return filters, present
+}
+
+func (s *Server) detach(sess *session) {
+	filters := sess.close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// a session taken over by a new connection leaves the state to it
+	if s.conns[sess.clientID] != sess {
+		return
+	}
+	delete(s.conns, sess.clientID)
+	if !sess.clean {
+		s.persisted[sess.clientID] = filters
+	}
+}
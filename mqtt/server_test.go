@@ -0,0 +1,264 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c4pt0r/tipubsub"
+)
+
+// fakeHub keeps the streams in memory
+type fakeHub struct {
+	mu      sync.Mutex
+	streams map[string][]tipubsub.Message
+	// stream name + "/" + subscriber id -> channel
+	subs    map[string]chan tipubsub.Message
+	offsets map[string]tipubsub.Offset
+	// the offset of the last SubscribeFrom of a subscriber
+	from map[string]tipubsub.Offset
+}
+
+func newFakeHub(names ...string) *fakeHub {
+	h := &fakeHub{
+		streams: map[string][]tipubsub.Message{},
+		subs:    map[string]chan tipubsub.Message{},
+		offsets: map[string]tipubsub.Offset{},
+		from:    map[string]tipubsub.Offset{},
+	}
+	for _, name := range names {
+		h.streams[name] = nil
+	}
+	return h
+}
+
+func (h *fakeHub) Publish(streamName string, msg *tipubsub.Message) error {
+	return h.PublishSync(streamName, msg)
+}
+
+func (h *fakeHub) PublishSync(streamName string, msgs ...*tipubsub.Message) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, msg := range msgs {
+		msg.ID = int64(len(h.streams[streamName]) + 1)
+		h.streams[streamName] = append(h.streams[streamName], *msg)
+		for key, ch := range h.subs {
+			if strings.HasPrefix(key, streamName+"/") {
+				ch <- *msg
+			}
+		}
+	}
+	return nil
+}
+
+func (h *fakeHub) SubscribeFrom(streamName string, subscriberID string, offset tipubsub.Offset) (<-chan tipubsub.Message, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan tipubsub.Message, 16)
+	if offset != tipubsub.LatestId {
+		for _, msg := range h.streams[streamName] {
+			if msg.ID > int64(offset) {
+				ch <- msg
+			}
+		}
+	}
+	h.subs[streamName+"/"+subscriberID] = ch
+	h.from[subscriberID] = offset
+	return ch, nil
+}
+
+func (h *fakeHub) Unsubscribe(streamName string, subscriberID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ch, ok := h.subs[streamName+"/"+subscriberID]; ok {
+		close(ch)
+		delete(h.subs, streamName+"/"+subscriberID)
+	}
+}
+
+func (h *fakeHub) CommitOffset(streamName string, consumerID string, offset tipubsub.Offset) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.offsets[streamName+"/"+consumerID] = offset
+	return nil
+}
+
+func (h *fakeHub) CommittedOffset(streamName string, consumerID string) (tipubsub.Offset, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.offsets[streamName+"/"+consumerID], nil
+}
+
+func (h *fakeHub) GetStreamNames() ([]string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var names []string
+	for name := range h.streams {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, addr string, clientID string, clean bool) (*testClient, *packet) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &testClient{t, conn, bufio.NewReader(conn)}
+	var flags byte
+	if clean {
+		flags = 0x02
+	}
+	body := appendString(nil, "MQTT")
+	body = append(body, 4, flags)
+	body = appendUint16(body, 0)
+	body = appendString(body, clientID)
+	c.send(encodePacket(typeConnect, 0, body))
+	return c, c.expect(typeConnack)
+}
+
+func (c *testClient) send(b []byte) {
+	if _, err := c.conn.Write(b); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) read() *packet {
+	p, err := readPacket(c.r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return p
+}
+
+func (c *testClient) expect(typ byte) *packet {
+	p := c.read()
+	if p.typ != typ {
+		c.t.Fatalf("got packet type %d, want %d", p.typ, typ)
+	}
+	return p
+}
+
+func (c *testClient) subscribe(pid uint16, filter string, qos byte) []byte {
+	body := appendUint16(nil, pid)
+	body = appendString(body, filter)
+	body = append(body, qos)
+	c.send(encodePacket(typeSubscribe, 0x02, body))
+	p := c.expect(typeSuback)
+	d := &decoder{buf: p.body}
+	if got := d.uint16(); got != pid {
+		c.t.Fatalf("SUBACK of packet %d, want %d", got, pid)
+	}
+	return d.buf
+}
+
+func TestServer(t *testing.T) {
+	h := newFakeHub("s/a", "t")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go newServer(h).Serve(l)
+
+	c, connack := dial(t, l.Addr().String(), "c1", false)
+	if connack.body[0] != 0 || connack.body[1] != connAccepted {
+		t.Fatalf("got CONNACK %v", connack.body)
+	}
+	if codes := c.subscribe(1, "s/+", 1); len(codes) != 1 || codes[0] != 1 {
+		t.Fatalf("got SUBACK codes %v", codes)
+	}
+	if codes := c.subscribe(2, "s/#/x", 0); len(codes) != 1 || codes[0] != subackFailure {
+		t.Fatalf("got SUBACK codes %v for an invalid filter", codes)
+	}
+
+	c.send((&publishPacket{qos: 1, topic: "s/a", packetID: 7, payload: []byte("hi")}).encode())
+	// the PUBACK and the delivered message may come in any order
+	var delivered *publishPacket
+	var acked bool
+	for !acked || delivered == nil {
+		p := c.read()
+		switch p.typ {
+		case typePuback:
+			if pid := (&decoder{buf: p.body}).uint16(); pid != 7 {
+				t.Fatalf("PUBACK of packet %d, want 7", pid)
+			}
+			acked = true
+		case typePublish:
+			if delivered, err = decodePublish(p); err != nil {
+				t.Fatal(err)
+			}
+		default:
+			t.Fatalf("unexpected packet type %d", p.typ)
+		}
+	}
+	if delivered.topic != "s/a" || string(delivered.payload) != "hi" || delivered.qos != 1 {
+		t.Fatalf("got %s %q QoS %d", delivered.topic, delivered.payload, delivered.qos)
+	}
+	c.send(encodeAck(typePuback, delivered.packetID))
+	c.send(encodePacket(typePingreq, 0, nil))
+	c.expect(typePingresp)
+	if o, _ := h.CommittedOffset("s/a", "c1"); o != 1 {
+		t.Fatalf("committed offset %d, want 1", o)
+	}
+	c.send(encodePacket(typeDisconnect, 0, nil))
+	c.conn.Close()
+
+	// the persistent session resumes its subscription after the commit
+	h.PublishSync("s/a", &tipubsub.Message{Data: "while away"})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		h.mu.Lock()
+		n := len(h.subs)
+		h.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the session was not detached")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c, connack = dial(t, l.Addr().String(), "c1", false)
+	defer c.conn.Close()
+	if connack.body[0] != 1 {
+		t.Fatal("session not present after reconnecting")
+	}
+	p, err := decodePublish(c.expect(typePublish))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p.payload) != "while away" {
+		t.Fatalf("got %q after reconnecting", p.payload)
+	}
+	h.mu.Lock()
+	from := h.from["c1"]
+	h.mu.Unlock()
+	if from != 1 {
+		t.Fatalf("resumed from %d, want 1", from)
+	}
+}
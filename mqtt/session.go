@@ -0,0 +1,352 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/c4pt0r/log"
+	"github.com/c4pt0r/tipubsub"
+)
+
+var anonymousSeq int64
+
+type inflight struct {
+	streamName string
+	id         int64
+}
+
+type session struct {
+	srv       *Server
+	conn      net.Conn
+	clientID  string
+	clean     bool
+	keepAlive time.Duration
+
+	writeMu sync.Mutex
+
+	mu     sync.Mutex
+	closed bool
+	// topic filter -> granted qos
+	filters map[string]byte
+	// stream name -> granted qos of the hub subscriptions
+	streams  map[string]byte
+	nextPID  uint16
+	inflight map[uint16]inflight
+	// stream name -> ids waiting for PUBACK in delivery order
+	unacked map[string][]int64
+}
+
+func newSession(srv *Server, conn net.Conn, c *connectPacket) *session {
+	clientID := c.clientID
+	if clientID == "" {
+		clientID = fmt.Sprintf("mqtt-anonymous-%d", atomic.AddInt64(&anonymousSeq, 1))
+	}
+	return &session{
+		srv:       srv,
+		conn:      conn,
+		clientID:  clientID,
+		clean:     c.cleanSession,
+		keepAlive: time.Duration(c.keepAlive) * time.Second,
+		filters:   map[string]byte{},
+		streams:   map[string]byte{},
+		inflight:  map[uint16]inflight{},
+		unacked:   map[string][]int64{},
+	}
+}
+
+func (sess *session) write(b []byte) error {
+	sess.writeMu.Lock()
+	defer sess.writeMu.Unlock()
+	_, err := sess.conn.Write(b)
+	return err
+}
+
+func (sess *session) serve(r *bufio.Reader) error {
+	for {
+		if sess.keepAlive > 0 {
+			// the spec allows one and a half keep alive periods
+			sess.conn.SetReadDeadline(time.Now().Add(sess.keepAlive * 3 / 2))
+		}
+		p, err := readPacket(r)
+		if err != nil {
+			return err
+		}
+		switch p.typ {
+		case typePublish:
+			err = sess.handlePublish(p)
+		case typePuback:
+			err = sess.handlePuback(p)
+		case typeSubscribe:
+			err = sess.handleSubscribe(p)
+		case typeUnsubscribe:
+			err = sess.handleUnsubscribe(p)
+		case typePingreq:
+			err = sess.write(encodePacket(typePingresp, 0, nil))
+		case typeDisconnect:
+			return nil
+		default:
+			err = fmt.Errorf("mqtt: unexpected packet type %d", p.typ)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (sess *session) handlePublish(p *packet) error {
+	pub, err := decodePublish(p)
+	if err != nil {
+		return err
+	}
+	if hasWildcard(pub.topic) || pub.topic == "" {
+		return fmt.Errorf("mqtt: invalid topic name %q", pub.topic)
+	}
+	msg := &tipubsub.Message{Data: string(pub.payload)}
+	switch pub.qos {
+	case 0:
+		// QoS 0 may lose messages, drop it instead of the connection
+		if err := sess.srv.hub.Publish(pub.topic, msg); err != tipubsub.ErrQueueFull {
+			return err
+		}
+		log.Warn("mqtt: queue full, dropped QoS 0 message of", sess.clientID, "to", pub.topic)
+		return nil
+	case 1:
+		// only acknowledge after the message is committed
+		if err := sess.srv.hub.PublishSync(pub.topic, msg); err != nil {
+			return err
+		}
+		return sess.write(encodeAck(typePuback, pub.packetID))
+	}
+	return fmt.Errorf("mqtt: QoS %d publish is not supported", pub.qos)
+}
+
+func (sess *session) handlePuback(p *packet) error {
+	d := &decoder{buf: p.body}
+	pid := d.uint16()
+	if d.err != nil {
+		return d.err
+	}
+	sess.mu.Lock()
+	in, ok := sess.inflight[pid]
+	if !ok {
+		sess.mu.Unlock()
+		return nil
+	}
+	delete(sess.inflight, pid)
+	// the durable offset only moves past messages that are all acknowledged
+	ids := sess.unacked[in.streamName]
+	for i, id := range ids {
+		if id == in.id {
+			ids = append(ids[:i], ids[i+1:]...)
+			break
+		}
+	}
+	sess.unacked[in.streamName] = ids
+	commit := in.id
+	if len(ids) > 0 {
+		commit = ids[0] - 1
+	}
+	sess.mu.Unlock()
+	if sess.clean {
+		return nil
+	}
+	return sess.srv.hub.CommitOffset(in.streamName, sess.clientID, tipubsub.Offset(commit))
+}
+
+func (sess *session) handleSubscribe(p *packet) error {
+	pid, filters, err := decodeSubscribe(p, true)
+	if err != nil {
+		return err
+	}
+	codes := make([]byte, len(filters))
+	for i, f := range filters {
+		if !validTopicFilter(f.filter) || f.qos > 2 {
+			codes[i] = subackFailure
+			continue
+		}
+		qos := f.qos
+		if qos > 1 {
+			qos = 1
+		}
+		if err := sess.subscribe(f.filter, qos); err != nil {
+			log.Error("mqtt:", sess.clientID, err)
+			codes[i] = subackFailure
+			continue
+		}
+		codes[i] = qos
+	}
+	return sess.write(encodeSuback(pid, codes))
+}
+
+func (sess *session) handleUnsubscribe(p *packet) error {
+	pid, filters, err := decodeSubscribe(p, false)
+	if err != nil {
+		return err
+	}
+	sess.mu.Lock()
+	for _, f := range filters {
+		delete(sess.filters, f.filter)
+	}
+	sess.mu.Unlock()
+	sess.resolveStreams()
+	return sess.write(encodeAck(typeUnsuback, pid))
+}
+
+func (sess *session) subscribe(filter string, qos byte) error {
+	sess.mu.Lock()
+	sess.filters[filter] = qos
+	sess.mu.Unlock()
+	return sess.resolveStreams()
+}
+
+// resolveStreams maps the topic filters to stream names, then attaches to
+// new streams and detaches from the ones no filter matches anymore
+func (sess *session) resolveStreams() error {
+	names, err := sess.srv.hub.GetStreamNames()
+	if err != nil {
+		return err
+	}
+	sess.mu.Lock()
+	if sess.closed {
+		sess.mu.Unlock()
+		return nil
+	}
+	want := map[string]byte{}
+	for filter, qos := range sess.filters {
+		if !hasWildcard(filter) {
+			want[filter] = maxQoS(want[filter], qos)
+			continue
+		}
+		for _, name := range names {
+			if matchTopic(filter, name) {
+				want[name] = maxQoS(want[name], qos)
+			}
+		}
+	}
+	var added, removed []string
+	for name, qos := range want {
+		if _, ok := sess.streams[name]; !ok {
+			added = append(added, name)
+		}
+		sess.streams[name] = qos
+	}
+	for name := range sess.streams {
+		if _, ok := want[name]; !ok {
+			removed = append(removed, name)
+			delete(sess.streams, name)
+		}
+	}
+	sess.mu.Unlock()
+
+	sort.Strings(added)
+	for _, name := range removed {
+		sess.srv.hub.Unsubscribe(name, sess.clientID)
+	}
+	for _, name := range added {
+		if err := sess.attachStream(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sess *session) attachStream(streamName string) error {
+	offset := tipubsub.LatestId
+	if !sess.clean {
+		o, err := sess.srv.hub.CommittedOffset(streamName, sess.clientID)
+		if err != nil {
+			return err
+		}
+		offset = o
+	}
+	ch, err := sess.srv.hub.SubscribeFrom(streamName, sess.clientID, offset)
+	if err != nil {
+		return err
+	}
+	go sess.forward(streamName, ch)
+	return nil
+}
+
+// forward sends the messages of a stream to the client until the hub
+// subscription is closed. If the hub dropped a client too slow for it, the
+// connection is closed so the client reconnects and resumes.
+func (sess *session) forward(streamName string, ch <-chan tipubsub.Message) {
+	defer func() {
+		sess.mu.Lock()
+		_, attached := sess.streams[streamName]
+		dropped := attached && !sess.closed
+		sess.mu.Unlock()
+		if dropped {
+			sess.conn.Close()
+		}
+	}()
+	for msg := range ch {
+		sess.mu.Lock()
+		qos := sess.streams[streamName]
+		pub := &publishPacket{
+			qos:     qos,
+			topic:   streamName,
+			payload: []byte(msg.Data),
+		}
+		if qos > 0 {
+			sess.nextPID++
+			if sess.nextPID == 0 {
+				sess.nextPID = 1
+			}
+			pub.packetID = sess.nextPID
+			sess.inflight[pub.packetID] = inflight{streamName, msg.ID}
+			sess.unacked[streamName] = append(sess.unacked[streamName], msg.ID)
+		}
+		sess.mu.Unlock()
+		if err := sess.write(pub.encode()); err != nil {
+			sess.conn.Close()
+			return
+		}
+	}
+}
+
+// close detaches the session from the hub and returns its topic filters
+func (sess *session) close() map[string]byte {
+	sess.mu.Lock()
+	if sess.closed {
+		sess.mu.Unlock()
+		return sess.filters
+	}
+	sess.closed = true
+	streams := make([]string, 0, len(sess.streams))
+	for name := range sess.streams {
+		streams = append(streams, name)
+	}
+	sess.mu.Unlock()
+	for _, name := range streams {
+		sess.srv.hub.Unsubscribe(name, sess.clientID)
+	}
+	sess.conn.Close()
+	return sess.filters
+}
+
+func maxQoS(a, b byte) byte {
+	if a > b {
+		return a
+	}
+	return b
+}
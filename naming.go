@@ -0,0 +1,89 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	streamTblPrefix = "tipubsub_stream_"
+	// MaxStreamNameLen is the size of the stream_name column of tipubsub_meta
+	MaxStreamNameLen = 255
+	// maxIdentLen is the max length of a table name in TiDB
+	maxIdentLen = 64
+)
+
+var (
+	// stream names are letters, digits and _ . - : / not starting with a
+	// separator, e.g. orders.eu-west or sensors/room1
+	streamNameRe = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.:/-]*$`)
+	// names which are valid table name suffixes as they are
+	plainStreamNameRe = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+	unsafeIdentCharRe = regexp.MustCompile(`[^A-Za-z0-9_]`)
+)
+
+// InvalidStreamNameError is returned for stream names violating the naming policy
+type InvalidStreamNameError struct {
+	Name   string
+	Reason string
+}
+
+func (e *InvalidStreamNameError) Error() string {
+	return fmt.Sprintf("invalid stream name %q: %s", e.Name, e.Reason)
+}
+
+// ValidateStreamName checks a stream name against the naming policy: 1 to
+// 255 letters, digits, '_', '.', '-', ':' or '/', starting with a letter,
+// digit or '_'.
+func ValidateStreamName(name string) error {
+	if name == "" {
+		return &InvalidStreamNameError{name, "empty name"}
+	}
+	if len(name) > MaxStreamNameLen {
+		return &InvalidStreamNameError{name, fmt.Sprintf("longer than %d bytes", MaxStreamNameLen)}
+	}
+	if !streamNameRe.MatchString(name) {
+		return &InvalidStreamNameError{name, "only letters, digits, '_', '.', '-', ':' and '/' are allowed, starting with a letter, digit or '_'"}
+	}
+	return nil
+}
+
+// getStreamTblName maps a stream name to the name of the table it is
+// created with, which is recorded in tipubsub_meta. Plain names keep the
+// tipubsub_stream_<name> layout, other names are sanitized and suffixed by
+// a hash so different names never share a table.
+func getStreamTblName(streamName string) string {
+	if plainStreamNameRe.MatchString(streamName) && len(streamTblPrefix)+len(streamName) <= maxIdentLen {
+		return streamTblPrefix + streamName
+	}
+	sum := sha1.Sum([]byte(streamName))
+	hash := hex.EncodeToString(sum[:])[:16]
+	safe := unsafeIdentCharRe.ReplaceAllString(streamName, "_")
+	// prefix + safe + "_" + hash fits in an identifier
+	if maxLen := maxIdentLen - len(streamTblPrefix) - 1 - len(hash); len(safe) > maxLen {
+		safe = safe[:maxLen]
+	}
+	return streamTblPrefix + safe + "_" + hash
+}
+
+// quoteIdent quotes a SQL identifier
+func quoteIdent(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
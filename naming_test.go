@@ -0,0 +1,64 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateStreamName(t *testing.T) {
+	for _, name := range []string{"a", "orders", "orders.eu-west", "sensors/room1", "_x:1", strings.Repeat("a", MaxStreamNameLen)} {
+		if err := ValidateStreamName(name); err != nil {
+			t.Errorf("%q: %v", name, err)
+		}
+	}
+	for _, name := range []string{"", ".a", "-a", "/a", "a b", "a'b", "a`b", strings.Repeat("a", MaxStreamNameLen+1)} {
+		var invalid *InvalidStreamNameError
+		if err := ValidateStreamName(name); !errors.As(err, &invalid) {
+			t.Errorf("%q: got %v, want an InvalidStreamNameError", name, err)
+		}
+	}
+}
+
+func TestGetStreamTblName(t *testing.T) {
+	if got := getStreamTblName("orders"); got != "tipubsub_stream_orders" {
+		t.Errorf("plain name mapped to %s", got)
+	}
+	seen := map[string]string{}
+	for _, name := range []string{"orders.eu", "orders-eu", "orders_eu", "orders/eu", strings.Repeat("x", 200), strings.Repeat("x", 201)} {
+		tbl := getStreamTblName(name)
+		if len(tbl) > maxIdentLen {
+			t.Errorf("%q mapped to %s, longer than %d", name, tbl, maxIdentLen)
+		}
+		if unsafeIdentCharRe.MatchString(tbl) {
+			t.Errorf("%q mapped to %s, not a plain identifier", name, tbl)
+		}
+		if tbl != getStreamTblName(name) {
+			t.Errorf("%q mapped to different tables", name)
+		}
+		if other, ok := seen[tbl]; ok {
+			t.Errorf("%q and %q share the table %s", name, other, tbl)
+		}
+		seen[tbl] = name
+	}
+}
+
+func TestQuoteIdent(t *testing.T) {
+	if got := quoteIdent("a`b"); got != "`a``b`" {
+		t.Errorf("got %s", got)
+	}
+}
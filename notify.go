@@ -0,0 +1,189 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/c4pt0r/log"
+)
+
+// The poll worker of a stream is woken as soon as the stream is written,
+// so it can wait IdlePollIntervalInMs between polls instead of
+// PollIntervalInMs. Writes of this hub wake it directly, writes of other
+// hubs are seen in tipubsub_watermarks, the last id of every stream read
+// in a single query, or are told by the writer over UDP. Watermarks are
+// moved after the write commits, not in its transaction, so the writers
+// of a stream do not conflict on its row for the whole transaction.
+
+// maxNotifySize is the largest notification datagram, a stream name
+const maxNotifySize = 512
+
+func (s *TiDBStore) BumpWatermark(streamName string, maxID int64) error {
+	stmt, err := s.cachedStmt(insertStmtKey{"tipubsub_watermarks", 0}, func() string {
+		return `
+			INSERT INTO tipubsub_watermarks (stream_name, max_id) VALUES (?, ?)
+			ON DUPLICATE KEY UPDATE max_id = GREATEST(max_id, VALUES(max_id))`
+	})
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(streamName, maxID)
+	return err
+}
+
+// maxMessageID is the last id of msgs, 0 if they are all delayed
+func maxMessageID(msgs []*Message) int64 {
+	var maxID int64
+	for _, msg := range msgs {
+		if msg.ID > maxID {
+			maxID = msg.ID
+		}
+	}
+	return maxID
+}
+
+func (s *TiDBStore) GetWatermarks() (map[string]int64, error) {
+	rows, err := s.db.Query(`SELECT stream_name, max_id FROM tipubsub_watermarks`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	marks := map[string]int64{}
+	for rows.Next() {
+		var name string
+		var maxID int64
+		if err := rows.Scan(&name, &maxID); err != nil {
+			return nil, err
+		}
+		marks[name] = maxID
+	}
+	return marks, rows.Err()
+}
+
+// notifier sends and receives the UDP notifications of written streams
+type notifier struct {
+	conn  *net.UDPConn
+	peers []*net.UDPAddr
+}
+
+func newNotifier(cfg *Config) (*notifier, error) {
+	n := &notifier{}
+	for _, peer := range cfg.NotifyPeers {
+		if peer = strings.TrimSpace(peer); peer == "" {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			return nil, err
+		}
+		n.peers = append(n.peers, addr)
+	}
+	if cfg.NotifyAddr == "" && len(n.peers) == 0 {
+		return n, nil
+	}
+	// without NotifyAddr the socket is only used to send
+	var laddr *net.UDPAddr
+	if cfg.NotifyAddr != "" {
+		var err error
+		if laddr, err = net.ResolveUDPAddr("udp", cfg.NotifyAddr); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	n.conn = conn
+	return n, nil
+}
+
+// send tells the peers that a stream was written, best effort
+func (n *notifier) send(streamName string) {
+	for _, peer := range n.peers {
+		if _, err := n.conn.WriteToUDP([]byte(streamName), peer); err != nil {
+			log.D("notify", peer, err)
+		}
+	}
+}
+
+// streamWritten is called after msgs are committed to a stream by this
+// hub, it wakes the poll worker of the stream, moves its watermark and
+// tells the peer hubs
+func (m *Hub) streamWritten(streamName string, msgs []*Message) {
+	maxID := maxMessageID(msgs)
+	if maxID == 0 {
+		return
+	}
+	m.wakePollWorker(streamName)
+	if m.cfg.WatermarkIntervalInMs > 0 {
+		if err := m.store.BumpWatermark(streamName, maxID); err != nil {
+			log.Error("watermark of", streamName, err)
+		}
+	}
+	m.notifier.send(streamName)
+}
+
+func (m *Hub) wakePollWorker(streamName string) {
+	m.mu.RLock()
+	pw := m.pollWorkers[streamName]
+	m.mu.RUnlock()
+	if pw != nil {
+		pw.wake()
+	}
+}
+
+// receiveNotifications wakes the poll workers of the streams written by
+// the peer hubs
+func (m *Hub) receiveNotifications() {
+	buf := make([]byte, maxNotifySize)
+	for {
+		n, _, err := m.notifier.conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Error("notify:", err)
+			return
+		}
+		m.wakePollWorker(string(buf[:n]))
+	}
+}
+
+// watchWatermarks wakes the poll workers of the streams whose watermark
+// moved since the last check
+func (m *Hub) watchWatermarks() {
+	interval := time.Duration(m.cfg.WatermarkIntervalInMs) * time.Millisecond
+	last := map[string]int64{}
+	for {
+		time.Sleep(interval)
+		m.mu.RLock()
+		idle := len(m.pollWorkers) == 0
+		m.mu.RUnlock()
+		if idle {
+			continue
+		}
+		marks, err := m.store.GetWatermarks()
+		if err != nil {
+			log.Error("watch watermarks:", err)
+			continue
+		}
+		for name, maxID := range marks {
+			if last[name] != maxID {
+				last[name] = maxID
+				m.wakePollWorker(name)
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaxMessageID(t *testing.T) {
+	if got := maxMessageID(nil); got != 0 {
+		t.Errorf("got %d for no message", got)
+	}
+	// delayed messages have no id yet
+	msgs := []*Message{{ID: 3}, {ID: 0}, {ID: 7}, {ID: 5}}
+	if got := maxMessageID(msgs); got != 7 {
+		t.Errorf("got %d, want 7", got)
+	}
+}
+
+func TestStreamWrittenBumpsWatermark(t *testing.T) {
+	store := newFakeStore()
+	notifier, err := newNotifier(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := newFakeHub(&Config{WatermarkIntervalInMs: 100}, store)
+	hub.notifier = notifier
+	hub.streamWritten("s", []*Message{{ID: 4}, {ID: 2}})
+	// only delayed messages, nothing was appended
+	hub.streamWritten("t", []*Message{{ID: 0}})
+	if store.watermarks["s"] != 4 {
+		t.Errorf("watermark of s is %d, want 4", store.watermarks["s"])
+	}
+	if _, ok := store.watermarks["t"]; ok {
+		t.Error("watermark of t moved without a written message")
+	}
+
+	// without watermarks nothing is written to the store
+	hub = newFakeHub(&Config{}, store)
+	hub.notifier = notifier
+	hub.streamWritten("u", []*Message{{ID: 1}})
+	if _, ok := store.watermarks["u"]; ok {
+		t.Error("watermark moved with WatermarkIntervalInMs 0")
+	}
+}
+
+func TestNotificationWakesPollWorker(t *testing.T) {
+	store := newFakeStore()
+	// the receiving hub polls too rarely for the test to pass without
+	// the notification
+	cfg := &Config{MaxBatchSize: 10, PollIntervalInMs: 60000, NotifyAddr: "127.0.0.1:0"}
+	receiver, err := newNotifier(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.conn.Close()
+	hub := newFakeHub(cfg, store)
+	hub.notifier = receiver
+	go hub.receiveNotifications()
+	ch, err := hub.Subscribe("s", "sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.pollWorkers["s"].close()
+	// let the first poll run, the worker then waits
+	time.Sleep(50 * time.Millisecond)
+
+	sender, err := newNotifier(&Config{NotifyPeers: []string{receiver.conn.LocalAddr().String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.conn.Close()
+	writer := newFakeHub(&Config{}, store)
+	writer.notifier = sender
+	store.put("s", "a")
+	writer.streamWritten("s", []*Message{{ID: 1}})
+	select {
+	case msg := <-ch:
+		if msg.Data != "a" {
+			t.Fatalf("got %q", msg.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the notification did not wake the poll worker")
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c4pt0r/log"
+)
+
+// IsStreamPattern tells if name is a stream name pattern rather than a name
+func IsStreamPattern(name string) bool {
+	return strings.ContainsAny(name, "*?")
+}
+
+// compileStreamPattern turns a pattern into a regexp: * matches anything
+// but a '.', ** anything and ? one character but a '.'
+func compileStreamPattern(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case pattern[i] == '*':
+			b.WriteString(`[^.]*`)
+		case pattern[i] == '?':
+			b.WriteString(`[^.]`)
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// patternSubscription merges the subscriptions to all the streams
+// matching a pattern, new streams are attached by Hub.watchStreams
+type patternSubscription struct {
+	hub          *Hub
+	pattern      *regexp.Regexp
+	subscriberID string
+	filter       *Filter
+	ch           chan Message
+	done         chan struct{}
+	wg           sync.WaitGroup
+
+	mu sync.Mutex
+	// streams are the attached streams
+	streams map[string]bool
+	closed  bool
+}
+
+// SubscribePattern subscribes to every stream whose name matches pattern,
+// e.g. orders.* , including the streams created later unless
+// StreamWatchIntervalInMs is 0. Messages have their
+// Stream set, the existing streams are delivered from their latest message
+// and the new ones from their first. filter may be nil.
+func (m *Hub) SubscribePattern(pattern string, subscriberID string, filter *Filter) (<-chan Message, error) {
+	re, err := compileStreamPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	names, err := m.GetStreamNames()
+	if err != nil {
+		return nil, err
+	}
+	ps := &patternSubscription{
+		hub:          m,
+		pattern:      re,
+		subscriberID: subscriberID,
+		filter:       filter,
+		ch:           make(chan Message),
+		done:         make(chan struct{}),
+		streams:      map[string]bool{},
+	}
+	m.UnsubscribePattern(subscriberID)
+	m.mu.Lock()
+	m.patternSubs[subscriberID] = ps
+	m.mu.Unlock()
+	log.I("pattern subscriber", subscriberID, "on", pattern)
+	ps.attach(names, LatestId)
+	return ps.ch, nil
+}
+
+// UnsubscribePattern ends a pattern subscription, its channel is closed
+func (m *Hub) UnsubscribePattern(subscriberID string) {
+	m.mu.Lock()
+	ps, ok := m.patternSubs[subscriberID]
+	delete(m.patternSubs, subscriberID)
+	m.mu.Unlock()
+	if ok {
+		ps.close()
+	}
+}
+
+// streamSubscriberID is the id of a pattern subscriber in every stream,
+// it does not clash with the plain subscribers
+func (ps *patternSubscription) streamSubscriberID() string {
+	return "pattern:" + ps.subscriberID
+}
+
+// attach subscribes to the matching streams of names not attached yet
+func (ps *patternSubscription) attach(names []string, offset Offset) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, name := range names {
+		if ps.closed || ps.streams[name] || !ps.pattern.MatchString(name) {
+			continue
+		}
+		ch, err := ps.hub.SubscribeWithFilter(name, ps.streamSubscriberID(), offset, ps.filter)
+		if err != nil {
+			log.Error("pattern subscriber", ps.subscriberID, "attach", name, err)
+			continue
+		}
+		log.I("pattern subscriber", ps.subscriberID, "attached", name)
+		ps.streams[name] = true
+		ps.wg.Add(1)
+		go ps.forward(name, ch)
+	}
+}
+
+// forward tags the messages of a stream, a closed channel means the
+// stream was dropped, it is attached again if it comes back
+func (ps *patternSubscription) forward(streamName string, ch <-chan Message) {
+	defer ps.wg.Done()
+	for msg := range ch {
+		msg.Stream = streamName
+		select {
+		case ps.ch <- msg:
+		case <-ps.done:
+			return
+		}
+	}
+	ps.mu.Lock()
+	delete(ps.streams, streamName)
+	ps.mu.Unlock()
+}
+
+func (ps *patternSubscription) close() {
+	ps.mu.Lock()
+	ps.closed = true
+	close(ps.done)
+	names := make([]string, 0, len(ps.streams))
+	for name := range ps.streams {
+		names = append(names, name)
+	}
+	ps.mu.Unlock()
+	for _, name := range names {
+		ps.hub.Unsubscribe(name, ps.streamSubscriberID())
+	}
+	ps.wg.Wait()
+	close(ps.ch)
+}
+
+// watchStreams attaches the streams created after pattern subscriptions
+// started, from their first message
+func (m *Hub) watchStreams() {
+	interval := time.Duration(m.cfg.StreamWatchIntervalInMs) * time.Millisecond
+	for {
+		time.Sleep(interval)
+		m.mu.RLock()
+		subs := make([]*patternSubscription, 0, len(m.patternSubs))
+		for _, ps := range m.patternSubs {
+			subs = append(subs, ps)
+		}
+		m.mu.RUnlock()
+		if len(subs) == 0 {
+			continue
+		}
+		names, err := m.GetStreamNames()
+		if err != nil {
+			log.Error("watch streams:", err)
+			continue
+		}
+		for _, ps := range subs {
+			ps.attach(names, 0)
+		}
+	}
+}
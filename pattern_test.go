@@ -0,0 +1,97 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCompileStreamPattern(t *testing.T) {
+	for _, c := range []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"orders.*", "orders.eu", true},
+		{"orders.*", "orders.eu.west", false},
+		{"orders.*", "orders", false},
+		{"orders.**", "orders.eu.west", true},
+		{"*.eu", "orders.eu", true},
+		{"order?", "orders", true},
+		{"order?", "order.", false},
+		{"a+b.*", "a+b.c", true},
+		{"a+b.*", "aab.c", false},
+	} {
+		re, err := compileStreamPattern(c.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if re.MatchString(c.name) != c.match {
+			t.Errorf("%q against %q: got %v", c.pattern, c.name, !c.match)
+		}
+	}
+	if !IsStreamPattern("orders.*") || !IsStreamPattern("order?") || IsStreamPattern("orders.eu") {
+		t.Error("IsStreamPattern is wrong")
+	}
+}
+
+func TestSubscribePattern(t *testing.T) {
+	store := newFakeStore()
+	store.put("orders.eu", "old")
+	store.put("users", "old")
+	hub := newFakeHub(&Config{MaxBatchSize: 10, PollIntervalInMs: 1}, store)
+	ch, err := hub.SubscribePattern("orders.*", "p", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func() Message {
+		select {
+		case msg := <-ch:
+			return msg
+		case <-time.After(time.Second):
+			t.Fatal("no message")
+		}
+		return Message{}
+	}
+	// existing streams are delivered from their latest message
+	store.put("users", "other")
+	store.put("orders.eu", "new")
+	if msg := next(); msg.Data != "new" || msg.Stream != "orders.eu" {
+		t.Fatalf("got %q from %q", msg.Data, msg.Stream)
+	}
+	// streams created later are delivered from their first message
+	store.put("orders.us", "first")
+	names, _ := store.GetStreamNames()
+	hub.mu.RLock()
+	ps := hub.patternSubs["p"]
+	hub.mu.RUnlock()
+	ps.attach(names, 0)
+	if msg := next(); msg.Data != "first" || msg.Stream != "orders.us" {
+		t.Fatalf("got %q from %q", msg.Data, msg.Stream)
+	}
+	hub.UnsubscribePattern("p")
+	if _, ok := <-ch; ok {
+		t.Fatal("channel not closed after UnsubscribePattern")
+	}
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+	for name, pw := range hub.pollWorkers {
+		if !pw.idleFor(0) {
+			t.Errorf("%s still has subscribers", name)
+		}
+		pw.close()
+	}
+}
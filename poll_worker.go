@@ -22,6 +22,19 @@ import (
 	"github.com/c4pt0r/log"
 )
 
+// subscriber is a single consumer attached to a PollWorker, it owns a
+// delivery goroutine so messages are handed over in order and the output
+// channel is only closed after the last send.
+type subscriber struct {
+	id     string
+	offset Offset
+	// filter selects the delivered messages, nil for all
+	filter  *Filter
+	ch      chan Message
+	batches chan []Message
+	done    chan struct{}
+}
+
 // PollWorker is a worker that polls messages from a stream
 type PollWorker struct {
 	cfg            *Config
@@ -33,13 +46,27 @@ type PollWorker struct {
 
 	// make sure subscribers is threadsafe here
 	mu sync.Mutex
-	// subscribers map[string]Subscriber, key is subscriber id
-	subscribers map[string]chan Message
+	// subscribers map[string]*subscriber, key is subscriber id
+	subscribers map[string]*subscriber
+	// idleSince is when the last subscriber left
+	idleSince time.Time
+	// wakeCh ends the wait for the next poll
+	wakeCh chan struct{}
+	// the poll interval doubles from minInterval up to maxInterval while
+	// the stream is idle, interval is the current one
+	minInterval time.Duration
+	maxInterval time.Duration
+	interval    int64
+	// shared is set when the hub polls for the worker, which only polls
+	// when woken
+	shared bool
+	// gaps holds back the polled messages after a missing id
+	gaps idGaps
 }
 
 func newPollWorker(cfg *Config, s Store, streamName string) (*PollWorker, error) {
 	// create stream table
-	err := s.CreateStream(streamName)
+	err := s.CreateStreamWithLayout(streamName, cfg.StreamConfig(streamName).Layout)
 	if err != nil {
 		return nil, err
 	}
@@ -50,8 +77,14 @@ func newPollWorker(cfg *Config, s Store, streamName string) (*PollWorker, error)
 		return nil, err
 	}
 
+	gaps, err := newIDGaps(cfg, s, streamName)
+	if err != nil {
+		return nil, err
+	}
+
 	stopped := atomic.Value{}
 	stopped.Store(false)
+	minInterval, maxInterval := cfg.pollIntervals(streamName)
 
 	pw := &PollWorker{
 		streamName:     streamName,
@@ -61,49 +94,145 @@ func newPollWorker(cfg *Config, s Store, streamName string) (*PollWorker, error)
 		stopped:        stopped,
 		numSubscribers: 0,
 		mu:             sync.Mutex{},
-		subscribers:    map[string]chan Message{},
+		subscribers:    map[string]*subscriber{},
+		idleSince:      time.Now(),
+		wakeCh:         make(chan struct{}, 1),
+		minInterval:    minInterval,
+		maxInterval:    maxInterval,
+		interval:       int64(minInterval),
+		shared:         cfg.SharedPollIntervalInMs > 0,
+		gaps:           gaps,
 	}
 	go pw.run()
 	return pw, nil
 }
 
-func (pw *PollWorker) addNewSubscriber(subscriberID string) (<-chan Message, error) {
+// addNewSubscriber registers a subscriber, if offset is not LatestId the
+// messages after offset are replayed before the live ones.
+func (pw *PollWorker) addNewSubscriber(subscriberID string, offset Offset, filter *Filter) (<-chan Message, error) {
 	pw.mu.Lock()
 	defer pw.mu.Unlock()
-	log.I("pollWorkers", pw.streamName, "got new subscriber:", subscriberID)
-	ch := make(chan Message)
-	/*
-		if offset != LatestId && offset < pw.lastSeenOffset {
-			for {
-				msgs, newOffsetInt, err := pw.store.FetchMessages(pw.streamName, offset, pw.cfg.MaxBatchSize)
-				if err != nil {
-					return nil, err
+	log.I("pollWorkers", pw.streamName, "got new subscriber:", subscriberID, "@", offset)
+	if old, ok := pw.subscribers[subscriberID]; ok {
+		close(old.done)
+		atomic.AddInt32(&pw.numSubscribers, -1)
+	}
+	sub := &subscriber{
+		id:      subscriberID,
+		offset:  offset,
+		filter:  filter,
+		ch:      make(chan Message),
+		batches: make(chan []Message, pw.queueSize()),
+		done:    make(chan struct{}),
+	}
+	go pw.deliver(sub)
+	// listen to new messages
+	pw.subscribers[subscriberID] = sub
+	atomic.AddInt32(&pw.numSubscribers, 1)
+	return sub.ch, nil
+}
+
+// defaultSubscriberQueueSize is the number of polled batches buffered for
+// a subscriber if SubscriberQueueSize is not set
+const defaultSubscriberQueueSize = 1024
+
+func (pw *PollWorker) queueSize() int {
+	if pw.cfg.SubscriberQueueSize > 0 {
+		return pw.cfg.SubscriberQueueSize
+	}
+	return defaultSubscriberQueueSize
+}
+
+func (pw *PollWorker) deliver(sub *subscriber) {
+	defer close(sub.ch)
+	send := func(msg Message) bool {
+		// it may have expired while queued
+		if msg.Expired(time.Now()) {
+			return true
+		}
+		select {
+		case sub.ch <- msg:
+			return true
+		case <-sub.done:
+			return false
+		}
+	}
+	// catch up from the requested offset to the last polled id, the
+	// messages after it come from the poller once their gaps are settled.
+	// The subscriber is registered before end is read, so no batch
+	// after end is missed.
+	var lastID int64
+	if sub.offset != LatestId {
+		offset, end := sub.offset, pw.lastOffset()
+	catchUp:
+		for offset < end {
+			msgs, max, err := pw.store.FetchMessagesFiltered(pw.streamName, offset, pw.cfg.MaxBatchSize, sub.filter)
+			if err != nil {
+				log.Error(err)
+				return
+			}
+			if len(msgs) == 0 {
+				break
+			}
+			for _, msg := range msgs {
+				if msg.ID > int64(end) {
+					break catchUp
 				}
-				if len(msgs) > 0 {
-					offset = Offset(newOffsetInt)
-					go func() {
-						// send messages to this subscriber
-						for _, msg := range msgs {
-							ch <- msg
-						}
-					}()
-				} else {
-					break
+				if sub.filter != nil && !sub.filter.Match(&msg) {
+					continue
+				}
+				if !send(msg) {
+					return
 				}
 			}
+			offset = max
 		}
-	*/
-	// listen to new messages
-	pw.subscribers[subscriberID] = ch
-	atomic.AddInt32(&pw.numSubscribers, 1)
-	return ch, nil
+		lastID = int64(end)
+		if int64(sub.offset) > lastID {
+			lastID = int64(sub.offset)
+		}
+	}
+	for {
+		select {
+		case msgs := <-sub.batches:
+			for _, msg := range msgs {
+				// already sent during catch up
+				if msg.ID <= lastID {
+					continue
+				}
+				if !send(msg) {
+					return
+				}
+			}
+		case <-sub.done:
+			return
+		}
+	}
 }
 
 func (pw *PollWorker) Stat() map[string]interface{} {
 	return map[string]interface{}{
-		"last_poll_id":        pw.lastSeenOffset,
-		"poll_interval_in_ms": pw.cfg.PollIntervalInMs,
+		"last_poll_id":        pw.lastOffset(),
+		"poll_interval_in_ms": time.Duration(atomic.LoadInt64(&pw.interval)).Milliseconds(),
 		"poll_batch_size":     pw.cfg.MaxBatchSize,
+		"num_subscribers":     atomic.LoadInt32(&pw.numSubscribers),
+		"shared_poll":         pw.shared,
+	}
+}
+
+// dropSubscriber removes sub if it is still registered, the id may have
+// been subscribed again since
+func (pw *PollWorker) dropSubscriber(sub *subscriber) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.subscribers[sub.id] != sub {
+		return
+	}
+	close(sub.done)
+	delete(pw.subscribers, sub.id)
+	atomic.AddInt32(&pw.numSubscribers, -1)
+	if len(pw.subscribers) == 0 {
+		pw.idleSince = time.Now()
 	}
 }
 
@@ -111,45 +240,132 @@ func (pw *PollWorker) removeSubscriber(subscriberID string) {
 	pw.mu.Lock()
 	defer pw.mu.Unlock()
 	log.I("pollWorkers", pw.streamName, "remove subscriber:", subscriberID)
-	if v, ok := pw.subscribers[subscriberID]; ok {
-		close(v)
+	if sub, ok := pw.subscribers[subscriberID]; ok {
+		// the delivery goroutine closes the channel on its way out
+		close(sub.done)
+		delete(pw.subscribers, subscriberID)
+		atomic.AddInt32(&pw.numSubscribers, -1)
+		if len(pw.subscribers) == 0 {
+			pw.idleSince = time.Now()
+		}
 	}
-	delete(pw.subscribers, subscriberID)
-	atomic.AddInt32(&pw.numSubscribers, -1)
+}
+
+// idleFor tells if the worker has had no subscriber for timeout
+func (pw *PollWorker) idleFor(timeout time.Duration) bool {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return len(pw.subscribers) == 0 && time.Since(pw.idleSince) >= timeout
+}
+
+// close stops polling and closes the channels of all the subscribers
+func (pw *PollWorker) close() {
+	pw.Stop()
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	for id, sub := range pw.subscribers {
+		close(sub.done)
+		delete(pw.subscribers, id)
+	}
+	atomic.StoreInt32(&pw.numSubscribers, 0)
 }
 
 func (pw *PollWorker) Stop() {
 	log.I("pollWorkers", pw.streamName, "stopped")
 	pw.stopped.Store(true)
+	pw.wake()
+}
+
+// wait waits for the next poll, the interval is reset by activity and
+// backs off exponentially otherwise
+func (pw *PollWorker) wait(active bool) {
+	if pw.shared {
+		<-pw.wakeCh
+		return
+	}
+	interval := time.Duration(atomic.LoadInt64(&pw.interval))
+	if active {
+		interval = pw.minInterval
+	}
+	select {
+	case <-pw.wakeCh:
+		interval = pw.minInterval
+	case <-time.After(interval):
+		if !active {
+			if interval *= 2; interval > pw.maxInterval {
+				interval = pw.maxInterval
+			}
+		}
+	}
+	atomic.StoreInt64(&pw.interval, int64(interval))
+}
+
+// lastOffset is the last polled id, read by the shared poller
+func (pw *PollWorker) lastOffset() Offset {
+	return Offset(atomic.LoadInt64((*int64)(&pw.lastSeenOffset)))
+}
+
+// wake makes the worker poll now, the stream has new messages
+func (pw *PollWorker) wake() {
+	select {
+	case pw.wakeCh <- struct{}{}:
+	default:
+	}
 }
 
 func (pw *PollWorker) run() {
 	log.Info("sub: start polling from", pw.streamName, "@id=", pw.lastSeenOffset)
 	for !pw.stopped.Load().(bool) {
 		// get messages from the stream in batches
-		msgs, max, err := pw.store.FetchMessages(pw.streamName, pw.lastSeenOffset, pw.cfg.MaxBatchSize)
+		polled, _, err := pw.store.FetchMessages(pw.streamName, pw.lastSeenOffset, pw.cfg.MaxBatchSize)
 		if err != nil {
 			log.Error(err)
-			time.Sleep(time.Duration(pw.cfg.PollIntervalInMs) * time.Millisecond)
-			goto done
 		}
+		msgs := pw.gaps.settled(pw.lastSeenOffset, polled, time.Now())
 		if len(msgs) > 0 {
-			pw.lastSeenOffset = Offset(max)
+			atomic.StoreInt64((*int64)(&pw.lastSeenOffset), msgs[len(msgs)-1].ID)
 			log.Info("sub: got", len(msgs), "messages from", pw.streamName, "@ id=", pw.lastSeenOffset)
 
+			// fanout to a snapshot of the subscribers, a removed one may
+			// still get a batch which its delivery goroutine drops
 			pw.mu.Lock()
-			// fanout to subscribers
-			for _, c := range pw.subscribers {
-				go func(ch chan Message) {
-					for _, msg := range msgs {
-						ch <- msg
-					}
-				}(c)
+			subs := make([]*subscriber, 0, len(pw.subscribers))
+			for _, sub := range pw.subscribers {
+				subs = append(subs, sub)
 			}
 			pw.mu.Unlock()
+			// the data is parsed once for all the filters
+			var parsed []interface{}
+			for _, sub := range subs {
+				batch := msgs
+				if sub.filter != nil {
+					if parsed == nil && sub.filter.needsData() {
+						parsed = make([]interface{}, len(msgs))
+						for i := range msgs {
+							parsed[i] = parseData(msgs[i].Data)
+						}
+					}
+					if batch = sub.filter.filterMessages(msgs, parsed); len(batch) == 0 {
+						continue
+					}
+				}
+				select {
+				case sub.batches <- batch:
+				case <-sub.done:
+				default:
+					// its queue is full, waiting would hold up the others
+					log.Warn("pollWorkers", pw.streamName, "drop slow subscriber:", sub.id)
+					pw.dropSubscriber(sub)
+				}
+			}
+		}
+		// a full batch means there are more messages waiting
+		if pw.cfg.MaxBatchSize > 0 && len(msgs) >= pw.cfg.MaxBatchSize {
+			atomic.StoreInt64(&pw.interval, int64(pw.minInterval))
+			continue
 		}
-	done:
-		time.Sleep(time.Duration(pw.cfg.PollIntervalInMs) * time.Millisecond)
+		// a gap is polled again soon
+		pw.wait(len(polled) > 0)
 	}
 	log.D("poll worker stopped")
 }
@@ -0,0 +1,194 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPollWorkerDeliversInOrder(t *testing.T) {
+	store := newFakeStore()
+	store.put("s", "a", "b")
+	pw, err := newPollWorker(&Config{MaxBatchSize: 10, PollIntervalInMs: 1}, store, "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pw.close()
+	ch, _ := pw.addNewSubscriber("sub", 0, nil)
+	store.put("s", "c")
+	for _, want := range []string{"a", "b", "c"} {
+		select {
+		case msg := <-ch:
+			if msg.Data != want {
+				t.Fatalf("got %q, want %q", msg.Data, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no message %q", want)
+		}
+	}
+}
+
+func TestPollWorkerDropsSlowSubscriber(t *testing.T) {
+	store := newFakeStore()
+	store.endless = true
+	pw, err := newPollWorker(&Config{MaxBatchSize: 1, SubscriberQueueSize: 4}, store, "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pw.close()
+	// the subscriber never reads, its queue fills up
+	slow, _ := pw.addNewSubscriber("slow", LatestId, nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&pw.numSubscribers) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("slow subscriber not dropped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// the worker goes on for the others
+	ch, _ := pw.addNewSubscriber("other", LatestId, nil)
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("worker stuck on the dropped subscriber")
+	}
+	// the channel of the dropped one is closed
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-slow:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("channel of the dropped subscriber not closed")
+		}
+	}
+}
+
+func TestPollWorkerSkipsExpired(t *testing.T) {
+	expired := time.Now().Add(-time.Second).UnixNano()
+	later := time.Now().Add(time.Hour).UnixNano()
+	store := newFakeStore()
+	store.putMessages("s", Message{Data: "a"}, Message{Data: "gone", ExpireAt: expired}, Message{Data: "b", ExpireAt: later})
+	pw, err := newPollWorker(&Config{MaxBatchSize: 10, PollIntervalInMs: 1}, store, "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pw.close()
+	// replayed from the first message, then polled
+	replayed, _ := pw.addNewSubscriber("replayed", 0, nil)
+	live, _ := pw.addNewSubscriber("live", LatestId, nil)
+	store.putMessages("s", Message{Data: "gone too", ExpireAt: expired}, Message{Data: "c"})
+	for name, ch := range map[string]<-chan Message{"replayed": replayed, "live": live} {
+		want := []string{"a", "b", "c"}
+		if name == "live" {
+			want = []string{"c"}
+		}
+		for _, data := range want {
+			select {
+			case msg := <-ch:
+				if msg.Data != data {
+					t.Fatalf("%s: got %q, want %q", name, msg.Data, data)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%s: no message %q", name, data)
+			}
+		}
+	}
+}
+
+func TestPollWorkerBackoff(t *testing.T) {
+	pw := &PollWorker{
+		wakeCh:      make(chan struct{}, 1),
+		minInterval: time.Millisecond,
+		maxInterval: 4 * time.Millisecond,
+		interval:    int64(time.Millisecond),
+	}
+	interval := func() time.Duration { return time.Duration(pw.interval) }
+	// idle polls double the interval up to the max
+	for _, want := range []time.Duration{2, 4, 4} {
+		pw.wait(false)
+		if interval() != want*time.Millisecond {
+			t.Fatalf("idle: got %v, want %v", interval(), want*time.Millisecond)
+		}
+	}
+	// messages reset it
+	pw.wait(true)
+	if interval() != time.Millisecond {
+		t.Fatalf("active: got %v", interval())
+	}
+	// and so does a wake up, without waiting for the interval
+	pw.maxInterval = time.Hour
+	pw.interval = int64(time.Hour)
+	pw.wake()
+	start := time.Now()
+	pw.wait(false)
+	if interval() != time.Millisecond || time.Since(start) > time.Second {
+		t.Fatalf("woken: got %v after %v", interval(), time.Since(start))
+	}
+}
+
+func TestPollWorkerWaitsForGap(t *testing.T) {
+	store := newFakeStore()
+	store.put("s", "a")
+	pw, err := newPollWorker(&Config{MaxBatchSize: 10, PollIntervalInMs: 1, GapTimeoutInMs: 60000}, store, "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pw.close()
+	ch, _ := pw.addNewSubscriber("sub", LatestId, nil)
+	// 3 commits before 2
+	store.insert("s", Message{ID: 3, Data: "c"})
+	select {
+	case msg := <-ch:
+		t.Fatalf("got %q before the gap was filled", msg.Data)
+	case <-time.After(50 * time.Millisecond):
+	}
+	store.insert("s", Message{ID: 2, Data: "b"})
+	for _, want := range []string{"b", "c"} {
+		select {
+		case msg := <-ch:
+			if msg.Data != want {
+				t.Fatalf("got %q, want %q", msg.Data, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no message %q", want)
+		}
+	}
+}
+
+func TestPollWorkerSkipsGapAfterTimeout(t *testing.T) {
+	store := newFakeStore()
+	store.put("s", "a")
+	pw, err := newPollWorker(&Config{MaxBatchSize: 10, PollIntervalInMs: 1, GapTimeoutInMs: 20}, store, "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pw.close()
+	ch, _ := pw.addNewSubscriber("sub", LatestId, nil)
+	// 2 is never used
+	store.insert("s", Message{ID: 3, Data: "c"})
+	select {
+	case msg := <-ch:
+		if msg.Data != "c" {
+			t.Fatalf("got %q, want c", msg.Data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the gap was never skipped")
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/c4pt0r/log"
+)
+
+// TxHandler transforms a batch of input messages, everything it writes in
+// tx, e.g. with Hub.PublishTx, is committed together with the offset of
+// the consumer. An error rolls it all back.
+type TxHandler func(tx *sql.Tx, msgs []Message) error
+
+// ProcessOptions are the options of Hub.Process
+type ProcessOptions struct {
+	// BatchSize is the max number of messages per handler call, defaults to MaxBatchSize
+	BatchSize int
+	// StartOffset is where a consumer without committed offset starts, 0
+	// reads the stream from the beginning, LatestId only new messages
+	StartOffset Offset
+	// PollInterval is how long to wait when there is nothing to process,
+	// defaults to PollIntervalInMs
+	PollInterval time.Duration
+}
+
+// Process consumes a stream exactly once as consumerID until ctx is done:
+// every batch is handled in a transaction which also commits the offset of
+// the consumer, so a crash never loses input nor duplicates output. When
+// several processes run the same consumer, the offset row serializes them
+// and a batch handled by another one is skipped.
+func (m *Hub) Process(ctx context.Context, streamName string, consumerID string, opts ProcessOptions, handler TxHandler) error {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = m.cfg.MaxBatchSize
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = time.Duration(m.cfg.PollIntervalInMs) * time.Millisecond
+	}
+	if err := m.CreateStream(streamName); err != nil {
+		return err
+	}
+	committed, err := m.initOffset(streamName, consumerID, opts.StartOffset)
+	if err != nil {
+		return err
+	}
+	gaps, err := newIDGaps(m.cfg, m.store, streamName)
+	if err != nil {
+		return err
+	}
+	pos := committed
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		msgs, _, err := m.store.FetchMessages(streamName, pos, opts.BatchSize)
+		if err != nil {
+			return err
+		}
+		// the messages after a missing id wait for it to commit
+		if msgs = gaps.settled(pos, msgs, time.Now()); len(msgs) == 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(opts.PollInterval):
+			}
+			continue
+		}
+		last, err := m.processBatch(streamName, consumerID, committed, msgs, handler)
+		if err == errOffsetMoved {
+			// another process handled the batch, start over from its offset
+			if committed, err = m.initOffset(streamName, consumerID, opts.StartOffset); err != nil {
+				return err
+			}
+			pos = committed
+			log.I("process", streamName, consumerID, "offset moved to", committed)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		committed, pos = last, last
+	}
+}
+
+// initOffset returns the committed offset of a consumer, a new consumer
+// first saves start so processBatch always has an offset row to lock and
+// concurrent processes agree on where it starts
+func (m *Hub) initOffset(streamName string, consumerID string, start Offset) (Offset, error) {
+	committed, err := m.store.GetCommittedOffset(streamName, consumerID)
+	if err != nil || committed != LatestId {
+		return committed, err
+	}
+	if start == LatestId {
+		// pin the latest offset, FetchMessages would move it at every call
+		_, maxID, err := m.store.MinMaxID(streamName)
+		if err != nil {
+			return LatestId, err
+		}
+		start = Offset(maxID)
+	}
+	return m.store.InitCommittedOffset(streamName, consumerID, start)
+}
+
+var errOffsetMoved = errors.New("committed offset moved")
+
+// processBatch handles msgs and commits the offset of their last message
+// in one transaction, if the committed offset is still the expected one
+func (m *Hub) processBatch(streamName string, consumerID string, expected Offset, msgs []Message, handler TxHandler) (Offset, error) {
+	last := Offset(msgs[len(msgs)-1].ID)
+	err := m.RunTx(func(tx *sql.Tx) error {
+		committed, err := m.store.LockCommittedOffset(tx, streamName, consumerID)
+		if err != nil {
+			return err
+		}
+		if committed != expected {
+			return errOffsetMoved
+		}
+		if err := handler(tx, msgs); err != nil {
+			return err
+		}
+		return m.store.CommitOffsetTx(tx, streamName, consumerID, last)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return last, nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInitOffset(t *testing.T) {
+	store := newFakeStore()
+	store.put("s", "a", "b", "c")
+	hub := newFakeHub(&Config{}, store)
+	for _, c := range []struct {
+		consumer string
+		start    Offset
+		want     Offset
+	}{
+		{"from-start", 0, 0},
+		{"from-latest", LatestId, 3},
+		// the saved offset wins over the start
+		{"from-start", LatestId, 0},
+		{"from-latest", 0, 3},
+	} {
+		got, err := hub.initOffset("s", c.consumer, c.start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("%s from %d: got %d, want %d", c.consumer, c.start, got, c.want)
+		}
+	}
+	// new messages do not move a pinned latest offset
+	store.put("s", "d")
+	if got, _ := hub.initOffset("s", "from-latest", LatestId); got != 3 {
+		t.Errorf("latest offset moved to %d", got)
+	}
+}
+
+func TestProcessExactlyOnce(t *testing.T) {
+	hub := testHub(t, &Config{MaxBatchSize: 7, PollIntervalInMs: 10})
+	run := time.Now().UnixNano()
+	in, out := fmt.Sprintf("test_in_%d", run), fmt.Sprintf("test_out_%d", run)
+	for _, name := range []string{in, out} {
+		if err := hub.CreateStream(name); err != nil {
+			t.Fatal(err)
+		}
+		name := name
+		t.Cleanup(func() { hub.DeleteStream(name) })
+	}
+	const n = 50
+	var msgs []*Message
+	for i := 0; i < n; i++ {
+		msgs = append(msgs, &Message{Data: fmt.Sprint(i)})
+	}
+	if err := hub.PublishSync(in, msgs...); err != nil {
+		t.Fatal(err)
+	}
+
+	// two processes of a new consumer race for its first batches
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hub.Process(ctx, in, "copy", ProcessOptions{}, func(tx *sql.Tx, msgs []Message) error {
+				copies := make([]*Message, len(msgs))
+				for i := range msgs {
+					copies[i] = &Message{Data: msgs[i].Data}
+				}
+				return hub.PublishTx(tx, out, copies...)
+			})
+		}()
+	}
+	for {
+		_, committed, err := hub.MinMaxID(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset, err := hub.CommittedOffset(in, "copy")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset == Offset(committed) {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatal("the input was not processed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	wg.Wait()
+
+	copies, _, err := hub.FetchMessages(out, 0, 2*n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, msg := range copies {
+		if seen[msg.Data] {
+			t.Fatalf("message %s copied twice", msg.Data)
+		}
+		seen[msg.Data] = true
+	}
+	if len(seen) != n {
+		t.Fatalf("%d messages copied, want %d", len(seen), n)
+	}
+}
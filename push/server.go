@@ -0,0 +1,150 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package push serves tipubsub streams to browsers over Server-Sent Events
+// and WebSocket.
+package push
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/c4pt0r/log"
+	"github.com/c4pt0r/tipubsub"
+)
+
+// Server is a http server exposing:
+//
+//	GET /sse/<streamName>?offset=<id>
+//	GET /ws/<streamName>?offset=<id>
+//
+// offset is optional, for SSE the Last-Event-ID header takes precedence so
+// reconnecting browsers resume where they stopped.
+type Server struct {
+	hub       *tipubsub.Hub
+	heartbeat time.Duration
+	bufSize   int
+	seq       int64
+}
+
+func NewServer(hub *tipubsub.Hub, cfg *tipubsub.Config) *Server {
+	return &Server{
+		hub:       hub,
+		heartbeat: time.Duration(cfg.PushHeartbeatInSec) * time.Second,
+		bufSize:   cfg.PushBufferSize,
+	}
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sse/", s.serveSSE)
+	mux.HandleFunc("/ws/", s.serveWS)
+	return mux
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	log.Info("push: listening on", addr)
+	return http.ListenAndServe(addr, s.Handler())
+}
+
+func (s *Server) newSubscriberID(proto string, r *http.Request) string {
+	return fmt.Sprintf("%s-%s-%d", proto, r.RemoteAddr, atomic.AddInt64(&s.seq, 1))
+}
+
+func parseOffset(val string) (tipubsub.Offset, error) {
+	if val == "" || val == "latest" {
+		return tipubsub.LatestId, nil
+	}
+	o, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid offset: %s", val)
+	}
+	return tipubsub.Offset(o), nil
+}
+
+// parseFilter parses the optional filter query parameter
+func parseFilter(r *http.Request) (*tipubsub.Filter, error) {
+	expr := r.URL.Query().Get("filter")
+	if expr == "" {
+		return nil, nil
+	}
+	return tipubsub.ParseFilter(expr)
+}
+
+func streamNameFromPath(prefix string, r *http.Request) string {
+	return strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+}
+
+// subscription is a hub subscription with a bounded per-connection buffer.
+type subscription struct {
+	hub          *tipubsub.Hub
+	streamName   string
+	subscriberID string
+	// C is closed when the subscription is over, overflow is set if the
+	// client could not keep up with the buffer.
+	C        chan tipubsub.Message
+	overflow int32
+}
+
+// subscribe subscribes to a stream, or to a pattern like orders.* whose
+// messages carry their stream, offset is ignored for patterns
+func (s *Server) subscribe(streamName string, subscriberID string, offset tipubsub.Offset, filter *tipubsub.Filter) (*subscription, error) {
+	var ch <-chan tipubsub.Message
+	var err error
+	if tipubsub.IsStreamPattern(streamName) {
+		ch, err = s.hub.SubscribePattern(streamName, subscriberID, filter)
+	} else {
+		ch, err = s.hub.SubscribeWithFilter(streamName, subscriberID, offset, filter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sub := &subscription{
+		hub:          s.hub,
+		streamName:   streamName,
+		subscriberID: subscriberID,
+		C:            make(chan tipubsub.Message, s.bufSize),
+	}
+	go func() {
+		defer close(sub.C)
+		for msg := range ch {
+			select {
+			case sub.C <- msg:
+			default:
+				// buffer is full, drop the slow client
+				log.Warn("push: buffer full, dropping", subscriberID)
+				atomic.StoreInt32(&sub.overflow, 1)
+				sub.Close()
+				return
+			}
+		}
+	}()
+	return sub, nil
+}
+
+func (sub *subscription) Overflow() bool {
+	return atomic.LoadInt32(&sub.overflow) == 1
+}
+
+func (sub *subscription) Close() {
+	if tipubsub.IsStreamPattern(sub.streamName) {
+		sub.hub.UnsubscribePattern(sub.subscriberID)
+		return
+	}
+	sub.hub.Unsubscribe(sub.streamName, sub.subscriberID)
+}
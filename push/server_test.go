@@ -0,0 +1,59 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package push
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/c4pt0r/tipubsub"
+)
+
+func TestParseOffset(t *testing.T) {
+	for val, want := range map[string]tipubsub.Offset{
+		"":       tipubsub.LatestId,
+		"latest": tipubsub.LatestId,
+		"0":      0,
+		"42":     42,
+	} {
+		got, err := parseOffset(val)
+		if err != nil || got != want {
+			t.Errorf("%q: got %d, %v", val, got, err)
+		}
+	}
+	if _, err := parseOffset("first"); err == nil {
+		t.Error("no error for an invalid offset")
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/sse/orders.eu/?filter=header.kind+%3D%3D+%22a%22", nil)
+	if got := streamNameFromPath("/sse/", r); got != "orders.eu" {
+		t.Errorf("got stream %q", got)
+	}
+	f, err := parseFilter(r)
+	if err != nil || f == nil {
+		t.Fatalf("got %v, %v", f, err)
+	}
+	if !f.Match(&tipubsub.Message{Headers: map[string]string{"kind": "a"}}) {
+		t.Error("the filter does not match")
+	}
+	if f, err := parseFilter(httptest.NewRequest("GET", "/sse/s", nil)); f != nil || err != nil {
+		t.Errorf("no filter: got %v, %v", f, err)
+	}
+	if _, err := parseFilter(httptest.NewRequest("GET", "/sse/s?filter=%3D%3D", nil)); err == nil {
+		t.Error("no error for an invalid filter")
+	}
+}
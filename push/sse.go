@@ -0,0 +1,90 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package push
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/c4pt0r/log"
+)
+
+func (s *Server) serveSSE(w http.ResponseWriter, r *http.Request) {
+	streamName := streamNameFromPath("/sse/", r)
+	if streamName == "" {
+		http.Error(w, "missing stream name", http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	offsetVal := r.Header.Get("Last-Event-ID")
+	if offsetVal == "" {
+		offsetVal = r.URL.Query().Get("offset")
+	}
+	offset, err := parseOffset(offsetVal)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter, err := parseFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	subscriberID := s.newSubscriberID("sse", r)
+	sub, err := s.subscribe(streamName, subscriberID, offset, filter)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(s.heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			log.I("push: sse client gone", subscriberID)
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case msg, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			// the event id is the message id, browsers send it back as
+			// Last-Event-ID when reconnecting
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: message\ndata: %s\n\n", msg.ID, msg); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
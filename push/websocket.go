@@ -0,0 +1,106 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package push
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/c4pt0r/log"
+	"github.com/gorilla/websocket"
+)
+
+const wsWriteTimeout = 10 * time.Second
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// dashboards are usually served from a different origin
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+func (s *Server) serveWS(w http.ResponseWriter, r *http.Request) {
+	streamName := streamNameFromPath("/ws/", r)
+	if streamName == "" {
+		http.Error(w, "missing stream name", http.StatusBadRequest)
+		return
+	}
+	offset, err := parseOffset(r.URL.Query().Get("offset"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter, err := parseFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	subscriberID := s.newSubscriberID("ws", r)
+	sub, err := s.subscribe(streamName, subscriberID, offset, filter)
+	if err != nil {
+		log.Error(err)
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseInternalServerErr, err.Error()),
+			time.Now().Add(wsWriteTimeout))
+		return
+	}
+	defer sub.Close()
+
+	// the read loop only exists to notice the client going away
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(s.heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-gone:
+			log.I("push: ws client gone", subscriberID)
+			return
+		case <-heartbeat.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return
+			}
+		case msg, ok := <-sub.C:
+			if !ok {
+				if sub.Overflow() {
+					conn.WriteControl(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "buffer overflow"),
+						time.Now().Add(wsWriteTimeout))
+				}
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			// msg.ID is serialized as "id", clients resume with ?offset=<id>
+			if err := conn.WriteJSON(msg); err != nil {
+				return
+			}
+		}
+	}
+}
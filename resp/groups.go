@@ -0,0 +1,441 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resp
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/c4pt0r/tipubsub"
+)
+
+var errNoGroup = errors.New("NOGROUP No such key or consumer group")
+
+// createPendingTable creates the table of the pending entries lists, an
+// entry is kept until it is acked so it survives restarts and can be read
+// and acked through any server
+func createPendingTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS tipubsub_resp_pending (
+			stream_name VARCHAR(255) NOT NULL,
+			group_name VARCHAR(255) NOT NULL,
+			id BIGINT NOT NULL,
+			consumer VARCHAR(255) NOT NULL,
+			delivered_at BIGINT NOT NULL,
+			deliveries BIGINT NOT NULL DEFAULT 1,
+			PRIMARY KEY (stream_name, group_name, id)
+		);`)
+	return err
+}
+
+// placeholders returns n comma separated "?"
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+// checkGroup returns errNoGroup if the group does not exist, the position
+// of a group is the durable offset named after it
+func (s *Server) checkGroup(streamName string, name string) error {
+	offset, err := s.hub.CommittedOffset(streamName, name)
+	if err != nil {
+		return errors.New("ERR " + err.Error())
+	}
+	if offset == tipubsub.LatestId {
+		return errNoGroup
+	}
+	return nil
+}
+
+func (s *Server) resolveGroupID(streamName string, idArg string) (int64, error) {
+	if idArg == "$" {
+		_, max, err := s.hub.MinMaxID(streamName)
+		if err != nil {
+			return 0, errors.New("ERR " + err.Error())
+		}
+		return max, nil
+	}
+	id, _, err := parseID(idArg)
+	return id, err
+}
+
+// XGROUP CREATE key group id|$ [MKSTREAM]
+// XGROUP SETID key group id|$
+// XGROUP DESTROY key group
+// XGROUP CREATECONSUMER|DELCONSUMER key group consumer
+func (s *Server) xgroup(w writer, args []string) {
+	if len(args) < 3 {
+		w.err(errWrongArgs("xgroup"))
+		return
+	}
+	sub, streamName, name := strings.ToUpper(args[0]), args[1], args[2]
+	switch sub {
+	case "CREATE":
+		if len(args) < 4 {
+			w.err(errWrongArgs("xgroup"))
+			return
+		}
+		if len(args) > 4 && strings.ToUpper(args[4]) == "MKSTREAM" {
+			if err := s.hub.CreateStream(streamName); err != nil {
+				w.err("ERR " + err.Error())
+				return
+			}
+		} else if _, _, err := s.hub.MinMaxID(streamName); err != nil {
+			w.err("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+			return
+		}
+		if err := s.checkGroup(streamName, name); err == nil {
+			w.err("BUSYGROUP Consumer Group name already exists")
+			return
+		} else if err != errNoGroup {
+			w.err(err.Error())
+			return
+		}
+		s.setGroupID(w, streamName, name, args[3])
+	case "SETID":
+		if len(args) < 4 {
+			w.err(errWrongArgs("xgroup"))
+			return
+		}
+		if err := s.checkGroup(streamName, name); err != nil {
+			w.err(err.Error())
+			return
+		}
+		s.setGroupID(w, streamName, name, args[3])
+	case "DESTROY":
+		if err := s.checkGroup(streamName, name); err != nil {
+			w.int(0)
+			return
+		}
+		if err := s.deletePending(streamName, name); err != nil {
+			w.err("ERR " + err.Error())
+			return
+		}
+		if err := s.hub.DeleteCommittedOffset(streamName, name); err != nil {
+			w.err("ERR " + err.Error())
+			return
+		}
+		w.int(1)
+	case "CREATECONSUMER":
+		// consumers exist implicitly
+		w.int(1)
+	case "DELCONSUMER":
+		if len(args) != 4 {
+			w.err(errWrongArgs("xgroup"))
+			return
+		}
+		if err := s.checkGroup(streamName, name); err != nil {
+			w.err(err.Error())
+			return
+		}
+		res, err := s.hub.DB().Exec(`
+			DELETE FROM tipubsub_resp_pending
+			WHERE stream_name = ? AND group_name = ? AND consumer = ?`, streamName, name, args[3])
+		if err != nil {
+			w.err("ERR " + err.Error())
+			return
+		}
+		n, _ := res.RowsAffected()
+		w.int(n)
+	default:
+		w.err("ERR unknown subcommand '" + args[0] + "'")
+	}
+}
+
+func (s *Server) deletePending(streamName string, groupName string) error {
+	_, err := s.hub.DB().Exec(`
+		DELETE FROM tipubsub_resp_pending
+		WHERE stream_name = ? AND group_name = ?`, streamName, groupName)
+	return err
+}
+
+// setGroupID moves the group to id and resets its pending entries
+func (s *Server) setGroupID(w writer, streamName string, name string, idArg string) {
+	id, err := s.resolveGroupID(streamName, idArg)
+	if err != nil {
+		w.err(err.Error())
+		return
+	}
+	if err := s.deletePending(streamName, name); err != nil {
+		w.err("ERR " + err.Error())
+		return
+	}
+	if err := s.hub.CommitOffset(streamName, name, tipubsub.Offset(id)); err != nil {
+		w.err("ERR " + err.Error())
+		return
+	}
+	w.simple("OK")
+}
+
+// readNew claims the entries after the position of the group. The
+// position is locked until they are added to the pending entries list,
+// so the servers sharing a group never deliver an entry twice and an
+// entry is never lost before it is acked.
+func (s *Server) readNew(streamName string, groupName string, consumer string, limit int, noAck bool) ([]tipubsub.Message, error) {
+	tx, err := s.hub.DB().Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	offset, err := s.hub.LockCommittedOffset(tx, streamName, groupName)
+	if err != nil {
+		return nil, err
+	}
+	if offset == tipubsub.LatestId {
+		// destroyed meanwhile
+		return nil, errNoGroup
+	}
+	msgs, max, err := s.hub.FetchMessages(streamName, offset, limit)
+	if err != nil || len(msgs) == 0 {
+		return nil, err
+	}
+	if !noAck {
+		now := time.Now().UnixNano()
+		args := make([]interface{}, 0, 5*len(msgs))
+		for _, msg := range msgs {
+			args = append(args, streamName, groupName, msg.ID, consumer, now)
+		}
+		values := strings.TrimSuffix(strings.Repeat("(?, ?, ?, ?, ?),", len(msgs)), ",")
+		_, err := tx.Exec(`
+			INSERT INTO tipubsub_resp_pending (stream_name, group_name, id, consumer, delivered_at)
+			VALUES `+values, args...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := s.hub.CommitOffsetTx(tx, streamName, groupName, max); err != nil {
+		return nil, err
+	}
+	return msgs, tx.Commit()
+}
+
+// readPending returns the pending entries of consumer after id, an entry
+// trimmed from the stream is returned without data
+func (s *Server) readPending(streamName string, groupName string, consumer string, id int64, limit int) ([]tipubsub.Message, error) {
+	rows, err := s.hub.DB().Query(`
+		SELECT id
+		FROM tipubsub_resp_pending
+		WHERE stream_name = ? AND group_name = ? AND consumer = ? AND id > ?
+		ORDER BY id
+		LIMIT ?`, streamName, groupName, consumer, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	var ids []interface{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	_, err = s.hub.DB().Exec(`
+		UPDATE tipubsub_resp_pending
+		SET deliveries = deliveries + 1
+		WHERE stream_name = ? AND group_name = ? AND id IN (`+placeholders(len(ids))+`)`,
+		append([]interface{}{streamName, groupName}, ids...)...)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]tipubsub.Message, len(ids))
+	for i, id := range ids {
+		msgs[i].ID = id.(int64)
+		found, _, err := s.hub.FetchMessages(streamName, tipubsub.Offset(msgs[i].ID-1), 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(found) > 0 && found[0].ID == msgs[i].ID {
+			msgs[i] = found[0]
+		}
+	}
+	return msgs, nil
+}
+
+// XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds] [NOACK] STREAMS key [key ...] id [id ...]
+func (s *Server) xreadgroup(w writer, args []string) {
+	if len(args) < 6 || strings.ToUpper(args[0]) != "GROUP" {
+		w.err(errWrongArgs("xreadgroup"))
+		return
+	}
+	groupName, consumer := args[1], args[2]
+	opts, err := parseReadOptions(args[3:], true)
+	if err != nil {
+		w.err(err.Error())
+		return
+	}
+	for _, streamName := range opts.streams {
+		if err := s.checkGroup(streamName, groupName); err != nil {
+			w.err(err.Error())
+			return
+		}
+	}
+	limit := opts.count
+	if limit <= 0 || limit > s.maxCount {
+		limit = s.maxCount
+	}
+
+	// history reads return the pending entries and never block
+	var history []streamResult
+	newOnly := true
+	for i, idArg := range opts.ids {
+		if idArg == ">" {
+			continue
+		}
+		newOnly = false
+		id, _, err := parseID(idArg)
+		if err != nil {
+			w.err(err.Error())
+			return
+		}
+		msgs, err := s.readPending(opts.streams[i], groupName, consumer, id, limit)
+		if err != nil {
+			w.err("ERR " + err.Error())
+			return
+		}
+		history = append(history, streamResult{opts.streams[i], msgs})
+	}
+	if !newOnly {
+		writeStreamResults(w, history)
+		return
+	}
+
+	results, err := s.blockUntil(opts.block, func() ([]streamResult, error) {
+		var results []streamResult
+		for _, streamName := range opts.streams {
+			msgs, err := s.readNew(streamName, groupName, consumer, limit, opts.noAck)
+			if err != nil {
+				return nil, err
+			}
+			if len(msgs) > 0 {
+				results = append(results, streamResult{streamName, msgs})
+			}
+		}
+		return results, nil
+	})
+	if err == errNoGroup {
+		w.err(err.Error())
+		return
+	}
+	if err != nil {
+		w.err("ERR " + err.Error())
+		return
+	}
+	writeStreamResults(w, results)
+}
+
+// XACK key group id [id ...]
+func (s *Server) xack(w writer, args []string) {
+	if len(args) < 3 {
+		w.err(errWrongArgs("xack"))
+		return
+	}
+	streamName, groupName := args[0], args[1]
+	ids := make([]interface{}, 0, len(args)-2)
+	for _, idArg := range args[2:] {
+		id, _, err := parseID(idArg)
+		if err != nil {
+			w.err(err.Error())
+			return
+		}
+		ids = append(ids, id)
+	}
+	res, err := s.hub.DB().Exec(`
+		DELETE FROM tipubsub_resp_pending
+		WHERE stream_name = ? AND group_name = ? AND id IN (`+placeholders(len(ids))+`)`,
+		append([]interface{}{streamName, groupName}, ids...)...)
+	if err != nil {
+		w.err("ERR " + err.Error())
+		return
+	}
+	n, _ := res.RowsAffected()
+	w.int(n)
+}
+
+// XPENDING key group, only the summary form is supported
+func (s *Server) xpending(w writer, args []string) {
+	if len(args) != 2 {
+		w.err("ERR only the summary form of XPENDING is supported")
+		return
+	}
+	streamName, groupName := args[0], args[1]
+	if err := s.checkGroup(streamName, groupName); err != nil {
+		w.err(err.Error())
+		return
+	}
+	rows, err := s.hub.DB().Query(`
+		SELECT consumer, COUNT(*), MIN(id), MAX(id)
+		FROM tipubsub_resp_pending
+		WHERE stream_name = ? AND group_name = ?
+		GROUP BY consumer
+		ORDER BY consumer`, streamName, groupName)
+	if err != nil {
+		w.err("ERR " + err.Error())
+		return
+	}
+	defer rows.Close()
+	var (
+		names  []string
+		counts []int64
+		total  int64
+	)
+	var minID, maxID int64 = -1, -1
+	for rows.Next() {
+		var (
+			name      string
+			n, lo, hi int64
+		)
+		if err := rows.Scan(&name, &n, &lo, &hi); err != nil {
+			w.err("ERR " + err.Error())
+			return
+		}
+		names, counts = append(names, name), append(counts, n)
+		total += n
+		if minID < 0 || lo < minID {
+			minID = lo
+		}
+		if hi > maxID {
+			maxID = hi
+		}
+	}
+	if err := rows.Err(); err != nil {
+		w.err("ERR " + err.Error())
+		return
+	}
+	if total == 0 {
+		w.array(4)
+		w.int(0)
+		w.nullBulk()
+		w.nullBulk()
+		w.nullArray()
+		return
+	}
+	w.array(4)
+	w.int(total)
+	w.bulk(formatID(minID))
+	w.bulk(formatID(maxID))
+	w.array(len(names))
+	for i, name := range names {
+		w.array(2)
+		w.bulk(name)
+		w.bulk(strconv.FormatInt(counts[i], 10))
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c4pt0r/tipubsub"
+)
+
+// testServers returns two servers sharing a hub on the database of
+// TIPUBSUB_TEST_DSN
+func testServers(t *testing.T) (*Server, *Server, *tipubsub.Hub) {
+	dsn := os.Getenv("TIPUBSUB_TEST_DSN")
+	if dsn == "" {
+		t.Skip("TIPUBSUB_TEST_DSN is not set")
+	}
+	cfg := &tipubsub.Config{DSN: dsn, MaxBatchSize: 10, PollIntervalInMs: 10, GCIntervalInSec: 3600}
+	hub, err := tipubsub.NewHub(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := createPendingTable(hub.DB()); err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(hub, cfg), NewServer(hub, cfg), hub
+}
+
+// do runs a command and returns its raw reply
+func do(s *Server, args ...string) string {
+	var buf bytes.Buffer
+	w := writer{bufio.NewWriter(&buf)}
+	s.handlers[strings.ToUpper(args[0])](w, args[1:])
+	w.Flush()
+	return buf.String()
+}
+
+func TestGroupSharedByServers(t *testing.T) {
+	s1, s2, hub := testServers(t)
+	stream := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	defer hub.DeleteStream(stream)
+	if got := do(s1, "XGROUP", "CREATE", stream, "g", "$", "MKSTREAM"); got != "+OK\r\n" {
+		t.Fatalf("XGROUP CREATE: %q", got)
+	}
+	id1 := strings.TrimSpace(strings.Split(do(s1, "XADD", stream, "*", "f", "a"), "\r\n")[1])
+	do(s1, "XADD", stream, "*", "f", "b")
+
+	// each entry is delivered once whichever server is read
+	got1 := do(s1, "XREADGROUP", "GROUP", "g", "c1", "COUNT", "1", "STREAMS", stream, ">")
+	got2 := do(s2, "XREADGROUP", "GROUP", "g", "c2", "COUNT", "1", "STREAMS", stream, ">")
+	if !strings.Contains(got1, "\r\na\r\n") || !strings.Contains(got2, "\r\nb\r\n") {
+		t.Fatalf("XREADGROUP: got %q and %q", got1, got2)
+	}
+	if got := do(s2, "XPENDING", stream, "g"); !strings.HasPrefix(got, "*4\r\n:2\r\n") {
+		t.Fatalf("XPENDING: %q", got)
+	}
+	// the pending entries of c1 are seen and acked through the other server
+	if got := do(s2, "XREADGROUP", "GROUP", "g", "c1", "STREAMS", stream, "0"); !strings.Contains(got, id1) {
+		t.Fatalf("XREADGROUP 0: %q", got)
+	}
+	if got := do(s2, "XACK", stream, "g", id1); got != ":1\r\n" {
+		t.Fatalf("XACK: %q", got)
+	}
+	if got := do(s1, "XPENDING", stream, "g"); !strings.HasPrefix(got, "*4\r\n:1\r\n") {
+		t.Fatalf("XPENDING after XACK: %q", got)
+	}
+}
+
+func TestXAddChecks(t *testing.T) {
+	s, _, hub := testServers(t)
+	stream := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	defer hub.DeleteStream(stream)
+	if got := do(s, "XADD", stream, "NOMKSTREAM", "*", "f", "a"); got != "$-1\r\n" {
+		t.Fatalf("XADD NOMKSTREAM: %q", got)
+	}
+	if got := do(s, "XADD", stream, "5-0", "f", "a"); !strings.HasPrefix(got, "-ERR") {
+		t.Fatalf("XADD with an id: %q", got)
+	}
+}
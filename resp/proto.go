@@ -0,0 +1,151 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// limits on what clients send, as proto-max-bulk-len and the inline
+// and multibulk limits of Redis
+const (
+	maxArrayLen = 1024 * 1024
+	maxBulkSize = 16 * 1024 * 1024
+	maxLineSize = 64 * 1024
+)
+
+var (
+	errProtocol     = errors.New("ERR Protocol error")
+	errArrayTooLong = errors.New("ERR Protocol error: invalid multibulk length")
+	errBulkTooLarge = errors.New("ERR Protocol error: invalid bulk length")
+	errLineTooLong  = errors.New("ERR Protocol error: too big request")
+)
+
+// readCommand reads a command sent as an array of bulk strings, or as an
+// inline command like redis-cli and telnet do.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 {
+		return nil, errProtocol
+	}
+	if n > maxArrayLen {
+		return nil, errArrayTooLong
+	}
+	// the arguments are not there yet, do not trust n for the capacity
+	args := make([]string, 0, minInt(n, 16))
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errProtocol
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, errProtocol
+		}
+		if size > maxBulkSize {
+			return nil, errBulkTooLarge
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// readLine reads a line of at most maxLineSize bytes
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxLineSize {
+			return "", errLineTooLong
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// writer encodes RESP2 replies
+type writer struct {
+	*bufio.Writer
+}
+
+func (w writer) simple(s string) {
+	fmt.Fprintf(w, "+%s\r\n", s)
+}
+
+func (w writer) err(s string) {
+	fmt.Fprintf(w, "-%s\r\n", s)
+}
+
+func (w writer) int(n int64) {
+	fmt.Fprintf(w, ":%d\r\n", n)
+}
+
+func (w writer) bulk(s string) {
+	fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func (w writer) nullBulk() {
+	w.WriteString("$-1\r\n")
+}
+
+func (w writer) array(n int) {
+	fmt.Fprintf(w, "*%d\r\n", n)
+}
+
+func (w writer) nullArray() {
+	w.WriteString("*-1\r\n")
+}
+
+func (w writer) bulks(ss ...string) {
+	w.array(len(ss))
+	for _, s := range ss {
+		w.bulk(s)
+	}
+}
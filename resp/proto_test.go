@@ -0,0 +1,69 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resp
+
+import (
+	"bufio"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadCommand(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want []string
+	}{
+		{"*3\r\n$4\r\nXADD\r\n$1\r\ns\r\n$0\r\n\r\n", []string{"XADD", "s", ""}},
+		{"*1\r\n$4\r\nPI\nG\r\n", []string{"PI\nG"}},
+		{"PING  hello\r\n", []string{"PING", "hello"}},
+		{"\r\n", nil},
+	} {
+		got, err := readCommand(bufio.NewReader(strings.NewReader(c.in)))
+		if err != nil {
+			t.Fatalf("%q: %v", c.in, err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: got %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestReadCommandErrors(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want error
+	}{
+		{"*x\r\n", errProtocol},
+		{"*-2\r\n", errProtocol},
+		{"*1\r\n+PING\r\n", errProtocol},
+		{"*1\r\n$-1\r\n", errProtocol},
+		{"*2147483647\r\n", errArrayTooLong},
+		{"*1\r\n$9999999999\r\n", errBulkTooLarge},
+		{strings.Repeat("x", maxLineSize+1) + "\r\n", errLineTooLong},
+		{"*2\r\n$4\r\nPING\r\n", io.EOF},
+		{"*1\r\n$4\r\nPI", io.ErrUnexpectedEOF},
+	} {
+		_, err := readCommand(bufio.NewReader(strings.NewReader(c.in)))
+		if err != c.want {
+			in := c.in
+			if len(in) > 20 {
+				in = in[:20] + "..."
+			}
+			t.Errorf("%q: got %v, want %v", in, err, c.want)
+		}
+	}
+}
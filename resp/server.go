@@ -0,0 +1,153 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package resp serves tipubsub streams over the Redis protocol (RESP2) so
+// redis-cli and Redis Streams client libraries work against them.
+//
+// Entry IDs are "<Message.ID>-0" and are assigned by the store, XADD only
+// accepts "*" as ID.
+// Consumer group positions are durable offsets named after the group,
+// pending entries lists are kept in the tipubsub_resp_pending table, so a
+// group can be read and acked through several servers.
+package resp
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/c4pt0r/log"
+	"github.com/c4pt0r/tipubsub"
+)
+
+type handler func(w writer, args []string)
+
+type Server struct {
+	hub          *tipubsub.Hub
+	pollInterval time.Duration
+	maxCount     int
+
+	handlers map[string]handler
+}
+
+func NewServer(hub *tipubsub.Hub, cfg *tipubsub.Config) *Server {
+	s := &Server{
+		hub:          hub,
+		pollInterval: time.Duration(cfg.PollIntervalInMs) * time.Millisecond,
+		maxCount:     cfg.MaxBatchSize,
+	}
+	s.handlers = map[string]handler{
+		"PING":       s.ping,
+		"ECHO":       s.echo,
+		"COMMAND":    s.command,
+		"SELECT":     s.ok,
+		"CLIENT":     s.ok,
+		"XADD":       s.xadd,
+		"XRANGE":     s.xrange,
+		"XREAD":      s.xread,
+		"XLEN":       s.xlen,
+		"XTRIM":      s.xtrim,
+		"XGROUP":     s.xgroup,
+		"XREADGROUP": s.xreadgroup,
+		"XACK":       s.xack,
+		"XPENDING":   s.xpending,
+	}
+	return s
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	if err := createPendingTable(s.hub.DB()); err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Info("resp: listening on", addr)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := writer{bufio.NewWriter(conn)}
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if err != io.EOF {
+				log.Error("resp:", err)
+			}
+			if strings.HasPrefix(err.Error(), errProtocol.Error()) {
+				// like Redis, tell the client before closing
+				w.err(err.Error())
+				w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		name := strings.ToUpper(args[0])
+		if name == "QUIT" {
+			w.simple("OK")
+			w.Flush()
+			return
+		}
+		if h, ok := s.handlers[name]; ok {
+			h(w, args[1:])
+		} else {
+			w.err("ERR unknown command '" + args[0] + "'")
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) ping(w writer, args []string) {
+	if len(args) > 0 {
+		w.bulk(args[0])
+		return
+	}
+	w.simple("PONG")
+}
+
+func (s *Server) echo(w writer, args []string) {
+	if len(args) != 1 {
+		w.err(errWrongArgs("echo"))
+		return
+	}
+	w.bulk(args[0])
+}
+
+// command replies an empty command table, it is enough for redis-cli
+func (s *Server) command(w writer, args []string) {
+	w.array(0)
+}
+
+func (s *Server) ok(w writer, args []string) {
+	w.simple("OK")
+}
+
+func errWrongArgs(cmd string) string {
+	return "ERR wrong number of arguments for '" + cmd + "' command"
+}
@@ -0,0 +1,507 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/c4pt0r/tipubsub"
+)
+
+// dataField is the field name of messages which are not published as a
+// field-value list, XADD with only this field stores the value as is.
+const dataField = "data"
+
+var errInvalidID = errors.New("ERR Invalid stream ID specified as stream command argument")
+
+func formatID(id int64) string {
+	return strconv.FormatInt(id, 10) + "-0"
+}
+
+// parseID parses "<id>" or "<id>-<seq>", returns the id and seq.
+func parseID(s string) (int64, int64, error) {
+	idPart, seqPart := s, ""
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		idPart, seqPart = s[:i], s[i+1:]
+	}
+	id, err := strconv.ParseInt(idPart, 10, 64)
+	if err != nil || id < 0 {
+		return 0, 0, errInvalidID
+	}
+	var seq int64
+	if seqPart != "" {
+		seq, err = strconv.ParseInt(seqPart, 10, 64)
+		if err != nil || seq < 0 {
+			return 0, 0, errInvalidID
+		}
+	}
+	return id, seq, nil
+}
+
+// parseRangeStart returns the smallest id included by a range start
+func parseRangeStart(s string) (int64, error) {
+	if s == "-" {
+		return 0, nil
+	}
+	exclusive := strings.HasPrefix(s, "(")
+	id, seq, err := parseID(strings.TrimPrefix(s, "("))
+	if err != nil {
+		return 0, err
+	}
+	// all our entries have seq 0
+	if exclusive || seq > 0 {
+		id++
+	}
+	return id, nil
+}
+
+// parseRangeEnd returns the largest id included by a range end
+func parseRangeEnd(s string) (int64, error) {
+	if s == "+" {
+		return math.MaxInt64, nil
+	}
+	exclusive := strings.HasPrefix(s, "(")
+	id, _, err := parseID(strings.TrimPrefix(s, "("))
+	if err != nil {
+		return 0, err
+	}
+	if exclusive {
+		id--
+	}
+	return id, nil
+}
+
+// encodeFields stores field-value pairs as a JSON object keeping their order
+func encodeFields(fields []string) string {
+	if len(fields) == 2 && fields[0] == dataField {
+		return fields[1]
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(fields[i])
+		v, _ := json.Marshal(fields[i+1])
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+// decodeFields is the reverse of encodeFields, data which is not a JSON
+// object of strings is returned as the single field "data"
+func decodeFields(data string) []string {
+	raw := []string{dataField, data}
+	dec := json.NewDecoder(strings.NewReader(data))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return raw
+	}
+	var fields []string
+	for dec.More() {
+		k, err := dec.Token()
+		if err != nil {
+			return raw
+		}
+		v, err := dec.Token()
+		if err != nil {
+			return raw
+		}
+		ks, ok1 := k.(string)
+		vs, ok2 := v.(string)
+		if !ok1 || !ok2 {
+			return raw
+		}
+		fields = append(fields, ks, vs)
+	}
+	if t, err := dec.Token(); err != nil || t != json.Delim('}') {
+		return raw
+	}
+	return fields
+}
+
+func writeEntries(w writer, msgs []tipubsub.Message) {
+	w.array(len(msgs))
+	for _, msg := range msgs {
+		w.array(2)
+		w.bulk(formatID(msg.ID))
+		w.bulks(decodeFields(msg.Data)...)
+	}
+}
+
+// trimOption is the MAXLEN|MINID [=|~] threshold [LIMIT count] option of
+// XADD and XTRIM, the approximation flag and LIMIT are accepted and ignored.
+type trimOption struct {
+	strategy  string
+	threshold string
+}
+
+// parseTrimOption parses the option at args[0], returns the number of
+// consumed arguments
+func parseTrimOption(args []string) (*trimOption, int, error) {
+	if len(args) < 2 {
+		return nil, 0, errors.New("ERR syntax error")
+	}
+	opt := &trimOption{strategy: strings.ToUpper(args[0])}
+	i := 1
+	if args[i] == "=" || args[i] == "~" {
+		i++
+	}
+	if i >= len(args) {
+		return nil, 0, errors.New("ERR syntax error")
+	}
+	opt.threshold = args[i]
+	i++
+	if i+1 < len(args) && strings.ToUpper(args[i]) == "LIMIT" {
+		i += 2
+	}
+	return opt, i, nil
+}
+
+func (s *Server) trim(streamName string, opt *trimOption) (int64, error) {
+	var (
+		deleted int64
+		err     error
+	)
+	switch opt.strategy {
+	case "MAXLEN":
+		n, perr := strconv.Atoi(opt.threshold)
+		if perr != nil || n < 0 {
+			return 0, errors.New("ERR The MAXLEN argument must be >= 0.")
+		}
+		deleted, err = s.hub.TrimStream(streamName, n)
+	case "MINID":
+		id, _, perr := parseID(opt.threshold)
+		if perr != nil {
+			return 0, perr
+		}
+		deleted, err = s.hub.TrimStreamBefore(streamName, id)
+	default:
+		return 0, errors.New("ERR syntax error")
+	}
+	if err != nil {
+		return 0, errors.New("ERR " + err.Error())
+	}
+	return deleted, nil
+}
+
+// XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold [LIMIT count]] * field value [field value ...]
+func (s *Server) xadd(w writer, args []string) {
+	if len(args) < 4 {
+		w.err(errWrongArgs("xadd"))
+		return
+	}
+	streamName := args[0]
+	args = args[1:]
+	var opt *trimOption
+	noMkStream := false
+	for len(args) > 0 {
+		switch strings.ToUpper(args[0]) {
+		case "NOMKSTREAM":
+			noMkStream = true
+			args = args[1:]
+			continue
+		case "MAXLEN", "MINID":
+			o, n, err := parseTrimOption(args)
+			if err != nil {
+				w.err(err.Error())
+				return
+			}
+			opt = o
+			args = args[n:]
+			continue
+		}
+		break
+	}
+	if len(args) < 3 || len(args)%2 != 1 {
+		w.err(errWrongArgs("xadd"))
+		return
+	}
+	// the store assigns the ids
+	if args[0] != "*" {
+		w.err("ERR only * is supported as the ID of XADD")
+		return
+	}
+	if noMkStream {
+		ok, err := s.hub.StreamExists(streamName)
+		if err != nil {
+			w.err("ERR " + err.Error())
+			return
+		}
+		if !ok {
+			w.nullBulk()
+			return
+		}
+	}
+	msg := &tipubsub.Message{
+		Data: encodeFields(args[1:]),
+	}
+	if err := s.hub.PublishSync(streamName, msg); err != nil {
+		w.err("ERR " + err.Error())
+		return
+	}
+	if opt != nil {
+		if _, err := s.trim(streamName, opt); err != nil {
+			w.err(err.Error())
+			return
+		}
+	}
+	w.bulk(formatID(msg.ID))
+}
+
+// rangeMessages returns at most count messages with start <= id <= end
+func (s *Server) rangeMessages(streamName string, start, end int64, count int) ([]tipubsub.Message, error) {
+	var ret []tipubsub.Message
+	offset := tipubsub.Offset(start - 1)
+	for count < 0 || len(ret) < count {
+		limit := s.maxCount
+		if count >= 0 && count-len(ret) < limit {
+			limit = count - len(ret)
+		}
+		msgs, max, err := s.hub.FetchMessages(streamName, offset, limit)
+		if err != nil {
+			return nil, err
+		}
+		if len(msgs) == 0 {
+			break
+		}
+		for _, msg := range msgs {
+			if msg.ID > end {
+				return ret, nil
+			}
+			ret = append(ret, msg)
+		}
+		offset = max
+	}
+	return ret, nil
+}
+
+// XRANGE key start end [COUNT count]
+func (s *Server) xrange(w writer, args []string) {
+	if len(args) != 3 && len(args) != 5 {
+		w.err(errWrongArgs("xrange"))
+		return
+	}
+	start, err := parseRangeStart(args[1])
+	if err != nil {
+		w.err(err.Error())
+		return
+	}
+	end, err := parseRangeEnd(args[2])
+	if err != nil {
+		w.err(err.Error())
+		return
+	}
+	count := -1
+	if len(args) == 5 {
+		if strings.ToUpper(args[3]) != "COUNT" {
+			w.err("ERR syntax error")
+			return
+		}
+		count, err = strconv.Atoi(args[4])
+		if err != nil || count < 0 {
+			w.err("ERR value is not an integer or out of range")
+			return
+		}
+	}
+	if count == 0 || start > end {
+		w.array(0)
+		return
+	}
+	msgs, err := s.rangeMessages(args[0], start, end, count)
+	if err != nil {
+		w.err("ERR " + err.Error())
+		return
+	}
+	writeEntries(w, msgs)
+}
+
+// readOptions is the common part of XREAD and XREADGROUP
+type readOptions struct {
+	count   int
+	block   time.Duration
+	noAck   bool
+	streams []string
+	ids     []string
+}
+
+func parseReadOptions(args []string, allowNoAck bool) (*readOptions, error) {
+	opts := &readOptions{count: -1, block: -1}
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COUNT", "BLOCK":
+			if i+1 >= len(args) {
+				return nil, errors.New("ERR syntax error")
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 0 {
+				return nil, errors.New("ERR value is not an integer or out of range")
+			}
+			if strings.ToUpper(args[i]) == "COUNT" {
+				opts.count = n
+			} else {
+				opts.block = time.Duration(n) * time.Millisecond
+			}
+			i++
+		case "NOACK":
+			if !allowNoAck {
+				return nil, errors.New("ERR syntax error")
+			}
+			opts.noAck = true
+		case "STREAMS":
+			rest := args[i+1:]
+			if len(rest) == 0 || len(rest)%2 != 0 {
+				return nil, errors.New("ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.")
+			}
+			opts.streams = rest[:len(rest)/2]
+			opts.ids = rest[len(rest)/2:]
+			return opts, nil
+		default:
+			return nil, errors.New("ERR syntax error")
+		}
+	}
+	return nil, errors.New("ERR syntax error")
+}
+
+// streamResult is the messages of one stream in a XREAD reply
+type streamResult struct {
+	streamName string
+	msgs       []tipubsub.Message
+}
+
+func writeStreamResults(w writer, results []streamResult) {
+	if len(results) == 0 {
+		w.nullArray()
+		return
+	}
+	w.array(len(results))
+	for _, r := range results {
+		w.array(2)
+		w.bulk(r.streamName)
+		writeEntries(w, r.msgs)
+	}
+}
+
+// blockUntil calls read until it returns results or the block timeout is
+// reached, a negative block means no blocking and 0 blocks forever
+func (s *Server) blockUntil(block time.Duration, read func() ([]streamResult, error)) ([]streamResult, error) {
+	deadline := time.Now().Add(block)
+	for {
+		results, err := read()
+		if err != nil || len(results) > 0 || block < 0 {
+			return results, err
+		}
+		if block > 0 && time.Now().After(deadline) {
+			return nil, nil
+		}
+		time.Sleep(s.pollInterval)
+	}
+}
+
+// XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
+func (s *Server) xread(w writer, args []string) {
+	opts, err := parseReadOptions(args, false)
+	if err != nil {
+		w.err(err.Error())
+		return
+	}
+	offsets := make([]tipubsub.Offset, len(opts.streams))
+	for i, idArg := range opts.ids {
+		if idArg == "$" {
+			_, max, err := s.hub.MinMaxID(opts.streams[i])
+			if err != nil {
+				w.err("ERR " + err.Error())
+				return
+			}
+			offsets[i] = tipubsub.Offset(max)
+			continue
+		}
+		id, seq, err := parseID(idArg)
+		if err != nil {
+			w.err(err.Error())
+			return
+		}
+		// entries after <id>-<seq>, seq > 0 skips <id>-0 too
+		if seq > 0 {
+			id++
+		}
+		offsets[i] = tipubsub.Offset(id)
+	}
+	limit := opts.count
+	if limit <= 0 || limit > s.maxCount {
+		limit = s.maxCount
+	}
+	results, err := s.blockUntil(opts.block, func() ([]streamResult, error) {
+		var results []streamResult
+		for i, streamName := range opts.streams {
+			msgs, _, err := s.hub.FetchMessages(streamName, offsets[i], limit)
+			if err != nil {
+				return nil, err
+			}
+			if len(msgs) > 0 {
+				results = append(results, streamResult{streamName, msgs})
+			}
+		}
+		return results, nil
+	})
+	if err != nil {
+		w.err("ERR " + err.Error())
+		return
+	}
+	writeStreamResults(w, results)
+}
+
+// XLEN key
+func (s *Server) xlen(w writer, args []string) {
+	if len(args) != 1 {
+		w.err(errWrongArgs("xlen"))
+		return
+	}
+	n, err := s.hub.StreamLen(args[0])
+	if err != nil {
+		// missing streams are empty like in redis
+		w.int(0)
+		return
+	}
+	w.int(n)
+}
+
+// XTRIM key MAXLEN|MINID [=|~] threshold [LIMIT count]
+func (s *Server) xtrim(w writer, args []string) {
+	if len(args) < 3 {
+		w.err(errWrongArgs("xtrim"))
+		return
+	}
+	opt, n, err := parseTrimOption(args[1:])
+	if err != nil || n != len(args)-1 {
+		w.err("ERR syntax error")
+		return
+	}
+	deleted, err := s.trim(args[0], opt)
+	if err != nil {
+		w.err(err.Error())
+		return
+	}
+	w.int(deleted)
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"time"
+
+	"github.com/c4pt0r/log"
+)
+
+// maxStreamsPerPoll bounds the number of streams in one UNION query of
+// the shared poller
+const maxStreamsPerPoll = 256
+
+// sharedPoll checks the max id of all the streams with a poll worker in
+// one query per maxStreamsPerPoll streams and wakes the workers of the
+// streams that moved, so idle streams cost no query of their own
+func (m *Hub) sharedPoll() {
+	interval := time.Duration(m.cfg.SharedPollIntervalInMs) * time.Millisecond
+	failing := map[string]bool{}
+	for {
+		time.Sleep(interval)
+		m.sharedPollOnce(failing)
+	}
+}
+
+// sharedPollOnce is a round of sharedPoll, failing are the streams whose
+// query failed, e.g. dropped by another hub, they are checked one by one
+// until they work again so they do not fail the query of the others
+func (m *Hub) sharedPollOnce(failing map[string]bool) {
+	m.mu.RLock()
+	workers := make(map[string]*PollWorker, len(m.pollWorkers))
+	names := make([]string, 0, len(m.pollWorkers))
+	for name, pw := range m.pollWorkers {
+		workers[name] = pw
+		if !failing[name] {
+			names = append(names, name)
+		}
+	}
+	m.mu.RUnlock()
+	for name := range failing {
+		if workers[name] == nil {
+			delete(failing, name)
+			continue
+		}
+		if maxIDs, err := m.store.MaxIDs([]string{name}); err == nil {
+			delete(failing, name)
+			wakeMoved(workers, maxIDs)
+		}
+	}
+	for len(names) > 0 {
+		n := len(names)
+		if n > maxStreamsPerPoll {
+			n = maxStreamsPerPoll
+		}
+		batch := names[:n]
+		names = names[n:]
+		maxIDs, err := m.store.MaxIDs(batch)
+		if err == nil {
+			wakeMoved(workers, maxIDs)
+			continue
+		}
+		// find the streams failing the query
+		log.Error("shared poll:", err)
+		for _, name := range batch {
+			maxIDs, err := m.store.MaxIDs([]string{name})
+			if err != nil {
+				log.Error("shared poll:", name, err)
+				failing[name] = true
+				continue
+			}
+			wakeMoved(workers, maxIDs)
+		}
+	}
+}
+
+// wakeMoved wakes the workers of the streams with messages after their
+// last polled one
+func wakeMoved(workers map[string]*PollWorker, maxIDs map[string]int64) {
+	for name, maxID := range maxIDs {
+		if pw := workers[name]; pw != nil && Offset(maxID) > pw.lastOffset() {
+			pw.wake()
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"testing"
+)
+
+func testWorker() *PollWorker {
+	return &PollWorker{wakeCh: make(chan struct{}, 1)}
+}
+
+func woken(pw *PollWorker) bool {
+	select {
+	case <-pw.wakeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestSharedPollWakesMovedStreams(t *testing.T) {
+	store := newFakeStore()
+	store.put("a", "1")
+	m := &Hub{store: store, pollWorkers: map[string]*PollWorker{"a": testWorker(), "b": testWorker()}}
+	m.sharedPollOnce(map[string]bool{})
+	if !woken(m.pollWorkers["a"]) || woken(m.pollWorkers["b"]) {
+		t.Error("only a should be woken")
+	}
+	if store.maxIDQueries != 1 {
+		t.Errorf("%d queries, want 1", store.maxIDQueries)
+	}
+}
+
+func TestSharedPollIsolatesFailingStreams(t *testing.T) {
+	store := newFakeStore()
+	store.put("a", "1")
+	store.missing = map[string]bool{"gone": true}
+	m := &Hub{store: store, pollWorkers: map[string]*PollWorker{
+		"a": testWorker(), "b": testWorker(), "gone": testWorker(),
+	}}
+	failing := map[string]bool{}
+	m.sharedPollOnce(failing)
+	if !failing["gone"] || len(failing) != 1 {
+		t.Fatalf("failing %v", failing)
+	}
+	if !woken(m.pollWorkers["a"]) || woken(m.pollWorkers["b"]) || woken(m.pollWorkers["gone"]) {
+		t.Error("only a should be woken")
+	}
+	// then the others are checked in one query and the failing one alone
+	store.put("b", "1")
+	store.maxIDQueries = 0
+	m.sharedPollOnce(failing)
+	if store.maxIDQueries != 2 {
+		t.Errorf("%d queries, want 2", store.maxIDQueries)
+	}
+	if !woken(m.pollWorkers["b"]) || woken(m.pollWorkers["gone"]) {
+		t.Error("only b should be woken")
+	}
+	// it is back in the shared query once it works again
+	delete(store.missing, "gone")
+	m.sharedPollOnce(failing)
+	if len(failing) != 0 {
+		t.Errorf("failing %v", failing)
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/c4pt0r/log"
+)
+
+// spillReadBatch is the number of spilled messages read back at once
+const spillReadBatch = 100
+
+// spillFile keeps the messages which did not fit in the queue of a stream
+// writer on disk, they are queued again in order when the writer catches
+// up. A file left by a crashed hub is queued again when the stream opens.
+type spillFile struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	w    MessageWriter
+	// readOff and writeOff are the bytes read back and written
+	readOff  int64
+	writeOff int64
+	// count is the number of messages on disk not queued yet
+	count int64
+	wake  chan struct{}
+	quit  chan struct{}
+	done  chan struct{}
+}
+
+// countingWriter counts the bytes appended to the spill file
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+func openSpillFile(path string) (*spillFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	sf := &spillFile{
+		path: path,
+		f:    f,
+		wake: make(chan struct{}, 1),
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	// count the messages left by a previous run
+	r, err := NewMessageReader(f, FormatNDJSON)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	for {
+		if _, err := r.Read(); err == io.EOF {
+			break
+		} else if err != nil {
+			f.Close()
+			return nil, err
+		}
+		sf.count++
+	}
+	// cut an interrupted write
+	sf.writeOff = r.Offset()
+	if err := f.Truncate(sf.writeOff); err != nil {
+		f.Close()
+		return nil, err
+	}
+	sf.w, _ = NewMessageWriter(countingWriter{f, &sf.writeOff}, FormatNDJSON, false)
+	if sf.count > 0 {
+		log.Warn("pub: queueing", sf.count, "spilled messages of", path)
+		sf.wake <- struct{}{}
+	}
+	return sf, nil
+}
+
+// publish queues m if nothing is spilled and the queue has room, it
+// appends m to the file otherwise so the order of messages is kept
+func (sf *spillFile) publish(mq chan *Message, m *Message) error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if sf.count == 0 {
+		select {
+		case mq <- m:
+			return nil
+		default:
+		}
+	}
+	if err := sf.w.Write(m); err != nil {
+		return err
+	}
+	if err := sf.w.Flush(); err != nil {
+		return err
+	}
+	sf.count++
+	select {
+	case sf.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (sf *spillFile) len() int64 {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	return sf.count
+}
+
+// read returns the next spilled messages and the bytes they use
+func (sf *spillFile) read() ([]*Message, int64, error) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if sf.count == 0 {
+		// start over to keep the file small
+		sf.readOff, sf.writeOff = 0, 0
+		return nil, 0, sf.f.Truncate(0)
+	}
+	r, _ := NewMessageReader(io.NewSectionReader(sf.f, sf.readOff, sf.writeOff-sf.readOff), FormatNDJSON)
+	var msgs []*Message
+	for len(msgs) < spillReadBatch {
+		m, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, r.Offset(), nil
+}
+
+// run queues the spilled messages to mq until stop is called
+func (sf *spillFile) run(mq chan *Message) {
+	defer close(sf.done)
+	for {
+		msgs, n, err := sf.read()
+		if err != nil {
+			log.Error("pub: read spill file", sf.path, err)
+		}
+		if len(msgs) == 0 {
+			select {
+			case <-sf.wake:
+				continue
+			case <-sf.quit:
+				return
+			}
+		}
+		for _, m := range msgs {
+			mq <- m
+		}
+		sf.mu.Lock()
+		sf.readOff += n
+		sf.count -= int64(len(msgs))
+		sf.mu.Unlock()
+	}
+}
+
+// stop waits for all the spilled messages to be queued and removes the
+// file. The messages not read back, e.g. after a read error, are kept in
+// it to be queued again when the stream opens.
+func (sf *spillFile) stop() {
+	close(sf.quit)
+	<-sf.done
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if sf.readOff >= sf.writeOff {
+		sf.f.Close()
+		os.Remove(sf.path)
+		return
+	}
+	log.Warn("pub: keeping", sf.count, "spilled messages in", sf.path)
+	if err := sf.dropRead(); err != nil {
+		log.Error("pub: spill file", sf.path, err)
+	}
+	sf.f.Close()
+}
+
+// dropRead removes the messages queued already from the file, they would
+// be queued twice otherwise
+func (sf *spillFile) dropRead() error {
+	if sf.readOff == 0 {
+		return nil
+	}
+	tmp := sf.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, io.NewSectionReader(sf.f, sf.readOff, sf.writeOff-sf.readOff))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, sf.path)
+}
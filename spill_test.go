@@ -0,0 +1,65 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// spill writes msgs to sf, nobody receives from the queue
+func spill(t *testing.T, sf *spillFile, data ...string) {
+	mq := make(chan *Message)
+	for _, d := range data {
+		if err := sf.publish(mq, &Message{Data: d}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSpillFileStopKeepsUnread(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s.spill")
+	sf, err := openSpillFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spill(t, sf, "a")
+	queued := sf.writeOff
+	spill(t, sf, "b", "c")
+	// the stream closes after queueing a, run has returned
+	sf.readOff, sf.count = queued, 2
+	close(sf.done)
+	sf.stop()
+
+	if sf, err = openSpillFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if sf.count != 2 {
+		t.Fatalf("%d messages kept, want 2", sf.count)
+	}
+	msgs, _, err := sf.read()
+	if err != nil || len(msgs) != 2 || msgs[0].Data != "b" || msgs[1].Data != "c" {
+		t.Fatalf("got %v %v", msgs, err)
+	}
+
+	// everything was queued, the file is removed
+	sf.readOff = sf.writeOff
+	close(sf.done)
+	sf.stop()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("spill file still there: %v", err)
+	}
+}
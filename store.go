@@ -16,7 +16,11 @@ package tipubsub
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -28,14 +32,57 @@ type Store interface {
 	Init() error
 	// CreateStream creates a stream
 	CreateStream(streamName string) error
+	// CreateStreamWithLayout creates a stream with a table layout, an existing stream keeps its layout
+	CreateStreamWithLayout(streamName string, layout StreamLayout) error
+	// DeleteStream drops a stream with its messages and durable offsets
+	DeleteStream(streamName string) error
+	// RenameStream renames a stream, its durable offsets move with it
+	RenameStream(oldName string, newName string) error
+	// DescribeStream returns the statistics of a stream
+	DescribeStream(streamName string) (*StreamInfo, error)
 	// PutMessages puts messages into a stream
 	PutMessages(streamName string, messages []*Message) error
+	// PutMessagesTx puts messages into a stream in the transaction of the caller
+	PutMessagesTx(txn *sql.Tx, streamName string, messages []*Message) error
+	// PutMessagesWithID puts messages keeping their IDs, messages whose ID exists are skipped
+	PutMessagesWithID(streamName string, messages []*Message) error
 	// FetchMessages fetches messages from a stream
 	FetchMessages(streamName string, offset Offset, limit int) ([]Message, Offset, error)
+	// FetchMessagesFiltered fetches messages matching the SQL part of filter, use Filter.Match for the rest
+	FetchMessagesFiltered(streamName string, offset Offset, limit int, filter *Filter) ([]Message, Offset, error)
 	// MinMaxID returns the min, max offset of a stream
 	MinMaxID(streamName string) (int64, int64, error)
+	// IDStep returns the difference between consecutive ids of a stream
+	IDStep(streamName string) (int64, error)
+	// MaxIDs returns the max offset of every stream of streamNames in a single query
+	MaxIDs(streamNames []string) (map[string]int64, error)
+	// CountMessages returns the number of messages in a stream
+	CountMessages(streamName string) (int64, error)
 	// GetStreamNames returns the names of all streams
 	GetStreamNames() ([]string, error)
+	// StreamExists tells if a stream has been created
+	StreamExists(streamName string) (bool, error)
+	// StreamTableName returns the table holding the messages of a stream
+	StreamTableName(streamName string) (string, error)
+	// CommitOffset saves the offset a consumer has processed a stream up to
+	CommitOffset(streamName string, consumerID string, offset Offset) error
+	// GetCommittedOffset returns the saved offset of a consumer, LatestId if there is none
+	GetCommittedOffset(streamName string, consumerID string) (Offset, error)
+	// CommitOffsetTx saves the offset of a consumer in the transaction of the caller
+	CommitOffsetTx(txn *sql.Tx, streamName string, consumerID string, offset Offset) error
+	// InitCommittedOffset saves offset for a consumer without saved offset and returns the saved one
+	InitCommittedOffset(streamName string, consumerID string, offset Offset) (Offset, error)
+	// LockCommittedOffset returns the saved offset of a consumer and locks it until txn ends
+	LockCommittedOffset(txn *sql.Tx, streamName string, consumerID string) (Offset, error)
+	// DeleteCommittedOffset removes the saved offset of a consumer
+	DeleteCommittedOffset(streamName string, consumerID string) error
+	// DeliverDelayed moves at most limit delayed messages due at now to their streams, it returns how many
+	// and calls written, if not nil, with the messages of every stream once they are committed
+	DeliverDelayed(now int64, limit int, written func(streamName string, msgs []*Message)) (int, error)
+	// BumpWatermark moves the watermark of a stream to maxID if it is lower
+	BumpWatermark(streamName string, maxID int64) error
+	// GetWatermarks returns the last id written to every stream
+	GetWatermarks() (map[string]int64, error)
 	// DB returns the underlying database
 	DB() *sql.DB
 }
@@ -48,25 +95,298 @@ func OpenStore(dsn string) (Store, error) {
 	return s, nil
 }
 
+// OpenStoreWithConfig opens the store of cfg.DSN tuned by cfg
+func OpenStoreWithConfig(cfg *Config) (Store, error) {
+	s := NewTiDBStore(cfg.DSN)
+	s.SetInsertRowsPerStmt(cfg.InsertRowsPerStmt)
+	if err := s.Init(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// StreamInfo is the result of DescribeStream
+type StreamInfo struct {
+	Name string `json:"name"`
+	// TableName is the stream table, derived from the stream name
+	TableName string `json:"table_name"`
+	Count     int64  `json:"count"`
+	MinID     int64  `json:"min_id"`
+	MaxID     int64  `json:"max_id"`
+	OldestTs  int64  `json:"oldest_ts"`
+	NewestTs  int64  `json:"newest_ts"`
+	// TableSize is the estimated size in bytes of the stream table
+	TableSize int64 `json:"table_size"`
+	// Schema is the CREATE TABLE statement of the stream table
+	Schema string `json:"schema"`
+	// Subscribers is the number of subscribers attached to this hub
+	Subscribers int `json:"subscribers"`
+	// Layout is the table layout of the stream
+	Layout StreamLayout `json:"layout"`
+	// Delayed is the number of messages waiting for their delivery time
+	Delayed int64 `json:"delayed"`
+}
+
+const (
+	defaultInsertRowsPerStmt = 256
+	// maxInsertStmtBytes keeps a multi-row INSERT well under max_allowed_packet
+	maxInsertStmtBytes = 4 * 1024 * 1024
+	// maxSeqIDsPerStmt keeps the recursive CTE of nextIDsSQL under the
+	// default cte_max_recursion_depth of 1000
+	maxSeqIDsPerStmt = 1000
+)
+
 type TiDBStore struct {
 	dsn string
 	db  *sql.DB
+
+	insertRowsPerStmt int
+	// prepared multi-row INSERTs, key is table name and number of rows
+	stmtMu sync.Mutex
+	stmts  map[insertStmtKey]*sql.Stmt
+
+	// rows of the streams read from tipubsub_meta
+	metaMu sync.RWMutex
+	metas  map[string]streamMeta
 }
 
-func getStreamTblName(streamName string) string {
-	return fmt.Sprintf("tipubsub_stream_%s", streamName)
+// streamMeta is the row of a stream in tipubsub_meta
+type streamMeta struct {
+	layout StreamLayout
+	// tblName is the table holding the messages
+	tblName string
 }
 
-func (s *TiDBStore) getMetaTblName(streamName string) string {
-	return fmt.Sprintf("tipubsub_meta_%s", streamName)
+type insertStmtKey struct {
+	tblName string
+	rows    int
 }
 
 func NewTiDBStore(dsn string) *TiDBStore {
 	return &TiDBStore{
-		dsn: dsn,
+		dsn:               dsn,
+		insertRowsPerStmt: defaultInsertRowsPerStmt,
+		stmts:             map[insertStmtKey]*sql.Stmt{},
+		metas:             map[string]streamMeta{},
+	}
+}
+
+// SetInsertRowsPerStmt sets the max number of rows of a multi-row INSERT,
+// 1 inserts row by row
+func (s *TiDBStore) SetInsertRowsPerStmt(n int) {
+	if n <= 0 {
+		n = defaultInsertRowsPerStmt
+	}
+	s.insertRowsPerStmt = n
+}
+
+// cachedStmt returns the prepared statement of key, build makes its SQL
+func (s *TiDBStore) cachedStmt(key insertStmtKey, build func() string) (*sql.Stmt, error) {
+	s.stmtMu.Lock()
+	defer s.stmtMu.Unlock()
+	if stmt, ok := s.stmts[key]; ok {
+		return stmt, nil
+	}
+	stmt, err := s.db.Prepare(build())
+	if err != nil {
+		return nil, err
+	}
+	s.stmts[key] = stmt
+	return stmt, nil
+}
+
+// messageColumns are the columns of a message besides id, in the order of
+// messageArgs
+const (
+	messageColumns    = "ts, data, dedup_key, deliver_at, expire_at, headers"
+	numMessageColumns = 6
+)
+
+func messageArgs(msg *Message) []interface{} {
+	return []interface{}{msg.Ts, msg.Data, dedupKeyArg(msg), nullInt64(msg.DeliverAt), nullInt64(msg.ExpireAt), headersArg(msg)}
+}
+
+// headersArg stores no headers as NULL
+func headersArg(msg *Message) sql.NullString {
+	if len(msg.Headers) == 0 {
+		return sql.NullString{}
+	}
+	b, _ := json.Marshal(msg.Headers)
+	return sql.NullString{String: string(b), Valid: true}
+}
+
+func scanHeaders(s sql.NullString) (map[string]string, error) {
+	if !s.Valid {
+		return nil, nil
+	}
+	var headers map[string]string
+	err := json.Unmarshal([]byte(s.String), &headers)
+	return headers, err
+}
+
+// nullInt64 stores 0 as NULL
+func nullInt64(v int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: v, Valid: v != 0}
+}
+
+// streamColumnMigrations add the columns missing in the tables of streams
+// created by older versions
+var streamColumnMigrations = []string{
+	`ALTER TABLE %s ADD COLUMN IF NOT EXISTS dedup_key VARCHAR(255)`,
+	`ALTER TABLE %s ADD UNIQUE INDEX IF NOT EXISTS dedup_key (dedup_key)`,
+	`ALTER TABLE %s ADD COLUMN IF NOT EXISTS deliver_at BIGINT`,
+	`ALTER TABLE %s ADD COLUMN IF NOT EXISTS expire_at BIGINT`,
+	`ALTER TABLE %s ADD INDEX IF NOT EXISTS expire_at (expire_at)`,
+	`ALTER TABLE %s ADD COLUMN IF NOT EXISTS headers JSON`,
+}
+
+// insertSQL returns the key and builder of the INSERT of rows messages
+// into tblName, withID inserts the ids too
+func insertSQL(tblName string, rows int, withID bool) (insertStmtKey, func() string) {
+	return insertStmtKey{tblName, rows}, func() string {
+		var b strings.Builder
+		columns, n := messageColumns, numMessageColumns
+		if withID {
+			columns, n = "id, "+columns, n+1
+		}
+		fmt.Fprintf(&b, "INSERT INTO %s (%s) VALUES ", quoteIdent(tblName), columns)
+		row := "(?" + strings.Repeat(", ?", n-1) + ")"
+		for i := 0; i < rows; i++ {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(row)
+		}
+		return b.String()
 	}
 }
 
+// idsExistSQL returns the key and builder of the query counting the rows
+// of rows ids, its key has negative rows not to clash with insertSQL
+func idsExistSQL(tblName string, rows int) (insertStmtKey, func() string) {
+	return insertStmtKey{tblName, -rows}, func() string {
+		return fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE id IN (?%s)`,
+			quoteIdent(tblName), strings.Repeat(", ?", rows-1))
+	}
+}
+
+// nextIDsSQL returns the key and builder of the query allocating ? ids
+// from the sequence of the auto_random stream table tblName
+func nextIDsSQL(tblName string) (insertStmtKey, func() string) {
+	seqName := getStreamSeqName(tblName)
+	return insertStmtKey{seqName, 0}, func() string {
+		return fmt.Sprintf(`
+			WITH RECURSIVE r (n) AS (
+				SELECT 1 UNION ALL SELECT n + 1 FROM r WHERE n < ?
+			)
+			SELECT NEXTVAL(%s) FROM r`, quoteIdent(seqName))
+	}
+}
+
+// storeTx runs the statements of a batch in txn, they are prepared and
+// cached when txn belongs to the db of the store
+type storeTx struct {
+	s      *TiDBStore
+	txn    *sql.Tx
+	cached bool
+}
+
+func (t storeTx) exec(key insertStmtKey, build func() string, args ...interface{}) (sql.Result, error) {
+	if !t.cached {
+		return t.txn.Exec(build(), args...)
+	}
+	stmt, err := t.s.cachedStmt(key, build)
+	if err != nil {
+		return nil, err
+	}
+	return t.txn.Stmt(stmt).Exec(args...)
+}
+
+func (t storeTx) query(key insertStmtKey, build func() string, args ...interface{}) (*sql.Rows, error) {
+	if !t.cached {
+		return t.txn.Query(build(), args...)
+	}
+	stmt, err := t.s.cachedStmt(key, build)
+	if err != nil {
+		return nil, err
+	}
+	return t.txn.Stmt(stmt).Query(args...)
+}
+
+// dropStmts closes the cached statements of a stream table which is gone
+func (s *TiDBStore) dropStmts(tblName string) {
+	seqName := getStreamSeqName(tblName)
+	s.stmtMu.Lock()
+	defer s.stmtMu.Unlock()
+	for key, stmt := range s.stmts {
+		if key.tblName == tblName || key.tblName == seqName {
+			stmt.Close()
+			delete(s.stmts, key)
+		}
+	}
+}
+
+// streamMeta returns the row of a stream in tipubsub_meta, ok is false if
+// the stream does not exist and the meta is the one it would be created
+// with. Rows without layout or table use LayoutAutoIncrement and the table
+// derived from the name, which is how the first versions named them.
+func (s *TiDBStore) streamMeta(streamName string) (meta streamMeta, ok bool, err error) {
+	s.metaMu.RLock()
+	meta, ok = s.metas[streamName]
+	s.metaMu.RUnlock()
+	if ok {
+		return meta, true, nil
+	}
+	meta = streamMeta{layout: LayoutAutoIncrement, tblName: getStreamTblName(streamName)}
+	var layout, tblName sql.NullString
+	err = s.db.QueryRow(`SELECT layout, table_name FROM tipubsub_meta WHERE stream_name = ?`, streamName).Scan(&layout, &tblName)
+	if err == sql.ErrNoRows {
+		return meta, false, nil
+	}
+	if err != nil {
+		return meta, false, err
+	}
+	if meta.layout, err = ParseStreamLayout(layout.String); err != nil {
+		return meta, false, err
+	}
+	if tblName.String != "" {
+		meta.tblName = tblName.String
+	}
+	s.metaMu.Lock()
+	s.metas[streamName] = meta
+	s.metaMu.Unlock()
+	return meta, true, nil
+}
+
+// streamLayout returns the layout of a stream, ok is false if the stream
+// does not exist
+func (s *TiDBStore) streamLayout(streamName string) (StreamLayout, bool, error) {
+	meta, ok, err := s.streamMeta(streamName)
+	return meta.layout, ok, err
+}
+
+// streamTable returns the table of a stream recorded in tipubsub_meta
+func (s *TiDBStore) streamTable(streamName string) (string, error) {
+	meta, _, err := s.streamMeta(streamName)
+	return meta.tblName, err
+}
+
+func (s *TiDBStore) StreamTableName(streamName string) (string, error) {
+	return s.streamTable(streamName)
+}
+
+// quotedStreamTable is streamTable ready to be used in SQL
+func (s *TiDBStore) quotedStreamTable(streamName string) (string, error) {
+	tblName, err := s.streamTable(streamName)
+	return quoteIdent(tblName), err
+}
+
+func (s *TiDBStore) forgetMeta(streamName string) {
+	s.metaMu.Lock()
+	delete(s.metas, streamName)
+	s.metaMu.Unlock()
+}
+
 func (s *TiDBStore) GetStreamNames() ([]string, error) {
 	var names []string
 	rows, err := s.db.Query("SELECT stream_name FROM tipubsub_meta")
@@ -85,33 +405,229 @@ func (s *TiDBStore) GetStreamNames() ([]string, error) {
 	return names, nil
 }
 
+func (s *TiDBStore) StreamExists(streamName string) (bool, error) {
+	var one int
+	err := s.db.QueryRow(`SELECT 1 FROM tipubsub_meta WHERE stream_name = ?`, streamName).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 // CreateStream creates a stream, every stream is a table in the database
 func (s *TiDBStore) CreateStream(streamName string) error {
-	// stream is a table in the database
-	stmt := fmt.Sprintf(`
-		CREATE TABLE IF NOT EXISTS %s (
-			id BIGINT AUTO_INCREMENT,
-			ts BIGINT,
-			create_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
-			data TEXT,
-			PRIMARY KEY (id),
-			KEY(ts)
-		);`, getStreamTblName(streamName))
-	_, err := s.db.Exec(stmt)
+	return s.CreateStreamWithLayout(streamName, LayoutAutoIncrement)
+}
+
+func (s *TiDBStore) CreateStreamWithLayout(streamName string, layout StreamLayout) error {
+	if err := ValidateStreamName(streamName); err != nil {
+		return err
+	}
+	meta, ok, err := s.streamMeta(streamName)
 	if err != nil {
 		return err
 	}
-	// insert the stream name into the meta table
-	stmt = fmt.Sprintf(`
-		REPLACE INTO tipubsub_meta (stream_name)
-		VALUES ('%s');`, streamName)
-	_, err = s.db.Exec(stmt)
+	if ok {
+		layout = meta.layout
+	}
+	if layout, err = ParseStreamLayout(string(layout)); err != nil {
+		return err
+	}
+	meta.layout = layout
+	quotedTblName := quoteIdent(meta.tblName)
+	// stream is a table in the database
+	var stmts []string
+	switch layout {
+	case LayoutAutoIncrement:
+		stmts = append(stmts, fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s (
+				id BIGINT AUTO_INCREMENT,
+				ts BIGINT,
+				create_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				data TEXT,
+				dedup_key VARCHAR(255),
+				deliver_at BIGINT,
+				expire_at BIGINT,
+				headers JSON,
+				PRIMARY KEY (id),
+				UNIQUE KEY (dedup_key),
+				KEY(ts),
+				KEY(expire_at)
+			);`, quotedTblName))
+	case LayoutAutoRandom:
+		// rows are clustered by rid which starts with random shard bits,
+		// only the small index on id is written in order
+		stmts = append(stmts,
+			// cached sequence blocks are per TiDB server, without cache
+			// the ids stay contiguous so readers only wait on real gaps
+			fmt.Sprintf(`CREATE SEQUENCE IF NOT EXISTS %s NOCACHE`, quoteIdent(getStreamSeqName(meta.tblName))),
+			fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s (
+				rid BIGINT AUTO_RANDOM,
+				id BIGINT NOT NULL,
+				ts BIGINT,
+				create_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				data TEXT,
+				dedup_key VARCHAR(255),
+				deliver_at BIGINT,
+				expire_at BIGINT,
+				headers JSON,
+				PRIMARY KEY (rid) CLUSTERED,
+				UNIQUE KEY (id),
+				UNIQUE KEY (dedup_key),
+				KEY(ts),
+				KEY(expire_at)
+			);`, quotedTblName))
+	}
+	if ok {
+		for _, stmt := range streamColumnMigrations {
+			stmts = append(stmts, fmt.Sprintf(stmt, quotedTblName))
+		}
+	}
+	for _, stmt := range stmts {
+		if _, err := s.db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	// insert the stream name and its table into the meta table, the
+	// layout of an existing stream is never changed
+	_, err = s.db.Exec(`
+		INSERT INTO tipubsub_meta (stream_name, layout, table_name)
+		VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE stream_name = stream_name`,
+		streamName, string(layout), meta.tblName)
 	if err != nil {
 		return err
 	}
+	if !ok {
+		s.metaMu.Lock()
+		s.metas[streamName] = meta
+		s.metaMu.Unlock()
+	}
 	return nil
 }
 
+// DeleteStream drops the stream table and forgets the stream
+func (s *TiDBStore) DeleteStream(streamName string) error {
+	tblName, err := s.streamTable(streamName)
+	if err != nil {
+		return err
+	}
+	s.dropStmts(tblName)
+	s.forgetMeta(streamName)
+	stmt := fmt.Sprintf(`DROP TABLE IF EXISTS %s`, quoteIdent(tblName))
+	if _, err := s.db.Exec(stmt); err != nil {
+		return err
+	}
+	stmt = fmt.Sprintf(`DROP SEQUENCE IF EXISTS %s`, quoteIdent(getStreamSeqName(tblName)))
+	if _, err := s.db.Exec(stmt); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(`DELETE FROM tipubsub_meta WHERE stream_name = ?`, streamName); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(`DELETE FROM tipubsub_delayed WHERE stream_name = ?`, streamName); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(`DELETE FROM tipubsub_watermarks WHERE stream_name = ?`, streamName); err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`DELETE FROM tipubsub_offsets WHERE stream_name = ?`, streamName)
+	return err
+}
+
+func (s *TiDBStore) RenameStream(oldName string, newName string) error {
+	if err := ValidateStreamName(newName); err != nil {
+		return err
+	}
+	meta, _, err := s.streamMeta(oldName)
+	if err != nil {
+		return err
+	}
+	// the table follows the name so a new stream with the old name gets a
+	// table of its own
+	newTblName := getStreamTblName(newName)
+	s.dropStmts(meta.tblName)
+	s.forgetMeta(oldName)
+	stmt := fmt.Sprintf(`RENAME TABLE %s TO %s`, quoteIdent(meta.tblName), quoteIdent(newTblName))
+	if _, err := s.db.Exec(stmt); err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`
+		UPDATE tipubsub_meta
+		SET stream_name = ?, table_name = ?
+		WHERE stream_name = ?`, newName, newTblName, oldName)
+	if err != nil {
+		return err
+	}
+	if meta.layout == LayoutAutoRandom {
+		// the sequence of the new name continues after the last id
+		_, maxID, err := s.MinMaxID(newName)
+		if err != nil {
+			return err
+		}
+		stmt = fmt.Sprintf(`CREATE SEQUENCE IF NOT EXISTS %s START WITH %d NOCACHE`, quoteIdent(getStreamSeqName(newTblName)), maxID+1)
+		if _, err := s.db.Exec(stmt); err != nil {
+			return err
+		}
+		if _, err := s.db.Exec(fmt.Sprintf(`DROP SEQUENCE IF EXISTS %s`, quoteIdent(getStreamSeqName(meta.tblName)))); err != nil {
+			return err
+		}
+	}
+	_, err = s.db.Exec(`UPDATE tipubsub_delayed SET stream_name = ? WHERE stream_name = ?`, newName, oldName)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`UPDATE tipubsub_watermarks SET stream_name = ? WHERE stream_name = ?`, newName, oldName)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`UPDATE tipubsub_offsets SET stream_name = ? WHERE stream_name = ?`, newName, oldName)
+	return err
+}
+
+func (s *TiDBStore) DescribeStream(streamName string) (*StreamInfo, error) {
+	tblName, err := s.streamTable(streamName)
+	if err != nil {
+		return nil, err
+	}
+	info := &StreamInfo{Name: streamName, TableName: tblName}
+	quotedTblName := quoteIdent(tblName)
+	stmt := fmt.Sprintf(`
+		SELECT
+			COUNT(*),
+			IFNULL(MIN(id), 0),
+			IFNULL(MAX(id), 0),
+			IFNULL(MIN(ts), 0),
+			IFNULL(MAX(ts), 0)
+		FROM %s`, quotedTblName)
+	err = s.db.QueryRow(stmt).Scan(&info.Count, &info.MinID, &info.MaxID, &info.OldestTs, &info.NewestTs)
+	if err != nil {
+		return nil, err
+	}
+	// the size is an estimation from the statistics of TiDB
+	err = s.db.QueryRow(`
+		SELECT IFNULL(DATA_LENGTH, 0) + IFNULL(INDEX_LENGTH, 0)
+		FROM information_schema.TABLES
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?`, tblName).Scan(&info.TableSize)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	var name string
+	err = s.db.QueryRow(fmt.Sprintf(`SHOW CREATE TABLE %s`, quotedTblName)).Scan(&name, &info.Schema)
+	if err != nil {
+		return nil, err
+	}
+	if info.Layout, _, err = s.streamLayout(streamName); err != nil {
+		return nil, err
+	}
+	err = s.db.QueryRow(`SELECT COUNT(*) FROM tipubsub_delayed WHERE stream_name = ?`, streamName).Scan(&info.Delayed)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
 func (s *TiDBStore) Init() error {
 	var err error
 	s.db, err = sql.Open("mysql", s.dsn)
@@ -126,55 +642,313 @@ func (s *TiDBStore) Init() error {
 	s.db.SetMaxOpenConns(50)
 	s.db.SetMaxIdleConns(50)
 
-	// create stream meta table for all the streams
+	// create stream meta table for all the streams, table_name maps a
+	// stream name to the table of its messages
 	stmt := fmt.Sprintf(`
 		CREATE TABLE IF NOT EXISTS tipubsub_meta (
-			stream_name VARCHAR(255) NOT NULL UNIQUE KEY
+			stream_name VARCHAR(255) NOT NULL UNIQUE KEY,
+			table_name VARCHAR(64)
 		);`)
 	_, err = s.db.Exec(stmt)
 	if err != nil {
 		return err
 	}
+	_, err = s.db.Exec(`ALTER TABLE tipubsub_meta ADD COLUMN IF NOT EXISTS table_name VARCHAR(64)`)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`ALTER TABLE tipubsub_meta ADD COLUMN IF NOT EXISTS layout VARCHAR(32)`)
+	if err != nil {
+		return err
+	}
+
+	// create durable offset table for all the consumers
+	stmt = `
+		CREATE TABLE IF NOT EXISTS tipubsub_offsets (
+			stream_name VARCHAR(255) NOT NULL,
+			consumer_id VARCHAR(255) NOT NULL,
+			offset_id BIGINT NOT NULL,
+			update_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			PRIMARY KEY (stream_name, consumer_id)
+		);`
+	_, err = s.db.Exec(stmt)
+	if err != nil {
+		return err
+	}
+
+	// create the table of delayed messages of all the streams
+	stmt = `
+		CREATE TABLE IF NOT EXISTS tipubsub_delayed (
+			id BIGINT AUTO_INCREMENT,
+			stream_name VARCHAR(255) NOT NULL,
+			deliver_at BIGINT NOT NULL,
+			ts BIGINT,
+			data TEXT,
+			dedup_key VARCHAR(255),
+			expire_at BIGINT,
+			headers JSON,
+			PRIMARY KEY (id),
+			KEY (deliver_at),
+			KEY stream_dedup_key (stream_name, dedup_key)
+		);`
+	_, err = s.db.Exec(stmt)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`ALTER TABLE tipubsub_delayed ADD COLUMN IF NOT EXISTS expire_at BIGINT`)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`ALTER TABLE tipubsub_delayed ADD COLUMN IF NOT EXISTS headers JSON`)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`ALTER TABLE tipubsub_delayed ADD INDEX IF NOT EXISTS stream_dedup_key (stream_name, dedup_key)`)
+	if err != nil {
+		return err
+	}
+
+	// create the table of the last id written to every stream
+	stmt = `
+		CREATE TABLE IF NOT EXISTS tipubsub_watermarks (
+			stream_name VARCHAR(255) NOT NULL,
+			max_id BIGINT NOT NULL,
+			PRIMARY KEY (stream_name)
+		);`
+	_, err = s.db.Exec(stmt)
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
 
 func (s *TiDBStore) PutMessages(streamName string, messages []*Message) error {
+	meta, _, err := s.streamMeta(streamName)
+	if err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		if len(msg.DedupKey) > MaxDedupKeyLen {
+			return ErrDedupKeyTooLong
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		err = s.putMessages(streamName, meta, messages)
+		// a concurrent publisher inserted one of the dedup keys first,
+		// the next attempt finds it
+		if !isDuplicateKeyErr(err) || attempt == maxDedupAttempts {
+			return err
+		}
+	}
+}
+
+func (s *TiDBStore) putMessages(streamName string, meta streamMeta, messages []*Message) error {
 	// a message is a row in the table, so we need to use a transaction
 	// because auto_increment is used, we don't need to set id
 	// use id as the offset
 	txn, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
 	defer txn.Rollback()
+	if err := s.putMessagesTx(storeTx{s, txn, true}, streamName, meta, messages); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+// PutMessagesTx puts messages into a stream in txn, they become visible
+// when txn commits. txn may belong to another *sql.DB of the same database.
+func (s *TiDBStore) PutMessagesTx(txn *sql.Tx, streamName string, messages []*Message) error {
+	meta, _, err := s.streamMeta(streamName)
 	if err != nil {
 		return err
 	}
 	for _, msg := range messages {
-		sql := fmt.Sprintf(`
-		INSERT INTO %s (
-			ts,
-			data
-		) VALUES (
-			?,
-			?
-		)`, getStreamTblName(streamName))
-		res, err := txn.Exec(sql, msg.Ts, msg.Data)
-		if err != nil {
+		if len(msg.DedupKey) > MaxDedupKeyLen {
+			return ErrDedupKeyTooLong
+		}
+	}
+	return s.putMessagesTx(storeTx{s, txn, false}, streamName, meta, messages)
+}
+
+func (s *TiDBStore) putMessagesTx(t storeTx, streamName string, meta streamMeta, messages []*Message) error {
+	// a delayed message with the key of a written one is dropped too
+	messages, resolve, err := s.dedup(t.txn, meta.tblName, messages)
+	if err != nil {
+		return err
+	}
+	messages, err = putDelayed(t.txn, streamName, messages)
+	if err != nil {
+		return err
+	}
+	maxRows := s.insertRowsPerStmt
+	if meta.layout == LayoutAutoRandom && maxRows > maxSeqIDsPerStmt {
+		maxRows = maxSeqIDsPerStmt
+	}
+	var step int64
+	if meta.layout != LayoutAutoRandom && len(messages) > 0 {
+		if err := t.txn.QueryRow(`SELECT @@auto_increment_increment`).Scan(&step); err != nil {
 			return err
 		}
-		id, err := res.LastInsertId()
+	}
+	for _, chunk := range chunkMessages(messages, maxRows, maxInsertStmtBytes) {
+		if meta.layout == LayoutAutoRandom {
+			err = putChunkWithSeq(t, meta.tblName, chunk)
+		} else {
+			err = putChunk(t, meta.tblName, chunk, step)
+		}
 		if err != nil {
 			return err
 		}
-		msg.ID = id
 	}
-	err = txn.Commit()
+	resolve()
+	return nil
+}
+
+// chunkMessages splits messages in chunks of at most maxRows messages and
+// maxBytes of data to stay under the packet size limit, a message larger
+// than maxBytes is a chunk of its own
+func chunkMessages(messages []*Message, maxRows int, maxBytes int) [][]*Message {
+	var chunks [][]*Message
+	for start := 0; start < len(messages); {
+		end, size := start, 0
+		for end < len(messages) && end-start < maxRows {
+			size += len(messages[end].Data)
+			if end > start && size > maxBytes {
+				break
+			}
+			end++
+		}
+		chunks = append(chunks, messages[start:end])
+		start = end
+	}
+	return chunks
+}
+
+// putChunk inserts messages into tblName with ids allocated by
+// AUTO_INCREMENT, step is auto_increment_increment
+func putChunk(t storeTx, tblName string, chunk []*Message, step int64) error {
+	args := make([]interface{}, 0, numMessageColumns*len(chunk))
+	for _, msg := range chunk {
+		args = append(args, messageArgs(msg)...)
+	}
+	key, build := insertSQL(tblName, len(chunk), false)
+	res, err := t.exec(key, build, args...)
+	if err != nil {
+		return err
+	}
+	// TiDB allocates the ids of a single INSERT as one batch, step apart,
+	// LastInsertId is the first one
+	firstID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	ids := make([]interface{}, len(chunk))
+	for i, msg := range chunk {
+		msg.ID = firstID + int64(i)*step
+		ids[i] = msg.ID
+	}
+	// read them back, a wrong id must never reach the caller
+	key, build = idsExistSQL(tblName, len(chunk))
+	rows, err := t.query(key, build, ids...)
 	if err != nil {
 		return err
 	}
+	defer rows.Close()
+	var found int
+	for rows.Next() {
+		if err := rows.Scan(&found); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if found != len(chunk) {
+		return fmt.Errorf("ids of %d messages inserted in %s are not %d apart from %d", len(chunk), tblName, step, firstID)
+	}
 	return nil
 }
 
+// putChunkWithSeq allocates the ids of messages from the sequence of the
+// stream table tblName and inserts them
+func putChunkWithSeq(t storeTx, tblName string, chunk []*Message) error {
+	key, build := nextIDsSQL(tblName)
+	rows, err := t.query(key, build, len(chunk))
+	if err != nil {
+		return err
+	}
+	ids := make([]int64, 0, len(chunk))
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(ids) != len(chunk) {
+		return fmt.Errorf("allocated %d ids for %d messages", len(ids), len(chunk))
+	}
+	// the ids of a chunk are not always consecutive, keep the publish order
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	args := make([]interface{}, 0, (numMessageColumns+1)*len(chunk))
+	for i, msg := range chunk {
+		msg.ID = ids[i]
+		args = append(args, msg.ID)
+		args = append(args, messageArgs(msg)...)
+	}
+	key, build = insertSQL(tblName, len(chunk), true)
+	_, err = t.exec(key, build, args...)
+	return err
+}
+
+func (s *TiDBStore) PutMessagesWithID(streamName string, messages []*Message) error {
+	meta, _, err := s.streamMeta(streamName)
+	if err != nil {
+		return err
+	}
+	txn, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+	stmt := fmt.Sprintf(`
+		INSERT IGNORE INTO %s (id, %s)
+		VALUES (?%s)`, quoteIdent(meta.tblName), messageColumns, strings.Repeat(", ?", numMessageColumns))
+	var maxID int64
+	for _, msg := range messages {
+		args := append([]interface{}{msg.ID}, messageArgs(msg)...)
+		if _, err := txn.Exec(stmt, args...); err != nil {
+			return err
+		}
+		if msg.ID > maxID {
+			maxID = msg.ID
+		}
+	}
+	if meta.layout == LayoutAutoRandom {
+		// move the sequence past the imported ids, SETVAL never moves it back
+		stmt = fmt.Sprintf(`SELECT SETVAL(%s, ?)`, quoteIdent(getStreamSeqName(meta.tblName)))
+		if _, err := txn.Exec(stmt, maxID); err != nil {
+			return err
+		}
+	}
+	return txn.Commit()
+}
+
 func (s *TiDBStore) FetchMessages(streamName string, idOffset Offset, limit int) ([]Message, Offset, error) {
+	return s.FetchMessagesFiltered(streamName, idOffset, limit, nil)
+}
+
+// FetchMessagesFiltered is FetchMessages returning only the messages
+// matching filter, the returned offset is the one of the last of them
+func (s *TiDBStore) FetchMessagesFiltered(streamName string, idOffset Offset, limit int, filter *Filter) ([]Message, Offset, error) {
 	if idOffset == LatestId {
 		_, maxOffset, err := s.MinMaxID(streamName)
 		if err != nil {
@@ -182,16 +956,34 @@ func (s *TiDBStore) FetchMessages(streamName string, idOffset Offset, limit int)
 		}
 		idOffset = Offset(maxOffset)
 	}
-	stmt := fmt.Sprintf(`
+	stmt := `
 		SELECT
 			id,
 			ts,
-			data
+			data,
+			IFNULL(dedup_key, ''),
+			IFNULL(deliver_at, 0),
+			IFNULL(expire_at, 0),
+			headers
 		FROM %s
-		WHERE id > ?
-		LIMIT %d`, getStreamTblName(streamName), limit)
+		WHERE id > ? AND (expire_at IS NULL OR expire_at > ?)%s
+		ORDER BY id
+		LIMIT %d`
+	tblName, err := s.quotedStreamTable(streamName)
+	if err != nil {
+		return nil, 0, err
+	}
+	args := []interface{}{idOffset, time.Now().UnixNano()}
+	var where string
+	if filter != nil {
+		if cond, condArgs := filter.sqlWhere(); cond != "" {
+			where = " AND " + cond
+			args = append(args, condArgs...)
+		}
+	}
+	stmt = fmt.Sprintf(stmt, tblName, where, limit)
 
-	rows, err := s.db.Query(stmt, idOffset)
+	rows, err := s.db.Query(stmt, args...)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, 0, nil
@@ -206,14 +998,26 @@ func (s *TiDBStore) FetchMessages(streamName string, idOffset Offset, limit int)
 		var id int64
 		var ts int64
 		var data string
-		err := rows.Scan(&id, &ts, &data)
+		var dedupKey string
+		var deliverAt int64
+		var expireAt int64
+		var headersJSON sql.NullString
+		err := rows.Scan(&id, &ts, &data, &dedupKey, &deliverAt, &expireAt, &headersJSON)
+		if err != nil {
+			return nil, 0, err
+		}
+		headers, err := scanHeaders(headersJSON)
 		if err != nil {
 			return nil, 0, err
 		}
 		messages = append(messages, Message{
-			ID:   id,
-			Ts:   ts,
-			Data: data,
+			ID:        id,
+			Ts:        ts,
+			Data:      data,
+			DedupKey:  dedupKey,
+			DeliverAt: deliverAt,
+			ExpireAt:  expireAt,
+			Headers:   headers,
 		})
 		if id > maxId {
 			maxId = id
@@ -223,20 +1027,133 @@ func (s *TiDBStore) FetchMessages(streamName string, idOffset Offset, limit int)
 }
 
 func (s *TiDBStore) MinMaxID(streamName string) (int64, int64, error) {
+	tblName, err := s.quotedStreamTable(streamName)
+	if err != nil {
+		return -1, -1, err
+	}
 	// using isnull make sure when there is no message in the stream, not return NULL
 	stmt := fmt.Sprintf(`
 		SELECT
 			IFNULL(MIN(id), 0),
 			IFNULL(MAX(id), 0)
-		FROM %s`, getStreamTblName(streamName))
+		FROM %s`, tblName)
 	var minId, maxId int64
-	err := s.db.QueryRow(stmt).Scan(&minId, &maxId)
+	err = s.db.QueryRow(stmt).Scan(&minId, &maxId)
 	if err != nil {
 		return -1, -1, err
 	}
 	return minId, maxId, nil
 }
 
+func (s *TiDBStore) MaxIDs(streamNames []string) (map[string]int64, error) {
+	maxIDs := make(map[string]int64, len(streamNames))
+	if len(streamNames) == 0 {
+		return maxIDs, nil
+	}
+	parts := make([]string, len(streamNames))
+	args := make([]interface{}, len(streamNames))
+	for i, name := range streamNames {
+		tblName, err := s.quotedStreamTable(name)
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = fmt.Sprintf(`SELECT ?, IFNULL(MAX(id), 0) FROM %s`, tblName)
+		args[i] = name
+	}
+	rows, err := s.db.Query(strings.Join(parts, " UNION ALL "), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var maxID int64
+		if err := rows.Scan(&name, &maxID); err != nil {
+			return nil, err
+		}
+		maxIDs[name] = maxID
+	}
+	return maxIDs, rows.Err()
+}
+
+func (s *TiDBStore) CountMessages(streamName string) (int64, error) {
+	tblName, err := s.quotedStreamTable(streamName)
+	if err != nil {
+		return 0, err
+	}
+	stmt := fmt.Sprintf(`SELECT COUNT(*) FROM %s`, tblName)
+	var cnt int64
+	err = s.db.QueryRow(stmt).Scan(&cnt)
+	if err != nil {
+		return 0, err
+	}
+	return cnt, nil
+}
+
+func (s *TiDBStore) CommitOffset(streamName string, consumerID string, offset Offset) error {
+	_, err := s.db.Exec(`
+		INSERT INTO tipubsub_offsets (stream_name, consumer_id, offset_id)
+		VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE offset_id = VALUES(offset_id)`, streamName, consumerID, int64(offset))
+	return err
+}
+
+func (s *TiDBStore) CommitOffsetTx(txn *sql.Tx, streamName string, consumerID string, offset Offset) error {
+	_, err := txn.Exec(`
+		INSERT INTO tipubsub_offsets (stream_name, consumer_id, offset_id)
+		VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE offset_id = VALUES(offset_id)`, streamName, consumerID, int64(offset))
+	return err
+}
+
+func (s *TiDBStore) InitCommittedOffset(streamName string, consumerID string, offset Offset) (Offset, error) {
+	_, err := s.db.Exec(`
+		INSERT IGNORE INTO tipubsub_offsets (stream_name, consumer_id, offset_id)
+		VALUES (?, ?, ?)`, streamName, consumerID, int64(offset))
+	if err != nil {
+		return LatestId, err
+	}
+	return s.GetCommittedOffset(streamName, consumerID)
+}
+
+func (s *TiDBStore) LockCommittedOffset(txn *sql.Tx, streamName string, consumerID string) (Offset, error) {
+	var offset int64
+	err := txn.QueryRow(`
+		SELECT offset_id
+		FROM tipubsub_offsets
+		WHERE stream_name = ? AND consumer_id = ?
+		FOR UPDATE`, streamName, consumerID).Scan(&offset)
+	if err == sql.ErrNoRows {
+		return LatestId, nil
+	}
+	if err != nil {
+		return LatestId, err
+	}
+	return Offset(offset), nil
+}
+
+func (s *TiDBStore) GetCommittedOffset(streamName string, consumerID string) (Offset, error) {
+	var offset int64
+	err := s.db.QueryRow(`
+		SELECT offset_id
+		FROM tipubsub_offsets
+		WHERE stream_name = ? AND consumer_id = ?`, streamName, consumerID).Scan(&offset)
+	if err == sql.ErrNoRows {
+		return LatestId, nil
+	}
+	if err != nil {
+		return LatestId, err
+	}
+	return Offset(offset), nil
+}
+
+func (s *TiDBStore) DeleteCommittedOffset(streamName string, consumerID string) error {
+	_, err := s.db.Exec(`
+		DELETE FROM tipubsub_offsets
+		WHERE stream_name = ? AND consumer_id = ?`, streamName, consumerID)
+	return err
+}
+
 func (s *TiDBStore) DB() *sql.DB {
 	return s.db
 }
@@ -0,0 +1,307 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStore opens the database of TIPUBSUB_TEST_DSN, the tests and
+// benchmarks using it are skipped without it
+func testStore(tb testing.TB) *TiDBStore {
+	dsn := os.Getenv("TIPUBSUB_TEST_DSN")
+	if dsn == "" {
+		tb.Skip("TIPUBSUB_TEST_DSN is not set")
+	}
+	s := NewTiDBStore(dsn)
+	if err := s.Init(); err != nil {
+		tb.Fatal(err)
+	}
+	return s
+}
+
+// testHub opens a hub on the database of TIPUBSUB_TEST_DSN
+func testHub(tb testing.TB, cfg *Config) *Hub {
+	dsn := os.Getenv("TIPUBSUB_TEST_DSN")
+	if dsn == "" {
+		tb.Skip("TIPUBSUB_TEST_DSN is not set")
+	}
+	cfg.DSN = dsn
+	if cfg.GCIntervalInSec <= 0 {
+		cfg.GCIntervalInSec = 3600
+	}
+	hub, err := NewHub(cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return hub
+}
+
+// testStream creates a stream dropped at the end of the test
+func testStream(tb testing.TB, s *TiDBStore, layout StreamLayout) string {
+	name := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	if err := s.CreateStreamWithLayout(name, layout); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { s.DeleteStream(name) })
+	return name
+}
+
+func TestChunkMessages(t *testing.T) {
+	msg := func(size int) *Message { return &Message{Data: strings.Repeat("x", size)} }
+	for _, c := range []struct {
+		name     string
+		messages []*Message
+		maxRows  int
+		maxBytes int
+		want     []int
+	}{
+		{"empty", nil, 3, 100, nil},
+		{"rows", []*Message{msg(1), msg(1), msg(1), msg(1), msg(1)}, 2, 100, []int{2, 2, 1}},
+		{"bytes", []*Message{msg(40), msg(40), msg(40), msg(40)}, 10, 100, []int{2, 2}},
+		{"large message alone", []*Message{msg(1), msg(200), msg(1)}, 10, 100, []int{1, 1, 1}},
+		{"seq bound", make([]*Message, 2500), maxSeqIDsPerStmt, 100, []int{1000, 1000, 500}},
+	} {
+		for i := range c.messages {
+			if c.messages[i] == nil {
+				c.messages[i] = msg(0)
+			}
+		}
+		chunks := chunkMessages(c.messages, c.maxRows, c.maxBytes)
+		var got []int
+		n := 0
+		for _, chunk := range chunks {
+			got = append(got, len(chunk))
+			for _, m := range chunk {
+				if m != c.messages[n] {
+					t.Fatalf("%s: message %d out of order", c.name, n)
+				}
+				n++
+			}
+		}
+		if len(got) != len(c.want) {
+			t.Errorf("%s: got chunks %v, want %v", c.name, got, c.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%s: got chunks %v, want %v", c.name, got, c.want)
+				break
+			}
+		}
+	}
+}
+
+func TestInsertSQL(t *testing.T) {
+	key, build := insertSQL("tipubsub_stream_s", 2, false)
+	want := "INSERT INTO `tipubsub_stream_s` (ts, data, dedup_key, deliver_at, expire_at, headers) VALUES " +
+		"(?, ?, ?, ?, ?, ?), (?, ?, ?, ?, ?, ?)"
+	if got := build(); got != want {
+		t.Errorf("got %s", got)
+	}
+	if key != (insertStmtKey{"tipubsub_stream_s", 2}) {
+		t.Errorf("got key %v", key)
+	}
+	_, build = insertSQL("tipubsub_stream_s", 1, true)
+	want = "INSERT INTO `tipubsub_stream_s` (id, ts, data, dedup_key, deliver_at, expire_at, headers) VALUES " +
+		"(?, ?, ?, ?, ?, ?, ?)"
+	if got := build(); got != want {
+		t.Errorf("got %s", got)
+	}
+	key, build = idsExistSQL("tipubsub_stream_s", 3)
+	if got := build(); got != "SELECT COUNT(*) FROM `tipubsub_stream_s` WHERE id IN (?, ?, ?)" {
+		t.Errorf("got %s", got)
+	}
+	if key != (insertStmtKey{"tipubsub_stream_s", -3}) {
+		t.Errorf("got key %v", key)
+	}
+}
+
+func TestPutMessagesIDs(t *testing.T) {
+	s := testStore(t)
+	for _, layout := range []StreamLayout{LayoutAutoIncrement, LayoutAutoRandom} {
+		for _, rows := range []int{1, 7, 256} {
+			s.SetInsertRowsPerStmt(rows)
+			name := testStream(t, s, layout)
+			var msgs []*Message
+			for i := 0; i < 20; i++ {
+				msgs = append(msgs, &Message{Ts: int64(i), Data: fmt.Sprint(i)})
+			}
+			if err := s.PutMessages(name, msgs); err != nil {
+				t.Fatal(err)
+			}
+			fetched, _, err := s.FetchMessages(name, 0, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(fetched) != len(msgs) {
+				t.Fatalf("%s, %d rows: fetched %d messages", layout, rows, len(fetched))
+			}
+			// the returned ids are the stored ones, in publish order
+			for i, msg := range fetched {
+				if msg.ID != msgs[i].ID || msg.Data != msgs[i].Data {
+					t.Fatalf("%s, %d rows: message %d is %d %q, put as %d %q",
+						layout, rows, i, msg.ID, msg.Data, msgs[i].ID, msgs[i].Data)
+				}
+			}
+		}
+	}
+}
+
+func TestDelayedDedup(t *testing.T) {
+	s := testStore(t)
+	name := testStream(t, s, LayoutAutoIncrement)
+	written := &Message{Data: "a", DedupKey: "a"}
+	if err := s.PutMessages(name, []*Message{written}); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour).UnixNano()
+	delayed := []*Message{
+		{Data: "a again", DedupKey: "a", DeliverAt: later},
+		{Data: "b", DedupKey: "b", DeliverAt: later},
+		{Data: "b again", DedupKey: "b", DeliverAt: later},
+	}
+	if err := s.PutMessages(name, delayed); err != nil {
+		t.Fatal(err)
+	}
+	// published once more after b was parked
+	if err := s.PutMessages(name, []*Message{{Data: "b later", DedupKey: "b", DeliverAt: later}}); err != nil {
+		t.Fatal(err)
+	}
+	if delayed[0].ID != written.ID {
+		t.Errorf("delayed repeat of a written message got id %d, want %d", delayed[0].ID, written.ID)
+	}
+	var parked int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM tipubsub_delayed WHERE stream_name = ?`, name).Scan(&parked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.db.Exec(`DELETE FROM tipubsub_delayed WHERE stream_name = ?`, name) })
+	if parked != 1 {
+		t.Errorf("%d messages parked, want 1", parked)
+	}
+}
+
+func TestPutMessagesTx(t *testing.T) {
+	s := testStore(t)
+	name := testStream(t, s, LayoutAutoIncrement)
+	for _, commit := range []bool{false, true} {
+		tx, err := s.DB().Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := &Message{Data: fmt.Sprint(commit)}
+		if err := s.PutMessagesTx(tx, name, []*Message{msg}); err != nil {
+			t.Fatal(err)
+		}
+		if msg.ID == 0 {
+			t.Fatal("no id before the commit")
+		}
+		// not visible before the commit
+		if msgs, _, _ := s.FetchMessages(name, 0, 10); len(msgs) != 0 {
+			t.Fatalf("got %v before the commit", msgs)
+		}
+		if commit {
+			err = tx.Commit()
+		} else {
+			err = tx.Rollback()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	msgs, _, err := s.FetchMessages(name, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Data != "true" {
+		t.Fatalf("got %v, want the committed message only", msgs)
+	}
+}
+
+func TestStreamLifecycle(t *testing.T) {
+	s := testStore(t)
+	for _, layout := range []StreamLayout{LayoutAutoIncrement, LayoutAutoRandom} {
+		name := testStream(t, s, layout)
+		if err := s.PutMessages(name, []*Message{{Data: "a"}, {Data: "b"}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CommitOffset(name, "c", 1); err != nil {
+			t.Fatal(err)
+		}
+		renamed := name + ".renamed"
+		if err := s.RenameStream(name, renamed); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.DeleteStream(renamed) })
+		info, err := s.DescribeStream(renamed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Count != 2 || info.Layout != layout || info.TableName != getStreamTblName(renamed) {
+			t.Fatalf("%s: got %+v", layout, info)
+		}
+		// offsets and ids carry over
+		if o, _ := s.GetCommittedOffset(renamed, "c"); o != 1 {
+			t.Fatalf("%s: offset %d after the rename", layout, o)
+		}
+		msgs := []*Message{{Data: "c"}}
+		if err := s.PutMessages(renamed, msgs); err != nil {
+			t.Fatal(err)
+		}
+		if msgs[0].ID <= info.MaxID {
+			t.Fatalf("%s: id %d after %d", layout, msgs[0].ID, info.MaxID)
+		}
+		if err := s.DeleteStream(renamed); err != nil {
+			t.Fatal(err)
+		}
+		names, err := s.GetStreamNames()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range names {
+			if n == renamed || n == name {
+				t.Fatalf("%s: %s still listed", layout, n)
+			}
+		}
+	}
+}
+
+func BenchmarkPutMessages(b *testing.B) {
+	s := testStore(b)
+	for _, rows := range []int{1, 16, 256} {
+		b.Run(fmt.Sprintf("rows_per_stmt_%d", rows), func(b *testing.B) {
+			s.SetInsertRowsPerStmt(rows)
+			name := testStream(b, s, LayoutAutoIncrement)
+			data := strings.Repeat("x", 256)
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				msgs := make([]*Message, 1000)
+				for j := range msgs {
+					msgs[j] = &Message{Ts: time.Now().UnixNano(), Data: data}
+				}
+				if err := s.PutMessages(name, msgs); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.N*1000)/time.Since(start).Seconds(), "msgs/s")
+		})
+	}
+}
@@ -16,6 +16,13 @@ package tipubsub
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/c4pt0r/log"
@@ -25,6 +32,19 @@ type Message struct {
 	ID   int64  `json:"id,string"`
 	Ts   int64  `json:"ts,string"`
 	Data string `json:"data"`
+	// DedupKey makes publishing idempotent, a message whose key is in the
+	// stream already is not written again and gets the ID of the first one
+	DedupKey string `json:"dedup_key,omitempty"`
+	// DeliverAt delays the delivery of the message until this unix time in
+	// nanoseconds, the message gets its ID when it is delivered
+	DeliverAt int64 `json:"deliver_at,string,omitempty"`
+	// ExpireAt is the unix time in nanoseconds after which the message is
+	// not delivered anymore and deleted by GC, 0 never expires
+	ExpireAt int64 `json:"expire_at,string,omitempty"`
+	// Headers are metadata subscription filters can select on
+	Headers map[string]string `json:"headers,omitempty"`
+	// Stream is the source stream of messages of pattern subscriptions
+	Stream string `json:"stream,omitempty"`
 }
 
 func (m Message) String() string {
@@ -32,95 +52,314 @@ func (m Message) String() string {
 	return string(b)
 }
 
-type Stream struct {
-	name string
-	mq   chan *Message
-
-	store        Store
-	maxBatchSize int
+// Expired tells if the message has expired at now
+func (m Message) Expired(now time.Time) bool {
+	return m.ExpireAt != 0 && m.ExpireAt <= now.UnixNano()
 }
 
 var (
-	pullTimeout = time.Millisecond * 100
+	ErrStreamClosed error = errors.New("stream closed")
+	// ErrQueueFull is returned when the publish queue of a stream is full
+	ErrQueueFull error = errors.New("publish queue full")
+)
+
+// QueueFullPolicy is what Publish does when the queue of a stream is full
+type QueueFullPolicy string
+
+const (
+	// QueueFullBlock waits for room, at most PublishTimeoutInMs if set
+	QueueFullBlock QueueFullPolicy = "block"
+	// QueueFullError returns ErrQueueFull right away
+	QueueFullError QueueFullPolicy = "error"
+	// QueueFullSpill writes the message to a file in SpillDir
+	QueueFullSpill QueueFullPolicy = "spill"
 )
 
+// Stream is the publishing side of a stream, messages are queued and
+// written in batches by one or more writers. Messages with the same key
+// are handled by the same writer so their order is kept, unkeyed ones all
+// go to the first writer.
+type Stream struct {
+	name    string
+	writers []*streamWriter
+	// mu guards closed, Publish holds it for reading so a queue is never
+	// closed under a sender
+	mu     sync.RWMutex
+	closed bool
+
+	store Store
+	cfg   StreamConfig
+	// spillDir is where the writers spill with QueueFullSpill
+	spillDir string
+	// rejected counts the publishes failed with ErrQueueFull
+	rejected int64
+	// onWritten is called after a batch is written, if set
+	onWritten func(streamName string, msgs []*Message)
+}
+
+type streamWriter struct {
+	mq   chan *Message
+	done chan struct{}
+	// spill is only set with QueueFullSpill
+	spill *spillFile
+}
+
 func (s *Stream) Name() string {
 	return s.name
 }
 
 func NewStream(cfg *Config, s Store, name string) (*Stream, error) {
-	return &Stream{
-		store:        s,
-		name:         name,
-		mq:           make(chan *Message, cfg.MaxBatchSize),
-		maxBatchSize: cfg.MaxBatchSize,
-	}, nil
+	sc := cfg.StreamConfig(name)
+	switch sc.QueueFullPolicy {
+	case QueueFullBlock, QueueFullError, QueueFullSpill:
+	default:
+		return nil, fmt.Errorf("unknown queue full policy %q", sc.QueueFullPolicy)
+	}
+	stream := &Stream{
+		store:    s,
+		name:     name,
+		cfg:      sc,
+		spillDir: cfg.SpillDir,
+	}
+	for i := 0; i < sc.PublishWriters; i++ {
+		stream.writers = append(stream.writers, &streamWriter{
+			mq:   make(chan *Message, sc.QueueSize),
+			done: make(chan struct{}),
+		})
+	}
+	return stream, nil
 }
 
 func (s *Stream) Open() error {
-	err := s.store.CreateStream(s.name)
+	err := s.store.CreateStreamWithLayout(s.name, s.cfg.Layout)
 	if err != nil {
 		return err
 	}
-	log.Info("pub: open stream:", s.name)
-	go s.pubWorker()
+	if s.cfg.QueueFullPolicy == QueueFullSpill {
+		if err := s.openSpillFiles(); err != nil {
+			return err
+		}
+	}
+	log.Info("pub: open stream:", s.name, "writers:", len(s.writers))
+	for _, w := range s.writers {
+		go s.pubWorker(w)
+		if w.spill != nil {
+			go w.spill.run(w.mq)
+		}
+	}
+	return nil
+}
+
+func (s *Stream) openSpillFiles() error {
+	dir := s.spillDir
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "tipubsub-spill")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for i, w := range s.writers {
+		// the table name is a safe file name
+		path := filepath.Join(dir, fmt.Sprintf("%s.%d.spill", getStreamTblName(s.name), i))
+		sf, err := openSpillFile(path)
+		if err != nil {
+			for _, w := range s.writers[:i] {
+				w.spill.stop()
+			}
+			return err
+		}
+		w.spill = sf
+	}
 	return nil
 }
 
-func (s *Stream) Publish(m *Message) {
+func (s *Stream) Publish(m *Message) error {
+	return s.PublishWithKey("", m)
+}
+
+// PublishWithKey queues a message to the writer of key, messages with the
+// same key are written in the order they are published. When the queue is
+// full it blocks, returns ErrQueueFull or spills to disk depending on the
+// queue full policy of the stream.
+func (s *Stream) PublishWithKey(key string, m *Message) error {
+	return s.publish(key, m, false)
+}
+
+// TryPublish queues a message or returns ErrQueueFull right away, whatever
+// the queue full policy is
+func (s *Stream) TryPublish(m *Message) error {
+	return s.TryPublishWithKey("", m)
+}
+
+func (s *Stream) TryPublishWithKey(key string, m *Message) error {
+	return s.publish(key, m, true)
+}
+
+func (s *Stream) publish(key string, m *Message, try bool) error {
 	if m.Ts == 0 {
 		m.Ts = time.Now().UnixNano()
 	}
-	s.mq <- m
+	w := s.writerFor(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrStreamClosed
+	}
+	// spilled messages go first to keep the order
+	if w.spill == nil || w.spill.len() == 0 {
+		select {
+		case w.mq <- m:
+			return nil
+		default:
+		}
+	}
+	switch {
+	case try:
+	case w.spill != nil:
+		return w.spill.publish(w.mq, m)
+	case s.cfg.QueueFullPolicy == QueueFullBlock && s.cfg.PublishTimeoutInMs <= 0:
+		w.mq <- m
+		return nil
+	case s.cfg.QueueFullPolicy == QueueFullBlock:
+		timer := time.NewTimer(time.Duration(s.cfg.PublishTimeoutInMs) * time.Millisecond)
+		defer timer.Stop()
+		select {
+		case w.mq <- m:
+			return nil
+		case <-timer.C:
+		}
+	}
+	atomic.AddInt64(&s.rejected, 1)
+	return ErrQueueFull
+}
+
+// writerFor returns the writer of key, the messages without a key are
+// kept in order by the first writer
+func (s *Stream) writerFor(key string) *streamWriter {
+	if len(s.writers) == 1 || key == "" {
+		return s.writers[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return s.writers[h.Sum32()%uint32(len(s.writers))]
+}
+
+// Stat returns the queue metrics of the stream
+func (s *Stream) Stat() map[string]interface{} {
+	var depth, capacity int
+	var spilled int64
+	for _, w := range s.writers {
+		depth += len(w.mq)
+		capacity += cap(w.mq)
+		if w.spill != nil {
+			spilled += w.spill.len()
+		}
+	}
+	return map[string]interface{}{
+		"stream_name":       s.name,
+		"queue_depth":       depth,
+		"queue_capacity":    capacity,
+		"queue_full_policy": string(s.cfg.QueueFullPolicy),
+		"spilled":           spilled,
+		"rejected":          atomic.LoadInt64(&s.rejected),
+	}
+}
+
+// Close stops accepting messages and waits for the queued ones to be written
+func (s *Stream) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	for _, w := range s.writers {
+		// the spilled messages are written before the queue is closed
+		if w.spill != nil {
+			w.spill.stop()
+		}
+		close(w.mq)
+	}
+	s.mu.Unlock()
+	for _, w := range s.writers {
+		<-w.done
+	}
+	log.Info("pub: closed stream:", s.name)
 }
 
 func (s *Stream) MinMaxID() (int64, int64, error) {
 	return s.store.MinMaxID(s.name)
 }
 
-func (s *Stream) getBatches(maxItems int, maxTimeout time.Duration) chan []*Message {
+// getBatches groups the messages of mq in batches of at most maxItems
+// messages and maxBytes bytes of data, a batch is flushed linger after
+// its first message at the latest.
+func getBatches(mq chan *Message, maxItems int, maxBytes int, linger time.Duration) chan []*Message {
 	// Create a channel to receive batches
 	batches := make(chan []*Message)
 	go func() {
 		defer close(batches)
+		var pending *Message
 		for keepGoing := true; keepGoing; {
 			var batch []*Message
-			expire := time.After(maxTimeout)
-			for {
+			var size int
+			// a message which did not fit in the previous batch
+			if pending != nil {
+				batch = append(batch, pending)
+				size = len(pending.Data)
+				pending = nil
+			} else {
+				// block until the first message of the batch
+				value, ok := <-mq
+				if !ok {
+					return
+				}
+				batch = append(batch, value)
+				size = len(value.Data)
+			}
+			expire := time.After(linger)
+			for len(batch) < maxItems && size < maxBytes {
 				select {
-				case value, ok := <-s.mq:
+				case value, ok := <-mq:
 					if !ok {
 						keepGoing = false
 						goto done
 					}
-					batch = append(batch, value)
-					// if batch is full, return batch
-					if len(batch) == maxItems {
+					if size+len(value.Data) > maxBytes {
+						pending = value
 						goto done
 					}
-				// if channel is empty, block for maxTimeout
+					batch = append(batch, value)
+					size += len(value.Data)
+				// flush what we have after linger
 				case <-expire:
 					goto done
 				}
 			}
 		done:
-			if len(batch) > 0 {
-				batches <- batch
-			}
+			batches <- batch
+		}
+		if pending != nil {
+			batches <- []*Message{pending}
 		}
 	}()
 	return batches
 }
 
-func (s *Stream) pubWorker() {
+func (s *Stream) pubWorker(w *streamWriter) {
+	defer close(w.done)
 	log.Info("pub: Starting pub worker...")
-	batches := s.getBatches(s.maxBatchSize, pullTimeout)
+	batches := getBatches(w.mq, s.cfg.MaxBatchSize, s.cfg.MaxBatchBytes, time.Duration(s.cfg.LingerInMs)*time.Millisecond)
 	for batch := range batches {
 		// Put batch to store
 		err := s.store.PutMessages(s.name, batch)
 		if err != nil {
 			// TODO: Retry?
 			log.Error(err)
+			continue
+		}
+		if s.onWritten != nil {
+			s.onWritten(s.name, batch)
 		}
 	}
 }
@@ -0,0 +1,189 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tipubsub
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriterForKeepsUnkeyedOrder(t *testing.T) {
+	s, err := NewStream(&Config{PublishWriters: 4, MaxBatchSize: 10}, newFakeStore(), "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		if w := s.writerFor(""); w != s.writers[0] {
+			t.Fatal("unkeyed message went to another writer than the first one")
+		}
+	}
+}
+
+func TestWriterForKeepsKey(t *testing.T) {
+	s, err := NewStream(&Config{PublishWriters: 4, MaxBatchSize: 10}, newFakeStore(), "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		w := s.writerFor(key)
+		for i := 0; i < 4; i++ {
+			if s.writerFor(key) != w {
+				t.Fatalf("key %q moved to another writer", key)
+			}
+		}
+	}
+}
+
+// batchSizes closes mq after queueing messages of the given sizes and
+// returns the sizes of the batches
+func batchSizes(sizes []int, maxItems int, maxBytes int) []int {
+	mq := make(chan *Message, len(sizes))
+	for _, size := range sizes {
+		mq <- &Message{Data: strings.Repeat("x", size)}
+	}
+	close(mq)
+	var got []int
+	for batch := range getBatches(mq, maxItems, maxBytes, time.Hour) {
+		got = append(got, len(batch))
+	}
+	return got
+}
+
+func TestGetBatches(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		sizes    []int
+		maxItems int
+		maxBytes int
+		want     []int
+	}{
+		{"items", []int{1, 1, 1, 1, 1}, 2, 100, []int{2, 2, 1}},
+		{"bytes", []int{40, 40, 40, 40}, 10, 100, []int{2, 2}},
+		{"pending at close", []int{60, 60}, 10, 100, []int{1, 1}},
+		{"large message alone", []int{10, 200, 10}, 10, 100, []int{1, 1, 1}},
+		{"empty", nil, 10, 100, nil},
+	} {
+		got := batchSizes(c.sizes, c.maxItems, c.maxBytes)
+		if fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("%s: got batches %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestGetBatchesLinger(t *testing.T) {
+	mq := make(chan *Message, 10)
+	batches := getBatches(mq, 10, 100, 10*time.Millisecond)
+	mq <- &Message{Data: "a"}
+	select {
+	case batch := <-batches:
+		if len(batch) != 1 {
+			t.Fatalf("got %d messages, want 1", len(batch))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("batch not flushed after linger")
+	}
+	close(mq)
+	if _, ok := <-batches; ok {
+		t.Fatal("batches not closed with the queue")
+	}
+}
+
+func TestMessageExpired(t *testing.T) {
+	now := time.Now()
+	if (Message{}).Expired(now) {
+		t.Error("a message without ExpireAt expired")
+	}
+	if !(Message{ExpireAt: now.UnixNano()}).Expired(now) {
+		t.Error("a message is not expired at ExpireAt")
+	}
+	if (Message{ExpireAt: now.Add(time.Second).UnixNano()}).Expired(now) {
+		t.Error("a message expired before ExpireAt")
+	}
+}
+
+func TestQueueFullError(t *testing.T) {
+	cfg := &Config{MaxBatchSize: 10, PublishQueueSize: 1, QueueFullPolicy: QueueFullError}
+	s, err := NewStream(cfg, newFakeStore(), "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// not opened, nothing drains the queue
+	if err := s.Publish(&Message{Data: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Publish(&Message{Data: "b"}); err != ErrQueueFull {
+		t.Fatalf("got %v, want ErrQueueFull", err)
+	}
+	if n := s.Stat()["rejected"]; n != int64(1) {
+		t.Fatalf("%v publishes rejected, want 1", n)
+	}
+}
+
+func TestQueueFullBlockTimeout(t *testing.T) {
+	cfg := &Config{MaxBatchSize: 10, PublishQueueSize: 1, PublishTimeoutInMs: 20}
+	s, err := NewStream(cfg, newFakeStore(), "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Publish(&Message{Data: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	// TryPublish never waits
+	if err := s.TryPublish(&Message{Data: "b"}); err != ErrQueueFull {
+		t.Fatalf("TryPublish: got %v, want ErrQueueFull", err)
+	}
+	start := time.Now()
+	if err := s.Publish(&Message{Data: "b"}); err != ErrQueueFull {
+		t.Fatalf("got %v, want ErrQueueFull", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("gave up after %v, before the publish timeout", elapsed)
+	}
+}
+
+func TestQueueFullSpill(t *testing.T) {
+	store := newFakeStore()
+	store.gate = make(chan struct{})
+	cfg := &Config{MaxBatchSize: 1, PublishQueueSize: 1, QueueFullPolicy: QueueFullSpill, SpillDir: t.TempDir()}
+	s, err := NewStream(cfg, store, "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	// the writer is blocked, the queue overflows to the spill file
+	for i := 0; i < 10; i++ {
+		if err := s.Publish(&Message{Data: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := s.Stat()["spilled"].(int64); n == 0 {
+		t.Fatal("nothing spilled")
+	}
+	close(store.gate)
+	s.Close()
+	msgs, _, _ := store.FetchMessages("s", 0, 100)
+	if len(msgs) != 10 {
+		t.Fatalf("%d messages written, want 10", len(msgs))
+	}
+	for i, msg := range msgs {
+		if msg.Data != fmt.Sprint(i) {
+			t.Fatalf("message %d is %q, the order was not kept", i, msg.Data)
+		}
+	}
+}
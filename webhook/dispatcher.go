@@ -0,0 +1,320 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/c4pt0r/log"
+	"github.com/c4pt0r/tipubsub"
+)
+
+const (
+	minBackoff   = time.Second
+	maxBackoff   = time.Minute
+	defaultLease = 30 * time.Second
+)
+
+// Dispatcher runs a delivery worker for every webhook which is not paused,
+// a worker only delivers while its dispatcher holds the lease of the
+// webhook so several servers never post the same messages
+type Dispatcher struct {
+	hub      *tipubsub.Hub
+	registry *Registry
+	cfg      *tipubsub.Config
+	client   *http.Client
+	// owner identifies the dispatcher in the leases
+	owner string
+
+	mu      sync.Mutex
+	workers map[string]*worker
+}
+
+type worker struct {
+	hook Webhook
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewDispatcher(hub *tipubsub.Hub, cfg *tipubsub.Config) (*Dispatcher, error) {
+	registry, err := NewRegistry(hub.DB())
+	if err != nil {
+		return nil, err
+	}
+	return &Dispatcher{
+		hub:      hub,
+		registry: registry,
+		cfg:      cfg,
+		client: &http.Client{
+			Timeout: time.Duration(cfg.WebhookTimeoutInSec) * time.Second,
+		},
+		owner:   newOwner(),
+		workers: map[string]*worker{},
+	}, nil
+}
+
+// newOwner returns the host name with a random suffix, unique per process
+func newOwner() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 8)
+	rand.Read(b)
+	return host + "-" + hex.EncodeToString(b)
+}
+
+func (d *Dispatcher) lease() time.Duration {
+	if d.cfg.WebhookLeaseInSec <= 0 {
+		return defaultLease
+	}
+	return time.Duration(d.cfg.WebhookLeaseInSec) * time.Second
+}
+
+// acquire waits until the dispatcher holds the lease of the webhook of w,
+// it returns false if the worker is stopped meanwhile
+func (d *Dispatcher) acquire(w *worker) bool {
+	for {
+		ok, err := d.registry.Acquire(w.hook.Name, d.owner, d.lease())
+		if err != nil {
+			log.Error("webhook:", w.hook.Name, err)
+		} else if ok {
+			return true
+		}
+		if !w.sleep(d.lease() / 3) {
+			return false
+		}
+	}
+}
+
+// Run reloads the webhooks from the registry periodically, it never returns
+func (d *Dispatcher) Run() {
+	for {
+		if err := d.reload(); err != nil {
+			log.Error("webhook: reload failed:", err)
+		}
+		time.Sleep(time.Duration(d.cfg.WebhookReloadIntervalInSec) * time.Second)
+	}
+}
+
+// consumerID is the name of the durable offset of a webhook
+func consumerID(name string) string {
+	return "webhook:" + name
+}
+
+// reload starts workers for new or changed webhooks and stops the ones
+// which are removed or paused
+func (d *Dispatcher) reload() error {
+	hooks, err := d.registry.List()
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	active := map[string]bool{}
+	for _, h := range hooks {
+		if h.Paused {
+			continue
+		}
+		active[h.Name] = true
+		if w, ok := d.workers[h.Name]; ok {
+			if w.hook == *h && !w.exited() {
+				continue
+			}
+			w.halt()
+		}
+		w := &worker{
+			hook: *h,
+			stop: make(chan struct{}),
+			done: make(chan struct{}),
+		}
+		d.workers[h.Name] = w
+		go d.run(w)
+	}
+	for name, w := range d.workers {
+		if !active[name] {
+			w.halt()
+			delete(d.workers, name)
+		}
+	}
+	return nil
+}
+
+func (w *worker) exited() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *worker) halt() {
+	if !w.exited() {
+		close(w.stop)
+	}
+	<-w.done
+}
+
+// sleep returns false if the worker is stopped meanwhile
+func (w *worker) sleep(d time.Duration) bool {
+	select {
+	case <-w.stop:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func (d *Dispatcher) run(w *worker) {
+	defer close(w.done)
+	hook := w.hook
+	if !d.acquire(w) {
+		return
+	}
+	defer func() {
+		if err := d.registry.Release(hook.Name, d.owner); err != nil {
+			log.Error("webhook:", hook.Name, err)
+		}
+	}()
+	renewAt := time.Now().Add(d.lease() / 3)
+	log.Info("webhook: start delivering", hook.StreamName, "to", hook.Name)
+	pollInterval := time.Duration(d.cfg.PollIntervalInMs) * time.Millisecond
+
+	offset, err := d.hub.CommittedOffset(hook.StreamName, consumerID(hook.Name))
+	for err != nil || offset == tipubsub.LatestId {
+		if err == nil {
+			// new webhooks start from the end of the stream
+			var max int64
+			_, max, err = d.hub.MinMaxID(hook.StreamName)
+			if err == nil {
+				offset = tipubsub.Offset(max)
+				err = d.hub.CommitOffset(hook.StreamName, consumerID(hook.Name), offset)
+			}
+			if err == nil {
+				break
+			}
+		}
+		log.Error("webhook:", hook.Name, err)
+		if !w.sleep(pollInterval) {
+			return
+		}
+		offset, err = d.hub.CommittedOffset(hook.StreamName, consumerID(hook.Name))
+	}
+
+	failures := 0
+	backoff := minBackoff
+	for {
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+		if time.Now().After(renewAt) {
+			// a lost lease is waited for again by the next reload
+			ok, err := d.registry.Acquire(hook.Name, d.owner, d.lease())
+			if err != nil || !ok {
+				log.Warn("webhook:", hook.Name, "lost its lease:", err)
+				return
+			}
+			renewAt = time.Now().Add(d.lease() / 3)
+		}
+		msgs, max, err := d.hub.FetchMessages(hook.StreamName, offset, hook.BatchSize)
+		if err != nil {
+			log.Error("webhook:", hook.Name, err)
+			if !w.sleep(pollInterval) {
+				return
+			}
+			continue
+		}
+		if len(msgs) == 0 {
+			if !w.sleep(pollInterval) {
+				return
+			}
+			continue
+		}
+		if err := d.deliver(&hook, msgs); err != nil {
+			failures++
+			log.Warn("webhook:", hook.Name, "delivery failed", failures, "times:", err)
+			if failures >= d.cfg.WebhookMaxFailures {
+				log.Error("webhook:", hook.Name, "paused after", failures, "failures, last error:", err)
+				if err := d.registry.SetPaused(hook.Name, true, err.Error()); err != nil {
+					log.Error("webhook:", hook.Name, err)
+				}
+				return
+			}
+			if !w.sleep(backoff) {
+				return
+			}
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		failures = 0
+		backoff = minBackoff
+		if err := d.hub.CommitOffset(hook.StreamName, consumerID(hook.Name), max); err != nil {
+			// the batch may be delivered again, receivers dedup by HeaderDelivery
+			log.Error("webhook:", hook.Name, err)
+		}
+		offset = max
+	}
+}
+
+// deliver posts msgs, a single message is posted as an object and batches
+// as an array
+func (d *Dispatcher) deliver(hook *Webhook, msgs []tipubsub.Message) error {
+	var (
+		body []byte
+		err  error
+	)
+	if hook.BatchSize == 1 {
+		body, err = json.Marshal(msgs[0])
+	} else {
+		body, err = json.Marshal(msgs)
+	}
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	ts := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderStream, hook.StreamName)
+	req.Header.Set(HeaderTimestamp, fmt.Sprint(ts))
+	req.Header.Set(HeaderDelivery, fmt.Sprintf("%d-%d", msgs[0].ID, msgs[len(msgs)-1].ID))
+	if hook.Secret != "" {
+		req.Header.Set(HeaderSignature, Sign(hook.Secret, ts, body))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded %s", hook.URL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/c4pt0r/tipubsub"
+)
+
+func TestDeliver(t *testing.T) {
+	var got []tipubsub.Message
+	var header http.Header
+	var status = http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		header = r.Header
+		ts, _ := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+		if !Verify("secret", ts, body, r.Header.Get(HeaderSignature)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		got = nil
+		if err := json.Unmarshal(body, &got); err != nil {
+			// a single message is posted as an object
+			var msg tipubsub.Message
+			if err := json.Unmarshal(body, &msg); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			got = []tipubsub.Message{msg}
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	d := &Dispatcher{client: srv.Client()}
+	hook := &Webhook{Name: "h", StreamName: "s", URL: srv.URL, Secret: "secret", BatchSize: 10}
+
+	msgs := []tipubsub.Message{{ID: 3, Data: "a"}, {ID: 5, Data: "b"}}
+	if err := d.deliver(hook, msgs); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Data != "a" || got[1].ID != 5 {
+		t.Fatalf("got %v", got)
+	}
+	if header.Get(HeaderStream) != "s" || header.Get(HeaderDelivery) != "3-5" {
+		t.Fatalf("got headers %v", header)
+	}
+
+	hook.BatchSize = 1
+	if err := d.deliver(hook, msgs[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Data != "a" {
+		t.Fatalf("got %v", got)
+	}
+
+	status = http.StatusInternalServerError
+	if err := d.deliver(hook, msgs[:1]); err == nil {
+		t.Fatal("no error for a failed delivery")
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package webhook delivers the messages of streams to HTTP endpoints.
+//
+// Webhooks are kept in the tipubsub_webhooks table, a Dispatcher posts the
+// messages of each enabled webhook to its URL and saves its position as the
+// durable offset "webhook:<name>" of the stream. With several servers, a
+// webhook is delivered by the one holding its lease.
+package webhook
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+type Webhook struct {
+	Name       string
+	StreamName string
+	URL        string
+	// Secret is the HMAC key of the signature header, empty means unsigned
+	Secret string
+	// BatchSize is the max number of messages in one request, 1 posts
+	// every message on its own
+	BatchSize int
+	// Paused webhooks are not delivered, webhooks are paused after too many
+	// failures in a row
+	Paused    bool
+	LastError string
+}
+
+// Registry stores webhooks in TiDB
+type Registry struct {
+	db *sql.DB
+}
+
+func NewRegistry(db *sql.DB) (*Registry, error) {
+	stmt := `
+		CREATE TABLE IF NOT EXISTS tipubsub_webhooks (
+			name VARCHAR(255) NOT NULL,
+			stream_name VARCHAR(255) NOT NULL,
+			url TEXT NOT NULL,
+			secret VARCHAR(255) NOT NULL DEFAULT '',
+			batch_size INT NOT NULL DEFAULT 1,
+			paused BOOL NOT NULL DEFAULT FALSE,
+			last_error TEXT,
+			update_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			PRIMARY KEY (name)
+		);`
+	if _, err := db.Exec(stmt); err != nil {
+		return nil, err
+	}
+	// the server delivering a webhook owns it until lease_until
+	for _, stmt := range []string{
+		`ALTER TABLE tipubsub_webhooks ADD COLUMN IF NOT EXISTS owner VARCHAR(255) NOT NULL DEFAULT ''`,
+		`ALTER TABLE tipubsub_webhooks ADD COLUMN IF NOT EXISTS lease_until DATETIME(3)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+	return &Registry{db: db}, nil
+}
+
+// Put creates or replaces a webhook
+func (r *Registry) Put(w *Webhook) error {
+	if w.BatchSize <= 0 {
+		w.BatchSize = 1
+	}
+	_, err := r.db.Exec(`
+		REPLACE INTO tipubsub_webhooks (name, stream_name, url, secret, batch_size, paused, last_error)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		w.Name, w.StreamName, w.URL, w.Secret, w.BatchSize, w.Paused, w.LastError)
+	return err
+}
+
+func (r *Registry) Remove(name string) error {
+	res, err := r.db.Exec(`DELETE FROM tipubsub_webhooks WHERE name = ?`, name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// SetPaused pauses or resumes a webhook, lastError is saved for operators
+func (r *Registry) SetPaused(name string, paused bool, lastError string) error {
+	res, err := r.db.Exec(`
+		UPDATE tipubsub_webhooks
+		SET paused = ?, last_error = ?
+		WHERE name = ?`, paused, lastError, name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// Acquire takes or renews the lease of a webhook for owner, it returns
+// false while another owner holds a lease which has not expired. The
+// database clock is used so the servers need not agree on the time.
+func (r *Registry) Acquire(name string, owner string, lease time.Duration) (bool, error) {
+	res, err := r.db.Exec(`
+		UPDATE tipubsub_webhooks
+		SET owner = ?, lease_until = NOW(3) + INTERVAL ? MICROSECOND, update_at = update_at
+		WHERE name = ? AND (owner = ? OR lease_until IS NULL OR lease_until < NOW(3))`,
+		owner, lease.Microseconds(), name, owner)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Release gives up the lease of owner on a webhook
+func (r *Registry) Release(name string, owner string) error {
+	_, err := r.db.Exec(`
+		UPDATE tipubsub_webhooks
+		SET lease_until = NULL, update_at = update_at
+		WHERE name = ? AND owner = ?`, name, owner)
+	return err
+}
+
+func (r *Registry) List() ([]*Webhook, error) {
+	rows, err := r.db.Query(`
+		SELECT name, stream_name, url, secret, batch_size, paused, IFNULL(last_error, '')
+		FROM tipubsub_webhooks
+		ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []*Webhook
+	for rows.Next() {
+		w := &Webhook{}
+		if err := rows.Scan(&w.Name, &w.StreamName, &w.URL, &w.Secret, &w.BatchSize, &w.Paused, &w.LastError); err != nil {
+			return nil, err
+		}
+		ret = append(ret, w)
+	}
+	return ret, rows.Err()
+}
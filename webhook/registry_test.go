@@ -0,0 +1,76 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/c4pt0r/tipubsub"
+)
+
+// testRegistry opens a registry on the database of TIPUBSUB_TEST_DSN
+func testRegistry(t *testing.T) *Registry {
+	dsn := os.Getenv("TIPUBSUB_TEST_DSN")
+	if dsn == "" {
+		t.Skip("TIPUBSUB_TEST_DSN is not set")
+	}
+	store, err := tipubsub.OpenStore(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRegistry(store.DB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRegistryLease(t *testing.T) {
+	r := testRegistry(t)
+	name := fmt.Sprintf("lease_test_%d", time.Now().UnixNano())
+	if err := r.Put(&Webhook{Name: name, StreamName: "s", URL: "http://localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Remove(name)
+	acquire := func(owner string, lease time.Duration, want bool) {
+		t.Helper()
+		ok, err := r.Acquire(name, owner, lease)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Fatalf("%s acquired the lease: %v, want %v", owner, ok, want)
+		}
+	}
+	acquire("a", time.Minute, true)
+	acquire("b", time.Minute, false)
+	// renewed by its owner
+	acquire("a", time.Minute, true)
+	// only the owner releases it
+	if err := r.Release(name, "b"); err != nil {
+		t.Fatal(err)
+	}
+	acquire("b", time.Minute, false)
+	if err := r.Release(name, "a"); err != nil {
+		t.Fatal(err)
+	}
+	acquire("b", 10*time.Millisecond, true)
+	// taken over once expired
+	time.Sleep(50 * time.Millisecond)
+	acquire("a", time.Minute, true)
+}
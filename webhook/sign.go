@@ -0,0 +1,47 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+)
+
+// headers set on every delivery
+const (
+	HeaderStream    = "X-Tipubsub-Stream"
+	HeaderTimestamp = "X-Tipubsub-Timestamp"
+	HeaderSignature = "X-Tipubsub-Signature"
+	// HeaderDelivery is "<first id>-<last id>" of the delivered messages,
+	// receivers can use it to drop retried deliveries
+	HeaderDelivery = "X-Tipubsub-Delivery"
+)
+
+// Sign returns the value of the signature header, a hex HMAC-SHA256 of
+// "<timestamp>.<body>" prefixed by "sha256="
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature header of a delivery
+func Verify(secret string, timestamp int64, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
@@ -0,0 +1,34 @@
+// Copyright 2022 Ed Huang<i@huangdx.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import "testing"
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"id":"1"}`)
+	sig := Sign("secret", 1700000000, body)
+	if !Verify("secret", 1700000000, body, sig) {
+		t.Fatal("signature not verified")
+	}
+	for name, ok := range map[string]bool{
+		"other secret":    Verify("other", 1700000000, body, sig),
+		"other timestamp": Verify("secret", 1700000001, body, sig),
+		"other body":      Verify("secret", 1700000000, []byte(`{"id":"2"}`), sig),
+	} {
+		if ok {
+			t.Errorf("%s: signature verified", name)
+		}
+	}
+}